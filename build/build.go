@@ -0,0 +1,984 @@
+package build
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/container"
+	"aproton.tech/container/image"
+	"aproton.tech/container/utils"
+)
+
+// the shell of RUN, CMD and ENTRYPOINT in shell form
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// BuildOptions is how an image is built from a Dockerfile
+type BuildOptions struct {
+	// ContextDir has the files of COPY and ADD, Dockerfile is ContextDir/Dockerfile
+	// when it is empty
+	ContextDir string
+	Dockerfile string
+	// Tags name the image, without tags it is only in the build cache
+	Tags []string
+	// BuildArgs are the values of the ARGs of the Dockerfile
+	BuildArgs map[string]string
+	// Platform is the os/arch[/variant] of the base image, the host one when it is empty
+	Platform string
+	// NoCache runs every step, the images of the steps still replace the build cache
+	NoCache bool
+	// Output receives the steps and the output of RUN, it is os.Stdout when it is nil
+	Output io.Writer
+}
+
+// BuildResult is the built image
+type BuildResult struct {
+	Digest v1.Hash               `json:"digest"`
+	Images []*image.ImageSummary `json:"images,omitempty"`
+}
+
+func BuildCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "build [OPTIONS] CONTEXT",
+		Short: "build an image from a Dockerfile",
+		Args:  cobra.ExactArgs(1),
+		RunE:  BuildImageCommand,
+	}
+	cmd.Flags().StringArrayP("tag", "t", []string{}, "Name the image, name:tag")
+	cmd.Flags().StringP("file", "f", "", "The Dockerfile (default \"CONTEXT/Dockerfile\")")
+	cmd.Flags().StringArray("build-arg", []string{}, "Set an ARG of the Dockerfile, KEY=VALUE, the value of KEY alone is the one of the environment")
+	cmd.Flags().String("platform", "", "Build on the base image of the platform os/arch[/variant] (default the host platform)")
+	cmd.Flags().Bool("no-cache", false, "Do not use the build cache")
+	return cmd
+}
+
+func BuildImageCommand(cmd *cobra.Command, args []string) error {
+	tags, err := cmd.Flags().GetStringArray("tag")
+	if err != nil {
+		return err
+	}
+	buildArgs, err := cmd.Flags().GetStringArray("build-arg")
+	if err != nil {
+		return err
+	}
+
+	opts := BuildOptions{
+		ContextDir: args[0],
+		Dockerfile: cmd.Flag("file").Value.String(),
+		Tags:       tags,
+		BuildArgs:  map[string]string{},
+		Platform:   cmd.Flag("platform").Value.String(),
+		NoCache:    cmd.Flag("no-cache").Value.String() == "true",
+	}
+	for _, arg := range buildArgs {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			// like docker, KEY alone passes the variable of the environment
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		opts.BuildArgs[key] = value
+	}
+
+	_, err = Build(cmd.Context(), opts)
+	return err
+}
+
+// Build builds the image of the Dockerfile into the repository. Every step is an image
+// in the build cache, keyed by the step and the key of the step before it, so a step is
+// only run again when it or a step before it changes.
+func Build(ctx context.Context, opts BuildOptions) (*BuildResult, error) {
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = filepath.Join(opts.ContextDir, "Dockerfile")
+	}
+	if opts.Platform != "" {
+		if _, err := image.ParsePlatform(opts.Platform); err != nil {
+			return nil, err
+		}
+	}
+	for _, tag := range opts.Tags {
+		if _, err := name.ParseReference(tag); err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+	}
+
+	f, err := os.Open(opts.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	df, err := ParseDockerfile(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", opts.Dockerfile, err)
+	}
+	if len(df.Instructions) == 0 {
+		return nil, fmt.Errorf("%s has no instructions", opts.Dockerfile)
+	}
+
+	buildCtx, err := newBuildContext(opts.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(image.TempPath(), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(image.TempPath(), "build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// garbage collection must not remove the images of the steps while they are built on
+	unlock, err := image.LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	b := &builder{
+		opts:       opts,
+		out:        opts.Output,
+		escape:     df.Escape,
+		context:    buildCtx,
+		tmp:        tmp,
+		globalArgs: map[string]*string{},
+		args:       map[string]*string{},
+		usedArgs:   map[string]bool{},
+	}
+
+	for n, inst := range df.Instructions {
+		fmt.Fprintf(b.out, "Step %d/%d : %s\n", n+1, len(df.Instructions), inst.Original)
+		if err := b.dispatch(ctx, inst); err != nil {
+			return nil, err
+		}
+		if b.img != nil {
+			digest, err := b.img.Digest()
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(b.out, " ---> %s\n", digest.Hex[:12])
+		}
+	}
+
+	if b.img == nil {
+		return nil, errors.New("no build stage, the Dockerfile has no FROM instruction")
+	}
+
+	unused := []string{}
+	for key := range opts.BuildArgs {
+		if !b.usedArgs[key] {
+			unused = append(unused, key)
+		}
+	}
+	if len(unused) != 0 {
+		slices.Sort(unused)
+		fmt.Fprintf(b.out, "[Warning] One or more build-args %v were not consumed\n", unused)
+	}
+
+	digest, err := b.img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	result := &BuildResult{Digest: digest}
+	fmt.Fprintf(b.out, "Successfully built %s\n", digest.Hex[:12])
+
+	for _, tag := range opts.Tags {
+		summary, err := image.StoreImage(b.img, tag)
+		if err != nil {
+			return nil, err
+		}
+		result.Images = append(result.Images, summary)
+		fmt.Fprintf(b.out, "Successfully tagged %s\n", summary.Name)
+	}
+
+	return result, nil
+}
+
+// builder is the state of a build, the image of the last step and the variables
+type builder struct {
+	opts    BuildOptions
+	out     io.Writer
+	escape  rune
+	context *buildContext
+	// tmp has the layers and the downloads of the build
+	tmp string
+
+	img     v1.Image
+	imgName string
+	// cacheKey is the key of the image of the last step
+	cacheKey string
+	// cmdSet tells whether CMD is in the Dockerfile, ENTRYPOINT resets the inherited one
+	cmdSet bool
+
+	// the ARGs before FROM and the ones of the stage, a nil value is declared without one
+	globalArgs map[string]*string
+	args       map[string]*string
+	argOrder   []string
+	usedArgs   map[string]bool
+}
+
+func (b *builder) dispatch(ctx context.Context, inst *Instruction) error {
+	if inst.Command == "ARG" {
+		return b.arg(inst)
+	}
+	if inst.Command == "FROM" {
+		return b.from(ctx, inst)
+	}
+	if b.img == nil {
+		return fmt.Errorf("%s before FROM, the Dockerfile must start with FROM", inst.Command)
+	}
+
+	switch inst.Command {
+	case "RUN":
+		return b.run(ctx, inst)
+	case "COPY", "ADD":
+		return b.copy(ctx, inst)
+	case "ENV":
+		return b.env(inst)
+	case "LABEL":
+		return b.label(inst)
+	case "WORKDIR":
+		return b.workdir(inst)
+	case "USER":
+		return b.user(inst)
+	case "EXPOSE":
+		return b.expose(inst)
+	case "ENTRYPOINT", "CMD":
+		return b.command(inst)
+	}
+	return fmt.Errorf("instruction %s is not supported", inst.Command)
+}
+
+// config returns a copy of the config of the image of the last step
+func (b *builder) config() (*v1.ConfigFile, error) {
+	config, err := b.img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return config.DeepCopy(), nil
+}
+
+// lookup returns the variables of the instructions, an ENV is preferred to an ARG
+func (b *builder) lookup() (lookupFunc, error) {
+	env := []string{}
+	if b.img != nil {
+		config, err := b.config()
+		if err != nil {
+			return nil, err
+		}
+		env = config.Config.Env
+	}
+
+	args := b.args
+	if b.img == nil {
+		args = b.globalArgs
+	}
+
+	return func(name string) (string, bool) {
+		for i := len(env) - 1; i >= 0; i-- {
+			if key, value, _ := strings.Cut(env[i], "="); key == name {
+				return value, true
+			}
+		}
+		if value := args[name]; value != nil {
+			return *value, true
+		}
+		return "", false
+	}, nil
+}
+
+func (b *builder) from(ctx context.Context, inst *Instruction) error {
+	if b.img != nil {
+		return errors.New("multi-stage builds are not supported, the Dockerfile has more than one FROM")
+	}
+
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	words, err := expandWords(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && !(len(words) == 3 && strings.EqualFold(words[1], "AS")) {
+		return fmt.Errorf("FROM requires an image, optionally followed by AS name")
+	}
+	if err := checkFlags(inst, "platform"); err != nil {
+		return err
+	}
+
+	platform := b.opts.Platform
+	if flag, ok := inst.Flags["platform"]; ok {
+		if platform, err = expandWord(flag, b.escape, lookup); err != nil {
+			return err
+		}
+	}
+
+	if strings.EqualFold(words[0], "scratch") {
+		p := image.HostPlatform()
+		if platform != "" {
+			parsed, err := image.ParsePlatform(platform)
+			if err != nil {
+				return err
+			}
+			p = *parsed
+		}
+
+		b.imgName = "scratch"
+		b.img, err = mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+			OS:           p.OS,
+			Architecture: p.Architecture,
+			Variant:      p.Variant,
+			RootFS:       v1.RootFS{Type: "layers"},
+		})
+	} else {
+		b.imgName = words[0]
+		b.img, _, err = image.GetImage(ctx, words[0], platform, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	digest, err := b.img.Digest()
+	if err != nil {
+		return err
+	}
+	b.cacheKey = digest.String()
+	return nil
+}
+
+// arg declares ARGs, the value of a build arg is preferred to the default one and an ARG
+// of the stage without default gets the value of the global ARG
+func (b *builder) arg(inst *Instruction) error {
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	words, err := expandWords(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return err
+	}
+
+	for _, word := range words {
+		key, value, hasDefault := strings.Cut(word, "=")
+		if key == "" {
+			return fmt.Errorf("ARG requires a name: %q", word)
+		}
+
+		var arg *string
+		if hasDefault {
+			arg = &value
+		} else if b.img != nil && b.globalArgs[key] != nil {
+			global := *b.globalArgs[key]
+			arg = &global
+		}
+		if buildArg, ok := b.opts.BuildArgs[key]; ok {
+			arg = &buildArg
+			b.usedArgs[key] = true
+		}
+
+		if b.img == nil {
+			b.globalArgs[key] = arg
+			continue
+		}
+		if _, ok := b.args[key]; !ok {
+			b.argOrder = append(b.argOrder, key)
+		}
+		b.args[key] = arg
+	}
+
+	if b.img == nil {
+		return nil
+	}
+	return b.updateConfig("ARG "+strings.Join(words, " "), func(*v1.ConfigFile) error { return nil })
+}
+
+// argsEnv returns the ARGs with a value as the environment of RUN, unless an ENV
+// has the same name
+func (b *builder) argsEnv(config *v1.ConfigFile) []string {
+	env := []string{}
+	for _, key := range b.argOrder {
+		value := b.args[key]
+		if value == nil || slices.ContainsFunc(config.Config.Env, func(e string) bool { return strings.HasPrefix(e, key+"=") }) {
+			continue
+		}
+		env = append(env, key+"="+*value)
+	}
+	return env
+}
+
+func (b *builder) run(ctx context.Context, inst *Instruction) error {
+	if err := checkFlags(inst); err != nil {
+		return err
+	}
+
+	entrypoint, cmd := defaultShell, inst.Args
+	if inst.JSON {
+		if len(inst.Args) == 0 {
+			return errors.New("RUN requires a command")
+		}
+		entrypoint, cmd = inst.Args[:1], inst.Args[1:]
+	}
+	command := append(append([]string{}, entrypoint...), cmd...)
+
+	config, err := b.config()
+	if err != nil {
+		return err
+	}
+	env := b.argsEnv(config)
+
+	// the ARGs are part of the step, RUN runs again when one of them changes
+	createdBy := strings.Join(command, " ")
+	if len(env) != 0 {
+		createdBy = fmt.Sprintf("|%d %s %s", len(env), strings.Join(env, " "), createdBy)
+	}
+
+	return b.commit(createdBy, func() (v1.Image, error) {
+		cnt, err := container.CreateContainer(ctx, container.RunOptions{
+			Image:      b.imgName,
+			Rootfs:     b.img,
+			Entrypoint: entrypoint,
+			Cmd:        cmd,
+			Env:        env,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer b.removeContainer(cnt)
+
+		fmt.Fprintf(b.out, " ---> Running in %s\n", cnt.ContainerID)
+		if cnt.Overlay == nil {
+			return nil, errors.New("RUN needs an overlay sandbox to record the changes of the command")
+		}
+
+		mountPoints, err := runtimeMountPoints(cnt.Sandbox)
+		if err != nil {
+			return nil, err
+		}
+
+		rc, err := container.StartContainer(ctx, cnt.ContainerID, container.StartOptions{
+			Stdout: b.out,
+			Stderr: b.out,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result, err := rc.Wait()
+		if err != nil {
+			return nil, err
+		}
+		if result.ExitCode != 0 {
+			return nil, fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(command, " "), result.ExitCode)
+		}
+
+		return b.appendLayer(cnt.Overlay.Upper, createdBy, mountPoints...)
+	})
+}
+
+// runtimeMountPoints returns the paths which the runtime creates in the rootfs to mount its
+// files on, relative to the rootfs. They are not in the image and stay out of the layer.
+func runtimeMountPoints(sandbox string) ([]string, error) {
+	paths := []string{}
+	for _, file := range container.RuntimeFiles {
+		for p := file; p != "/"; p = filepath.Dir(p) {
+			rel := strings.TrimPrefix(p, "/")
+			if slices.Contains(paths, rel) {
+				continue
+			}
+			target, err := securejoin.SecureJoin(sandbox, p)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Lstat(target); errors.Is(err, os.ErrNotExist) {
+				paths = append(paths, rel)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return paths, nil
+}
+
+func (b *builder) copy(ctx context.Context, inst *Instruction) error {
+	if _, ok := inst.Flags["from"]; ok {
+		return fmt.Errorf("%s --from is not supported, only a single stage is built", inst.Command)
+	}
+	if err := checkFlags(inst, "chown", "chmod"); err != nil {
+		return err
+	}
+
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	args := []string{}
+	if inst.JSON {
+		for _, arg := range inst.Args {
+			word, err := expandWord(arg, b.escape, lookup)
+			if err != nil {
+				return err
+			}
+			args = append(args, word)
+		}
+	} else if args, err = expandWords(inst.Args[0], b.escape, lookup); err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s requires at least two arguments, but got %d", inst.Command, len(args))
+	}
+
+	config, err := b.config()
+	if err != nil {
+		return err
+	}
+
+	req := &copyRequest{context: b.context, chown: inst.Flags["chown"]}
+	if req.chmod, err = parseChmod(inst.Flags["chmod"]); err != nil {
+		return err
+	}
+
+	dest := args[len(args)-1]
+	req.destDir = strings.HasSuffix(dest, "/") || strings.HasSuffix(dest, "/.") || dest == "."
+	if !path.IsAbs(dest) {
+		workdir := config.Config.WorkingDir
+		if workdir == "" {
+			workdir = "/"
+		}
+		dest = path.Join(workdir, dest)
+	}
+	req.dest = path.Clean(dest)
+
+	for _, src := range args[:len(args)-1] {
+		if inst.Command == "ADD" && isURL(src) {
+			source, err := download(ctx, src, b.tmp)
+			if err != nil {
+				return err
+			}
+			req.sources = append(req.sources, source)
+			continue
+		}
+		if isURL(src) {
+			return fmt.Errorf("COPY can not download %s, use ADD", src)
+		}
+
+		sources, err := b.context.resolve(src)
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", inst.Command, err)
+		}
+		for _, source := range sources {
+			// a symlink named as a source was resolved, the ones in a directory are copied
+			if source.info, err = os.Lstat(source.path); err != nil {
+				return fmt.Errorf("%s failed: %w", inst.Command, err)
+			}
+			source.extract = inst.Command == "ADD" && source.info.Mode().IsRegular() && isArchive(source.path)
+			req.sources = append(req.sources, source)
+		}
+	}
+
+	if len(req.sources) > 1 {
+		if !req.destDir {
+			return fmt.Errorf("when using %s with more than one source file, the destination must be a directory and end with a /", inst.Command)
+		}
+	} else if req.sources[0].info.IsDir() || req.sources[0].extract {
+		req.destDir = true
+	}
+
+	checksum, err := req.checksum()
+	if err != nil {
+		return err
+	}
+	kind := "multi"
+	if len(req.sources) == 1 {
+		kind = "file"
+		if req.sources[0].info.IsDir() {
+			kind = "dir"
+		}
+	}
+	flags := ""
+	for _, flag := range []string{"chown", "chmod"} {
+		if value, ok := inst.Flags[flag]; ok {
+			flags += fmt.Sprintf("--%s=%s ", flag, value)
+		}
+	}
+	createdBy := fmt.Sprintf("/bin/sh -c #(nop) %s %s%s:%s in %s ", inst.Command, flags, kind, checksum, req.dest)
+
+	return b.commit(createdBy, func() (v1.Image, error) {
+		// the files are copied into the overlay of a container, its upper dir is the layer
+		cnt, err := container.CreateContainer(ctx, container.RunOptions{
+			Image:      b.imgName,
+			Rootfs:     b.img,
+			Entrypoint: defaultShell,
+			Cmd:        []string{"#(nop) " + inst.Original},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer b.removeContainer(cnt)
+
+		if cnt.Overlay == nil {
+			return nil, fmt.Errorf("%s needs an overlay sandbox to record the copied files", inst.Command)
+		}
+		if err := req.apply(cnt.Sandbox); err != nil {
+			return nil, fmt.Errorf("%s failed: %w", inst.Command, err)
+		}
+		return b.appendLayer(cnt.Overlay.Upper, createdBy)
+	})
+}
+
+// keyValues returns the KEY=VALUE pairs of ENV and LABEL, the legacy form KEY VALUE
+// sets a single variable to the rest of the line
+func (b *builder) keyValues(inst *Instruction) ([][2]string, error) {
+	lookup, err := b.lookup()
+	if err != nil {
+		return nil, err
+	}
+
+	first := strings.Fields(inst.Args[0])[0]
+	if !strings.Contains(first, "=") {
+		rest := strings.TrimSpace(strings.TrimPrefix(inst.Args[0], first))
+		if rest == "" {
+			return nil, fmt.Errorf("%s %s requires a value", inst.Command, first)
+		}
+		value, err := expandWord(rest, b.escape, lookup)
+		if err != nil {
+			return nil, err
+		}
+		return [][2]string{{first, value}}, nil
+	}
+
+	words, err := expandWords(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return nil, err
+	}
+	pairs := [][2]string{}
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s syntax error: can't find = in %q, it must be of the form name=value", inst.Command, word)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
+
+func joinPairs(pairs [][2]string) string {
+	joined := []string{}
+	for _, pair := range pairs {
+		joined = append(joined, pair[0]+"="+pair[1])
+	}
+	return strings.Join(joined, " ")
+}
+
+func (b *builder) env(inst *Instruction) error {
+	pairs, err := b.keyValues(inst)
+	if err != nil {
+		return err
+	}
+
+	return b.updateConfig("ENV "+joinPairs(pairs), func(config *v1.ConfigFile) error {
+		for _, pair := range pairs {
+			config.Config.Env = setEnv(config.Config.Env, pair[0], pair[1])
+		}
+		return nil
+	})
+}
+
+// setEnv returns env with the variable added or replaced
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+func (b *builder) label(inst *Instruction) error {
+	pairs, err := b.keyValues(inst)
+	if err != nil {
+		return err
+	}
+
+	return b.updateConfig("LABEL "+joinPairs(pairs), func(config *v1.ConfigFile) error {
+		if config.Config.Labels == nil {
+			config.Config.Labels = map[string]string{}
+		}
+		for _, pair := range pairs {
+			config.Config.Labels[pair[0]] = pair[1]
+		}
+		return nil
+	})
+}
+
+// workdir sets the working directory, a relative one is relative to the one before,
+// it is created by the next RUN or COPY, or when a container of the image starts
+func (b *builder) workdir(inst *Instruction) error {
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	dir, err := expandWord(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return err
+	}
+
+	config, err := b.config()
+	if err != nil {
+		return err
+	}
+	if !path.IsAbs(dir) {
+		dir = path.Join("/", config.Config.WorkingDir, dir)
+	}
+	dir = path.Clean(dir)
+
+	return b.updateConfig("WORKDIR "+dir, func(config *v1.ConfigFile) error {
+		config.Config.WorkingDir = dir
+		return nil
+	})
+}
+
+func (b *builder) user(inst *Instruction) error {
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	user, err := expandWord(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return err
+	}
+
+	return b.updateConfig("USER "+user, func(config *v1.ConfigFile) error {
+		config.Config.User = user
+		return nil
+	})
+}
+
+func (b *builder) expose(inst *Instruction) error {
+	lookup, err := b.lookup()
+	if err != nil {
+		return err
+	}
+	words, err := expandWords(inst.Args[0], b.escape, lookup)
+	if err != nil {
+		return err
+	}
+
+	ports := []string{}
+	for _, word := range words {
+		expanded, err := parsePorts(word)
+		if err != nil {
+			return err
+		}
+		ports = append(ports, expanded...)
+	}
+
+	return b.updateConfig("EXPOSE "+strings.Join(ports, " "), func(config *v1.ConfigFile) error {
+		if config.Config.ExposedPorts == nil {
+			config.Config.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range ports {
+			config.Config.ExposedPorts[port] = struct{}{}
+		}
+		return nil
+	})
+}
+
+// parsePorts parses port[-port][/protocol] of EXPOSE, the protocol is tcp by default
+func parsePorts(spec string) ([]string, error) {
+	ports, proto, _ := strings.Cut(spec, "/")
+	proto = strings.ToLower(proto)
+	if proto == "" {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return nil, fmt.Errorf("invalid proto: %s", proto)
+	}
+
+	first, last, isRange := strings.Cut(ports, "-")
+	start, err := strconv.ParseUint(first, 10, 16)
+	if err != nil || start == 0 {
+		return nil, fmt.Errorf("invalid containerPort: %s", spec)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.ParseUint(last, 10, 16); err != nil || end < start {
+			return nil, fmt.Errorf("invalid containerPort: %s", spec)
+		}
+	}
+
+	expanded := []string{}
+	for port := start; port <= end; port++ {
+		expanded = append(expanded, fmt.Sprintf("%d/%s", port, proto))
+	}
+	return expanded, nil
+}
+
+// command sets ENTRYPOINT or CMD, the shell form is run by /bin/sh -c. ENTRYPOINT
+// resets the CMD of the base image, a CMD of the Dockerfile is kept.
+func (b *builder) command(inst *Instruction) error {
+	args := inst.Args
+	if !inst.JSON {
+		args = append(append([]string{}, defaultShell...), inst.Args[0])
+	}
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	if inst.Command == "CMD" {
+		b.cmdSet = true
+		return b.updateConfig("CMD "+string(encoded), func(config *v1.ConfigFile) error {
+			config.Config.Cmd = args
+			return nil
+		})
+	}
+
+	return b.updateConfig("ENTRYPOINT "+string(encoded), func(config *v1.ConfigFile) error {
+		config.Config.Entrypoint = args
+		if !b.cmdSet {
+			config.Config.Cmd = nil
+		}
+		return nil
+	})
+}
+
+// cacheKey is the key of a step in the build cache, it chains the key of the step
+// before, so the image of a step is only the same when all steps before it are
+func cacheKey(parent string, createdBy string) string {
+	sum := sha256.Sum256([]byte(parent + "\n" + createdBy))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// commit sets the image of the step, the one of the build cache or the one returned by
+// step, which is stored into the build cache
+func (b *builder) commit(createdBy string, step func() (v1.Image, error)) error {
+	key := cacheKey(b.cacheKey, createdBy)
+
+	if !b.opts.NoCache {
+		img, err := image.FindBuildCache(key)
+		if err == nil {
+			fmt.Fprintln(b.out, " ---> Using cache")
+			b.img, b.cacheKey = img, key
+			return nil
+		}
+		if !errors.Is(err, image.ErrImageNotFound) {
+			return err
+		}
+	}
+
+	img, err := step()
+	if err != nil {
+		return err
+	}
+	if img, err = image.StoreBuildCache(img, key); err != nil {
+		return err
+	}
+	b.img, b.cacheKey = img, key
+	return nil
+}
+
+// updateConfig commits a step which only changes the config, its history has no layer
+func (b *builder) updateConfig(instruction string, update func(config *v1.ConfigFile) error) error {
+	createdBy := "/bin/sh -c #(nop) " + instruction
+	return b.commit(createdBy, func() (v1.Image, error) {
+		config, err := b.config()
+		if err != nil {
+			return nil, err
+		}
+		if err := update(config); err != nil {
+			return nil, err
+		}
+
+		now := v1.Time{Time: time.Now().UTC()}
+		config.Created = now
+		config.History = append(config.History, v1.History{Created: now, CreatedBy: createdBy, EmptyLayer: true})
+		return mutate.ConfigFile(b.img, config)
+	})
+}
+
+// appendLayer adds the changes of the upper dir of a container as a layer of the image,
+// without the excluded paths
+func (b *builder) appendLayer(upper string, createdBy string, excluded ...string) (v1.Image, error) {
+	f, err := os.CreateTemp(b.tmp, "layer-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	if err := utils.Tar(upper, gz, utils.FromOverlayWhiteouts(), utils.WithoutPaths(excluded...)); err != nil {
+		return nil, fmt.Errorf("write layer: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	// the layers of a docker image are docker layers, the ones of an OCI image OCI layers
+	mediaType := types.DockerLayer
+	if manifestType, err := b.img.MediaType(); err == nil && manifestType == types.OCIManifestSchema1 {
+		mediaType = types.OCILayer
+	}
+	layer, err := tarball.LayerFromFile(f.Name(), tarball.WithMediaType(mediaType))
+	if err != nil {
+		return nil, err
+	}
+
+	now := v1.Time{Time: time.Now().UTC()}
+	img, err := mutate.Append(b.img, mutate.Addendum{
+		Layer:   layer,
+		History: v1.History{Created: now, CreatedBy: createdBy},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mutate.CreatedAt(img, now)
+}
+
+func (b *builder) removeContainer(cnt *container.ContainerMeta) {
+	if err := container.RemoveContainer(cnt.ContainerID); err != nil {
+		logrus.Warnf("remove build container %s: %v", cnt.ContainerID, err)
+		return
+	}
+	fmt.Fprintf(b.out, "Removing intermediate container %s\n", cnt.ContainerID)
+}
+
+// checkFlags returns an error for a flag of the instruction which is not supported
+func checkFlags(inst *Instruction, supported ...string) error {
+	for flag := range inst.Flags {
+		if !slices.Contains(supported, flag) {
+			return fmt.Errorf("%s --%s is not supported", inst.Command, flag)
+		}
+	}
+	return nil
+}
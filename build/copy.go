@@ -0,0 +1,538 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+
+	"aproton.tech/container/utils"
+)
+
+// buildContext is the directory of the files COPY and ADD read, the files matched by
+// its .dockerignore are left out
+type buildContext struct {
+	dir     string
+	ignored *patternmatcher.PatternMatcher
+}
+
+func newBuildContext(dir string) (*buildContext, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, fmt.Errorf("build context: %w", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("build context %s is not a directory", dir)
+	}
+
+	patterns := []string{}
+	f, err := os.Open(filepath.Join(abs, ".dockerignore"))
+	if err == nil {
+		patterns, err = ignorefile.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read .dockerignore: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ignored, err := patternmatcher.New(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid .dockerignore: %w", err)
+	}
+
+	return &buildContext{dir: abs, ignored: ignored}, nil
+}
+
+// excluded tells whether the file of the context, relative to it, is left out
+func (c *buildContext) excluded(rel string) (bool, error) {
+	if rel == "." || rel == "" {
+		return false, nil
+	}
+	return c.ignored.MatchesOrParentMatches(filepath.ToSlash(rel))
+}
+
+// resolve returns the files of the context matched by the source of COPY. The symlinks
+// of a source and of its parent directories are resolved inside the context, like
+// docker does, so a source can not point out of the context.
+func (c *buildContext) resolve(src string) ([]*copySource, error) {
+	clean := strings.TrimPrefix(filepath.Clean("/"+src), "/")
+	if clean == "" {
+		clean = "."
+	}
+
+	matches := []string{filepath.Join(c.dir, clean)}
+	if strings.ContainsAny(clean, "*?[") {
+		var err error
+		if matches, err = filepath.Glob(filepath.Join(c.dir, clean)); err != nil {
+			return nil, err
+		}
+	}
+
+	found := []*copySource{}
+	for _, match := range matches {
+		rel, err := filepath.Rel(c.dir, match)
+		if err != nil {
+			return nil, err
+		}
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("%s is out of the build context", src)
+		}
+
+		path, err := securejoin.SecureJoin(c.dir, rel)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return nil, err
+		}
+
+		// a symlink can not bring in a file excluded by .dockerignore
+		if excluded, err := c.excluded(rel); err != nil {
+			return nil, err
+		} else if excluded {
+			continue
+		}
+		if excluded, err := c.excluded(resolved); err != nil {
+			return nil, err
+		} else if excluded {
+			continue
+		}
+
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+		found = append(found, &copySource{path: path, rel: resolved, name: filepath.Base(match)})
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("file not found in build context or excluded by .dockerignore: %s", src)
+	}
+	return found, nil
+}
+
+// copySource is a file or directory copied by COPY or ADD
+type copySource struct {
+	// path is the file on the host, rel is its path in the build context, it is
+	// empty for a file downloaded by ADD
+	path string
+	rel  string
+	// name is the file name of the source, the name of a symlink in the context or
+	// of a download
+	name string
+	info fs.FileInfo
+	// extract is an archive of ADD, which is extracted into the destination
+	extract bool
+}
+
+// copyRequest is a COPY or ADD with the sources resolved
+type copyRequest struct {
+	context *buildContext
+	sources []*copySource
+	// dest is the absolute path in the image, it is a directory when destDir is set
+	dest    string
+	destDir bool
+	chown   string
+	chmod   *fs.FileMode
+}
+
+// copyEntry is a file of the sources, name is its path relative to the destination,
+// it is empty for the destination itself
+type copyEntry struct {
+	path string
+	info fs.FileInfo
+	name string
+}
+
+// walk calls fn for every file of the sources, the content of a directory is copied,
+// not the directory itself
+func (r *copyRequest) walk(fn func(src *copySource, entry copyEntry) error) error {
+	for _, src := range r.sources {
+		if !src.info.IsDir() {
+			name := src.name
+			if name == "" {
+				name = filepath.Base(src.path)
+			}
+			if !r.destDir {
+				name = ""
+			}
+			if err := fn(src, copyEntry{path: src.path, info: src.info, name: name}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := filepath.WalkDir(src.path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name, err := filepath.Rel(src.path, p)
+			if err != nil {
+				return err
+			}
+			if name == "." {
+				name = ""
+			} else if excluded, err := r.context.excluded(filepath.Join(src.rel, name)); err != nil {
+				return err
+			} else if excluded {
+				// a pattern with ! may bring back a file of an excluded directory
+				if d.IsDir() && !r.context.ignored.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return fn(src, copyEntry{path: p, info: info, name: filepath.ToSlash(name)})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum is the hash of the names, modes and content of the copied files, the
+// step is taken from the build cache when it has not changed
+func (r *copyRequest) checksum() (string, error) {
+	h := sha256.New()
+	err := r.walk(func(src *copySource, entry copyEntry) error {
+		link := ""
+		if entry.info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(entry.path); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%t\x00%s\x00", entry.name, entry.info.Mode(), src.extract, link)
+
+		if !entry.info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// apply copies the sources into the root filesystem of the image, the archives of ADD
+// are extracted into the destination directory
+func (r *copyRequest) apply(root string) error {
+	uid, gid := 0, 0
+	if r.chown != "" {
+		var err error
+		if uid, gid, err = lookupOwner(root, r.chown); err != nil {
+			return err
+		}
+	}
+
+	// a single file copied to an existing directory is copied into it
+	if !r.destDir {
+		if target, err := securejoin.SecureJoin(root, r.dest); err == nil {
+			if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+				r.destDir = true
+			}
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.writeTar(pw, root, uid, gid))
+	}()
+	if err := utils.Untar(pr, root); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	for _, src := range r.sources {
+		if !src.extract {
+			continue
+		}
+
+		target, err := securejoin.SecureJoin(root, r.dest)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := extractArchive(src.path, target); err != nil {
+			return fmt.Errorf("extract %s: %w", src.rel, err)
+		}
+	}
+	return nil
+}
+
+// writeTar writes the files of the sources as a tar stream, named by their path in root
+func (r *copyRequest) writeTar(w io.Writer, root string, uid, gid int) error {
+	tw := tar.NewWriter(w)
+	err := r.walk(func(src *copySource, entry copyEntry) error {
+		if src.extract {
+			return nil
+		}
+
+		name := path.Join(r.dest, entry.name)
+		if entry.name == "" && entry.info.IsDir() {
+			// the destination directory keeps its attributes when it exists
+			if target, err := securejoin.SecureJoin(root, name); err == nil {
+				if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+					return nil
+				}
+			}
+		}
+
+		link := ""
+		if entry.info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(entry.path); err != nil {
+				return err
+			}
+		} else if !entry.info.Mode().IsRegular() && !entry.info.IsDir() {
+			// sockets, pipes and devices of the context are not copied
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(entry.info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if r.chmod != nil && hdr.Typeflag != tar.TypeSymlink {
+			hdr.Mode = int64(*r.chmod)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !entry.info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// parseChmod parses the octal permission bits of --chmod
+func parseChmod(chmod string) (*fs.FileMode, error) {
+	if chmod == "" {
+		return nil, nil
+	}
+	perm, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil || perm > 07777 {
+		return nil, fmt.Errorf("invalid --chmod %q, it must be octal", chmod)
+	}
+	mode := fs.FileMode(perm)
+	return &mode, nil
+}
+
+// lookupOwner returns the ids of user[:group] of --chown, the names are looked up in
+// /etc/passwd and /etc/group of the image. The group is the user id when it is omitted.
+func lookupOwner(root string, chown string) (int, int, error) {
+	user, group, hasGroup := strings.Cut(chown, ":")
+
+	uid, err := lookupID(root, "/etc/passwd", user)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to find user %s: %w", user, err)
+	}
+	if !hasGroup {
+		return uid, uid, nil
+	}
+
+	gid, err := lookupID(root, "/etc/group", group)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to find group %s: %w", group, err)
+	}
+	return uid, gid, nil
+}
+
+// lookupID returns the id of a name of the passwd or group file, name:x:id:...
+func lookupID(root string, file string, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	path, err := securejoin.SecureJoin(root, file)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) >= 3 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no matching entries in %s", file)
+}
+
+// isURL tells whether a source of ADD is downloaded
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// download fetches the source of ADD into dir, the file gets the modification time of
+// the Last-Modified header
+func download(ctx context.Context, src string, dir string) (*copySource, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return nil, fmt.Errorf("can not determine a file name from the url %s", src)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: %s", src, resp.Status)
+	}
+
+	f, err := os.CreateTemp(dir, "download-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return nil, fmt.Errorf("download %s: %w", src, err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(f.Name(), modified, modified); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &copySource{path: f.Name(), name: name, info: info}, nil
+}
+
+// isArchive tells whether a local source of ADD is a tar archive, plain or compressed
+// by gzip or bzip2
+func isArchive(file string) bool {
+	rc, err := openArchive(file)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	_, err = tar.NewReader(rc).Next()
+	return err == nil
+}
+
+func extractArchive(file string, target string) error {
+	rc, err := openArchive(file)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return utils.Untar(rc, target)
+}
+
+// openArchive returns the decompressed content of the file
+func openArchive(file string) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(3)
+
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = gz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
@@ -0,0 +1,157 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// the instructions of a Dockerfile which can be built
+var supportedInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "ARG": true, "WORKDIR": true,
+	"USER": true, "EXPOSE": true, "LABEL": true, "ENTRYPOINT": true, "CMD": true,
+}
+
+// the instructions whose arguments may be a JSON array, the exec form
+var jsonInstructions = map[string]bool{
+	"RUN": true, "COPY": true, "ADD": true, "ENTRYPOINT": true, "CMD": true,
+}
+
+// the instructions with --name=value flags before the arguments
+var flagInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true,
+}
+
+var directivePattern = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// Instruction is a line of a Dockerfile, continuation lines joined
+type Instruction struct {
+	// Command is the instruction in upper case, e.g. RUN
+	Command string
+	// Flags are the --name=value before the arguments, e.g. --chown=1000 of COPY
+	Flags map[string]string
+	// Args is the JSON array of the exec form, otherwise the rest of the line
+	Args []string
+	JSON bool
+	// Original is the instruction as it is written, for the output of the build
+	Original string
+	Line     int
+}
+
+// Dockerfile is a parsed Dockerfile
+type Dockerfile struct {
+	Instructions []*Instruction
+	// Escape is the escape character of the Dockerfile, \ unless the escape directive sets `
+	Escape rune
+}
+
+// ParseDockerfile reads the instructions of the Dockerfile. The escape directive is
+// supported, the other parser directives like syntax are ignored.
+func ParseDockerfile(r io.Reader) (*Dockerfile, error) {
+	escape := '\\'
+	directives := true
+
+	instructions := []*Instruction{}
+	var pending *Instruction
+	text := ""
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if lineno == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		trimmed := strings.TrimSpace(line)
+
+		if directives {
+			if m := directivePattern.FindStringSubmatch(trimmed); m != nil {
+				if strings.ToLower(m[1]) == "escape" {
+					if m[2] != "\\" && m[2] != "`" {
+						return nil, fmt.Errorf("line %d: invalid escape token %q, it must be \\ or `", lineno, m[2])
+					}
+					escape = rune(m[2][0])
+				}
+				continue
+			}
+			directives = false
+		}
+
+		// comments and empty lines are skipped, also between continuation lines
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if pending == nil {
+			pending = &Instruction{Line: lineno}
+			text = ""
+		}
+
+		if strings.HasSuffix(line, string(escape)) {
+			text += strings.TrimSuffix(line, string(escape))
+			continue
+		}
+		text += line
+
+		if err := parseInstruction(pending, text); err != nil {
+			return nil, fmt.Errorf("line %d: %w", pending.Line, err)
+		}
+		instructions = append(instructions, pending)
+		pending = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if pending != nil {
+		if err := parseInstruction(pending, text); err != nil {
+			return nil, fmt.Errorf("line %d: %w", pending.Line, err)
+		}
+		instructions = append(instructions, pending)
+	}
+
+	return &Dockerfile{Instructions: instructions, Escape: escape}, nil
+}
+
+func parseInstruction(inst *Instruction, text string) error {
+	text = strings.TrimSpace(text)
+	inst.Original = text
+
+	command, rest := text, ""
+	if n := strings.IndexAny(text, " \t"); n >= 0 {
+		command, rest = text[:n], text[n+1:]
+	}
+	inst.Command = strings.ToUpper(command)
+	rest = strings.TrimSpace(rest)
+
+	if !supportedInstructions[inst.Command] {
+		return fmt.Errorf("instruction %s is not supported", inst.Command)
+	}
+
+	inst.Flags = map[string]string{}
+	if flagInstructions[inst.Command] {
+		for strings.HasPrefix(rest, "--") {
+			flag, remaining, _ := strings.Cut(rest, " ")
+			key, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+			inst.Flags[key] = value
+			rest = strings.TrimSpace(remaining)
+		}
+	}
+
+	if jsonInstructions[inst.Command] && strings.HasPrefix(rest, "[") {
+		args := []string{}
+		if err := json.Unmarshal([]byte(rest), &args); err == nil {
+			inst.Args, inst.JSON = args, true
+			return nil
+		}
+	}
+
+	if rest == "" {
+		return fmt.Errorf("%s requires at least one argument", inst.Command)
+	}
+	inst.Args = []string{rest}
+	return nil
+}
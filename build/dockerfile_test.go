@@ -0,0 +1,139 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		dockerfile string
+		want       []*Instruction
+		escape     rune
+	}{
+		{
+			name:       "shell form",
+			dockerfile: "FROM scratch\nrun echo hello\n",
+			want: []*Instruction{
+				{Command: "FROM", Args: []string{"scratch"}, Line: 1},
+				{Command: "RUN", Args: []string{"echo hello"}, Line: 2},
+			},
+		},
+		{
+			name:       "exec form",
+			dockerfile: `CMD ["/bin/sh", "-c", "echo \"hi\""]`,
+			want:       []*Instruction{{Command: "CMD", Args: []string{"/bin/sh", "-c", `echo "hi"`}, JSON: true, Line: 1}},
+		},
+		{
+			name:       "invalid JSON is the shell form",
+			dockerfile: "ENTRYPOINT [sh, -c]",
+			want:       []*Instruction{{Command: "ENTRYPOINT", Args: []string{"[sh, -c]"}, Line: 1}},
+		},
+		{
+			name:       "no exec form for ENV",
+			dockerfile: `ENV A ["x"]`,
+			want:       []*Instruction{{Command: "ENV", Args: []string{`A ["x"]`}, Line: 1}},
+		},
+		{
+			name:       "continuation lines",
+			dockerfile: "RUN echo a \\\n    && echo b \\\n\n    && echo c",
+			want:       []*Instruction{{Command: "RUN", Args: []string{"echo a     && echo b     && echo c"}, Line: 1}},
+		},
+		{
+			name:       "comment between continuation lines",
+			dockerfile: "RUN echo a \\\n# comment\n  b\nUSER app",
+			want: []*Instruction{
+				{Command: "RUN", Args: []string{"echo a   b"}, Line: 1},
+				{Command: "USER", Args: []string{"app"}, Line: 4},
+			},
+		},
+		{
+			name:       "continuation at the end",
+			dockerfile: "WORKDIR /app \\",
+			want:       []*Instruction{{Command: "WORKDIR", Args: []string{"/app"}, Line: 1}},
+		},
+		{
+			name:       "flags",
+			dockerfile: "COPY --chown=1000:1000 --chmod=755 src /dst\nFROM --platform=linux/arm64 busybox",
+			want: []*Instruction{
+				{Command: "COPY", Flags: map[string]string{"chown": "1000:1000", "chmod": "755"}, Args: []string{"src /dst"}, Line: 1},
+				{Command: "FROM", Flags: map[string]string{"platform": "linux/arm64"}, Args: []string{"busybox"}, Line: 2},
+			},
+		},
+		{
+			name:       "no flags for LABEL",
+			dockerfile: "LABEL --a=b",
+			want:       []*Instruction{{Command: "LABEL", Args: []string{"--a=b"}, Line: 1}},
+		},
+		{
+			name:       "escape directive",
+			dockerfile: "# escape=`\n\nRUN dir c:\\ `\n  /w",
+			want:       []*Instruction{{Command: "RUN", Args: []string{`dir c:\   /w`}, Line: 3}},
+			escape:     '`',
+		},
+		{
+			name:       "directive after an instruction is a comment",
+			dockerfile: "FROM scratch\n# escape=`\nRUN a \\\n b",
+			want: []*Instruction{
+				{Command: "FROM", Args: []string{"scratch"}, Line: 1},
+				{Command: "RUN", Args: []string{"a  b"}, Line: 3},
+			},
+		},
+		{
+			name:       "byte order mark and carriage returns",
+			dockerfile: "\ufeffFROM scratch\r\nEXPOSE 80\r\n",
+			want: []*Instruction{
+				{Command: "FROM", Args: []string{"scratch"}, Line: 1},
+				{Command: "EXPOSE", Args: []string{"80"}, Line: 2},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			df, err := ParseDockerfile(strings.NewReader(tc.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			escape := tc.escape
+			if escape == 0 {
+				escape = '\\'
+			}
+			if df.Escape != escape {
+				t.Errorf("escape %q, want %q", df.Escape, escape)
+			}
+
+			if len(df.Instructions) != len(tc.want) {
+				t.Fatalf("%d instructions, want %d", len(df.Instructions), len(tc.want))
+			}
+			for i, got := range df.Instructions {
+				want := tc.want[i]
+				if want.Flags == nil {
+					want.Flags = map[string]string{}
+				}
+				if got.Command != want.Command || !reflect.DeepEqual(got.Flags, want.Flags) ||
+					!reflect.DeepEqual(got.Args, want.Args) || got.JSON != want.JSON || got.Line != want.Line {
+					t.Errorf("instruction %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDockerfileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		dockerfile string
+		err        string
+	}{
+		{"FROM scratch\nONBUILD RUN echo", "line 2: instruction ONBUILD is not supported"},
+		{"RUN", "line 1: RUN requires at least one argument"},
+		{"COPY --chown=1", "line 1: COPY requires at least one argument"},
+		{"# escape=!\nFROM scratch", "line 1: invalid escape token"},
+	} {
+		_, err := ParseDockerfile(strings.NewReader(tc.dockerfile))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("ParseDockerfile(%q) = %v, want %q", tc.dockerfile, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// lookupFunc returns the value of a variable of the build, an ENV or an ARG
+type lookupFunc func(name string) (string, bool)
+
+// expandWords splits the arguments into words like a shell does, the variables are
+// substituted and the quotes removed. $VAR, ${VAR} and the modifiers :- - :+ + :? ?
+// of ${VAR} are supported.
+func expandWords(text string, escape rune, lookup lookupFunc) ([]string, error) {
+	l := &wordLexer{input: []rune(text), escape: escape, lookup: lookup}
+	return l.words(true, 0)
+}
+
+// expandWord substitutes the variables of the argument and removes the quotes,
+// the whitespace is kept
+func expandWord(text string, escape rune, lookup lookupFunc) (string, error) {
+	l := &wordLexer{input: []rune(text), escape: escape, lookup: lookup}
+	words, err := l.words(false, 0)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(words, ""), nil
+}
+
+type wordLexer struct {
+	input  []rune
+	pos    int
+	escape rune
+	lookup lookupFunc
+}
+
+// words reads the input until stop, which is consumed, or until the end when stop is 0
+func (l *wordLexer) words(split bool, stop rune) ([]string, error) {
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+
+	for l.pos < len(l.input) {
+		ch := l.input[l.pos]
+		if stop != 0 && ch == stop {
+			l.pos++
+			if inWord || !split {
+				words = append(words, word.String())
+			}
+			return words, nil
+		}
+		l.pos++
+
+		switch {
+		case split && unicode.IsSpace(ch):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case ch == '\'':
+			value, err := l.singleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			inWord = true
+		case ch == '"':
+			value, err := l.doubleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			inWord = true
+		case ch == '$':
+			value, err := l.variable()
+			if err != nil {
+				return nil, err
+			}
+			// an empty variable out of quotes is no word
+			word.WriteString(value)
+			inWord = inWord || value != ""
+		case ch == l.escape:
+			if l.pos < len(l.input) {
+				word.WriteRune(l.input[l.pos])
+				l.pos++
+			}
+			inWord = true
+		default:
+			word.WriteRune(ch)
+			inWord = true
+		}
+	}
+
+	if stop != 0 {
+		return nil, fmt.Errorf("missing '%c' in %q", stop, string(l.input))
+	}
+	if inWord || !split {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func (l *wordLexer) singleQuoted() (string, error) {
+	end := l.pos
+	for end < len(l.input) && l.input[end] != '\'' {
+		end++
+	}
+	if end == len(l.input) {
+		return "", errors.New("unexpected end of statement while looking for matching single-quote")
+	}
+
+	value := string(l.input[l.pos:end])
+	l.pos = end + 1
+	return value, nil
+}
+
+func (l *wordLexer) doubleQuoted() (string, error) {
+	value := strings.Builder{}
+	for l.pos < len(l.input) {
+		ch := l.input[l.pos]
+		l.pos++
+
+		switch {
+		case ch == '"':
+			return value.String(), nil
+		case ch == '$':
+			expanded, err := l.variable()
+			if err != nil {
+				return "", err
+			}
+			value.WriteString(expanded)
+		case ch == l.escape && l.pos < len(l.input):
+			next := l.input[l.pos]
+			if next != '"' && next != '$' && next != l.escape {
+				value.WriteRune(ch)
+			}
+			value.WriteRune(next)
+			l.pos++
+		default:
+			value.WriteRune(ch)
+		}
+	}
+	return "", errors.New("unexpected end of statement while looking for matching double-quote")
+}
+
+// variable returns the value of the variable after $, a $ which is not followed by
+// a name is kept
+func (l *wordLexer) variable() (string, error) {
+	if l.pos < len(l.input) && l.input[l.pos] == '{' {
+		l.pos++
+		return l.bracedVariable()
+	}
+
+	name := l.name()
+	if name == "" {
+		return "$", nil
+	}
+	value, _ := l.lookup(name)
+	return value, nil
+}
+
+func (l *wordLexer) bracedVariable() (string, error) {
+	name := l.name()
+	if name == "" {
+		return "", fmt.Errorf("bad substitution in %q", string(l.input))
+	}
+	value, set := l.lookup(name)
+
+	if l.pos >= len(l.input) {
+		return "", fmt.Errorf("missing '}' in %q", string(l.input))
+	}
+	if l.input[l.pos] == '}' {
+		l.pos++
+		return value, nil
+	}
+
+	// ${VAR:-word} also treats an empty variable as unset
+	colon := l.input[l.pos] == ':'
+	if colon {
+		l.pos++
+	}
+	if l.pos >= len(l.input) {
+		return "", fmt.Errorf("missing '}' in %q", string(l.input))
+	}
+	modifier := l.input[l.pos]
+	l.pos++
+
+	words, err := l.words(false, '}')
+	if err != nil {
+		return "", err
+	}
+	word := strings.Join(words, "")
+
+	unset := !set || (colon && value == "")
+	switch modifier {
+	case '-':
+		if unset {
+			return word, nil
+		}
+		return value, nil
+	case '+':
+		if unset {
+			return "", nil
+		}
+		return word, nil
+	case '?':
+		if unset {
+			if word == "" {
+				word = "is not allowed to be unset"
+			}
+			return "", fmt.Errorf("%s: %s", name, word)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unsupported modifier (%c) in substitution of %s", modifier, name)
+}
+
+func (l *wordLexer) name() string {
+	start := l.pos
+	for l.pos < len(l.input) {
+		ch := l.input[l.pos]
+		if ch != '_' && !unicode.IsLetter(ch) && !(unicode.IsDigit(ch) && l.pos > start) {
+			break
+		}
+		l.pos++
+	}
+	return string(l.input[start:l.pos])
+}
@@ -0,0 +1,165 @@
+package build
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"aproton.tech/container/config"
+)
+
+func testLookup(name string) (string, bool) {
+	value, ok := map[string]string{"A": "a", "EMPTY": "", "SPACED": "x  y", "PATH": "/bin"}[name]
+	return value, ok
+}
+
+func TestExpandWords(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		escape rune
+		want   []string
+	}{
+		{text: "$A ${A} $A$A", want: []string{"a", "a", "aa"}},
+		{text: "${UNSET:-x} ${EMPTY:-x} ${EMPTY-x} ${A:-x}", want: []string{"x", "x", "a"}},
+		{text: "${UNSET:+y} ${EMPTY:+y} ${EMPTY+y} ${A:+y}", want: []string{"y", "y"}},
+		{text: "${UNSET:-$A/b} ${UNSET:-${A:+c}}", want: []string{"a/b", "c"}},
+		{text: "${UNSET:-'x y'}", want: []string{"x y"}},
+		{text: "$UNSET b $EMPTY", want: []string{"b"}},
+		{text: `"" ''`, want: []string{"", ""}},
+		{text: `'$A b' "$A b" "$SPACED" $SPACED`, want: []string{"$A b", "a b", "x  y", "x  y"}},
+		{text: `a\ b \$A "\$A \"q\" \n"`, want: []string{"a b", "$A", `$A "q" \n`}},
+		{text: "a` b `$A", escape: '`', want: []string{"a b", "$A"}},
+		{text: `c:\dir`, escape: '`', want: []string{`c:\dir`}},
+		{text: "$ 5$ $1A", want: []string{"$", "5$", "$1A"}},
+		{text: "  x\t y  ", want: []string{"x", "y"}},
+		{text: "$PATH:/usr/bin", want: []string{"/bin:/usr/bin"}},
+	} {
+		escape := tc.escape
+		if escape == 0 {
+			escape = '\\'
+		}
+		got, err := expandWords(tc.text, escape, testLookup)
+		if err != nil {
+			t.Errorf("expandWords(%q): %v", tc.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expandWords(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestExpandWord(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"/app/$A dir", "/app/a dir"},
+		{"  ${UNSET:-x}  y ", "  x  y "},
+		{`"$A b" 'c'`, "a b c"},
+		{"", ""},
+	} {
+		got, err := expandWord(tc.text, '\\', testLookup)
+		if err != nil {
+			t.Errorf("expandWord(%q): %v", tc.text, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expandWord(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		err  string
+	}{
+		{"${UNSET:?must be set}", "UNSET: must be set"},
+		{"${EMPTY:?}", "EMPTY: is not allowed to be unset"},
+		{"${}", "bad substitution"},
+		{"${A", "missing '}'"},
+		{"${A:-x", "missing '}'"},
+		{"${A/x}", "unsupported modifier (/)"},
+		{"'a", "matching single-quote"},
+		{`"a`, "matching double-quote"},
+	} {
+		_, err := expandWords(tc.text, '\\', testLookup)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expandWords(%q) = %v, want %q", tc.text, err, tc.err)
+		}
+	}
+
+	// set, even when empty, is enough without the colon
+	if got, err := expandWords("${EMPTY?}", '\\', testLookup); err != nil || len(got) != 0 {
+		t.Errorf("expandWords(${EMPTY?}) = %q, %v", got, err)
+	}
+}
+
+// buildConfig builds the Dockerfile, which must not need containers, and returns the config
+// of the image
+func buildConfig(t *testing.T, dockerfile string, buildArgs map[string]string) *v1.ConfigFile {
+	t.Helper()
+
+	if err := config.Init(t.TempDir(), t.TempDir(), ""); err != nil {
+		t.Fatal(err)
+	}
+	df, err := ParseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &builder{
+		opts:       BuildOptions{BuildArgs: buildArgs, NoCache: true},
+		out:        &strings.Builder{},
+		escape:     df.Escape,
+		globalArgs: map[string]*string{},
+		args:       map[string]*string{},
+		usedArgs:   map[string]bool{},
+	}
+	for _, inst := range df.Instructions {
+		if err := b.dispatch(context.Background(), inst); err != nil {
+			t.Fatalf("%s: %v", inst.Original, err)
+		}
+	}
+
+	config, err := b.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestArgScope(t *testing.T) {
+	config := buildConfig(t, `
+ARG BASE=scratch
+ARG GLOBAL=global
+ARG OVERRIDDEN=global
+FROM ${BASE}
+LABEL before="${GLOBAL:-not in the stage}"
+ARG GLOBAL
+ARG OVERRIDDEN=stage
+ARG FROMCLI=default
+ARG NODEFAULT
+ARG SHADOWED=arg
+ENV SHADOWED=env
+LABEL global=$GLOBAL overridden=$OVERRIDDEN cli=$FROMCLI nodefault="${NODEFAULT-unset}" \
+      shadowed=$SHADOWED base="${BASE:-not in the stage}"
+`, map[string]string{"FROMCLI": "cli"})
+
+	want := map[string]string{
+		"before":     "not in the stage",
+		"global":     "global",
+		"overridden": "stage",
+		"cli":        "cli",
+		"nodefault":  "unset",
+		"shadowed":   "env",
+		"base":       "not in the stage",
+	}
+	if !reflect.DeepEqual(config.Config.Labels, want) {
+		t.Errorf("labels %v, want %v", config.Config.Labels, want)
+	}
+}
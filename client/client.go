@@ -0,0 +1,230 @@
+// Package client is the Go API of the container runtime, the command line is a thin layer on top
+// of the same functions. The state root is process wide, all clients of a process share it,
+// New fails when it is called again with another root or state.
+//
+// The init process of a container is the program itself executed again, so a program
+// using this package must call Init first in main.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/pkg/reexec"
+
+	"aproton.tech/container/build"
+	"aproton.tech/container/config"
+	"aproton.tech/container/container"
+	"aproton.tech/container/events"
+	"aproton.tech/container/image"
+)
+
+type (
+	RunOptions       = container.RunOptions
+	StartOptions     = container.StartOptions
+	RunResult        = container.RunResult
+	LogsOptions      = container.LogsOptions
+	LogEntry         = container.LogEntry
+	RunningContainer = container.RunningContainer
+	Container        = container.ContainerMeta
+	Mount            = container.Mount
+	PullOptions      = image.PullOptions
+	PushOptions      = image.PushOptions
+	PushResult       = image.PushResult
+	Image            = image.ImageSummary
+	ImageDetail      = image.ImageDetail
+	BuildOptions     = build.BuildOptions
+	BuildResult      = build.BuildResult
+	Event            = events.Event
+	EventsOptions    = events.ReadOptions
+	EventHandler     = events.Handler
+)
+
+var (
+	ErrContainerNotFound  = container.ErrContainerNotFound
+	ErrContainerNameInUse = container.ErrContainerNameInUse
+	ErrImageNotFound      = image.ErrImageNotFound
+	ErrNotLoggedIn        = image.ErrNotLoggedIn
+)
+
+// ErrConfigInUse is wrapped by the error of New with another root or state than the first client
+var ErrConfigInUse = errors.New("the runtime is configured with another root or state")
+
+// Options selects the state of the runtime, the empty fields fall back to the
+// environment, the config file and the defaults, like the flags of the command line
+type Options struct {
+	Root       string
+	State      string
+	ConfigFile string
+}
+
+type Client struct{}
+
+// Init runs the init process of a container when the program was executed as one,
+// the program must exit at once when it returns true
+func Init() bool {
+	return reexec.Init()
+}
+
+// initialized is the config of the first client, the runtime configuration is process wide
+var initialized struct {
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+// New initializes the runtime configuration and returns a client, the clients created
+// after the first one must resolve to the same root and state
+func New(opts Options) (*Client, error) {
+	initialized.mu.Lock()
+	defer initialized.mu.Unlock()
+
+	if initialized.cfg == nil {
+		if err := config.Init(opts.Root, opts.State, opts.ConfigFile); err != nil {
+			return nil, err
+		}
+		initialized.cfg = config.Get()
+		return &Client{}, nil
+	}
+
+	cfg, err := config.Resolve(opts.Root, opts.State, opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Root != initialized.cfg.Root || cfg.State != initialized.cfg.State {
+		return nil, fmt.Errorf("%w: root %s and state %s are used by another client", ErrConfigInUse, initialized.cfg.Root, initialized.cfg.State)
+	}
+	return &Client{}, nil
+}
+
+// OnEvent registers the handler for all container and image events of this process,
+// the returned function unregisters it
+func (c *Client) OnEvent(handler EventHandler) func() {
+	return events.Subscribe(handler)
+}
+
+// Events calls fn with the events recorded in the journal by all processes using the root
+func (c *Client) Events(ctx context.Context, opts EventsOptions, fn func(Event) error) error {
+	return events.Read(ctx, opts, fn)
+}
+
+// Login checks the credentials with the registry and stores them in the docker config.json,
+// they are used by the pulls without PullOptions.Auth
+func (c *Client) Login(ctx context.Context, server string, username string, password string) error {
+	return image.Login(ctx, server, username, password)
+}
+
+// Logout removes the stored credentials of the registry
+func (c *Client) Logout(ctx context.Context, server string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return image.Logout(server)
+}
+
+// Pull pulls the image for the platform of the options, the host platform by default
+func (c *Client) Pull(ctx context.Context, ref string, opts PullOptions) (*Image, error) {
+	return image.PullImage(ctx, ref, opts)
+}
+
+// Push pushes the image of the repository to the registry of its name
+func (c *Client) Push(ctx context.Context, ref string, opts PushOptions) (*PushResult, error) {
+	return image.PushImage(ctx, ref, opts)
+}
+
+// Build builds the image of a Dockerfile into the repository
+func (c *Client) Build(ctx context.Context, opts BuildOptions) (*BuildResult, error) {
+	return build.Build(ctx, opts)
+}
+
+// Images lists the named images of the repository
+func (c *Client) Images(ctx context.Context) ([]*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return image.ListImages()
+}
+
+// InspectImage returns the image of the repository with its config
+func (c *Client) InspectImage(ctx context.Context, ref string) (*ImageDetail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return image.InspectImage(ref)
+}
+
+// RemoveImage removes the image and collects the blobs and layers not used anymore
+func (c *Client) RemoveImage(ctx context.Context, ref string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return image.RemoveImage(ref)
+}
+
+// Run runs the container and waits until it exits, the container is killed when ctx is done
+func (c *Client) Run(ctx context.Context, opts RunOptions) (*RunResult, error) {
+	return container.RunContainer(ctx, opts)
+}
+
+// Create creates the container without starting it
+func (c *Client) Create(ctx context.Context, opts RunOptions) (*Container, error) {
+	return container.CreateContainer(ctx, opts)
+}
+
+// Start starts a created or exited container, RunningContainer.Wait must be called
+// to reap it, the container is killed when ctx is done
+func (c *Client) Start(ctx context.Context, idOrName string, opts StartOptions) (*RunningContainer, error) {
+	return container.StartContainer(ctx, idOrName, opts)
+}
+
+// Logs calls fn with the output of the container
+func (c *Client) Logs(ctx context.Context, idOrName string, opts LogsOptions, fn func(*LogEntry) error) error {
+	return container.ContainerLogs(ctx, idOrName, opts, fn)
+}
+
+// Containers lists all containers
+func (c *Client) Containers(ctx context.Context) ([]*Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return container.ListContainers()
+}
+
+// Inspect returns the container with the id or name
+func (c *Client) Inspect(ctx context.Context, idOrName string) (*Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return container.InspectContainer(idOrName)
+}
+
+// Stop stops the container, it is killed when it is still running after timeout or when ctx is done
+func (c *Client) Stop(ctx context.Context, idOrName string, timeout time.Duration) error {
+	return container.StopContainer(ctx, idOrName, timeout)
+}
+
+// Remove removes a container which is not running
+func (c *Client) Remove(ctx context.Context, idOrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return container.RemoveContainer(idOrName)
+}
+
+// Pause freezes the processes of the container
+func (c *Client) Pause(ctx context.Context, idOrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return container.PauseContainer(idOrName)
+}
+
+// Unpause thaws the processes of the container
+func (c *Client) Unpause(ctx context.Context, idOrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return container.UnpauseContainer(idOrName)
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultRoot       = "/var/lib/container"
+	DefaultState      = "/run/container"
+	DefaultConfigFile = "/etc/container/config.json"
+)
+
+const (
+	RootEnv   = "CONTAINER_ROOT"
+	StateEnv  = "CONTAINER_STATE"
+	ConfigEnv = "CONTAINER_CONFIG"
+)
+
+// Config is the content of the config file, every field can be overridden
+// by the environment and the command line flags
+type Config struct {
+	// Root keeps the persistent state: images, layers, containers and volumes
+	Root string `json:"root"`
+	// State keeps the ephemeral files of running containers
+	State string `json:"state"`
+
+	// Registries configures the access to the registries by host, e.g. docker.io or registry.example.com:5000
+	Registries map[string]*RegistryConfig `json:"registries,omitempty"`
+	// RegistryMirrors are the mirrors of Docker Hub, like the registry-mirrors of docker
+	RegistryMirrors []string `json:"registry-mirrors,omitempty"`
+	// InsecureRegistries are the hosts which may be accessed by HTTP or without verifying
+	// their TLS certificate, like the insecure-registries of docker
+	InsecureRegistries []string `json:"insecure-registries,omitempty"`
+}
+
+// RegistryConfig configures the access to a registry host
+type RegistryConfig struct {
+	// Mirrors are tried in order before the registry when pulling, e.g. https://mirror.example.com,
+	// a mirror with http:// is accessed by HTTP
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Insecure allows HTTP and skips the verification of the TLS certificate
+	Insecure bool `json:"insecure,omitempty"`
+	// CA is a PEM bundle of certificate authorities trusted in addition to the system ones
+	CA string `json:"ca,omitempty"`
+	// Cert and Key are the PEM client certificate and its key presented to the registry
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+var current = &Config{Root: DefaultRoot, State: DefaultState}
+
+// Init loads the config, a non-empty root or state comes from the command line and wins
+// over the environment, which wins over the config file, which wins over the defaults
+func Init(root string, state string, configFile string) error {
+	cfg, err := Resolve(root, state, configFile)
+	if err != nil {
+		return err
+	}
+
+	current = cfg
+	return nil
+}
+
+// Resolve returns the config which Init loads, without making it the current one
+func Resolve(root string, state string, configFile string) (*Config, error) {
+	if configFile == "" {
+		configFile = os.Getenv(ConfigEnv)
+	}
+
+	cfg, err := Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if env := os.Getenv(RootEnv); env != "" {
+		cfg.Root = env
+	}
+	if env := os.Getenv(StateEnv); env != "" {
+		cfg.State = env
+	}
+	if root != "" {
+		cfg.Root = root
+	}
+	if state != "" {
+		cfg.State = state
+	}
+
+	if cfg.Root, err = filepath.Abs(cfg.Root); err != nil {
+		return nil, err
+	}
+	if cfg.State, err = filepath.Abs(cfg.State); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Load reads the config file, an empty file name reads DefaultConfigFile,
+// which does not need to exist
+func Load(file string) (*Config, error) {
+	cfg := &Config{Root: DefaultRoot, State: DefaultState}
+
+	explicit := file != ""
+	if !explicit {
+		file = DefaultConfigFile
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ApplyRegistryFlags adds the registry flags of the command line to the config, a mirror
+// is REGISTRY=MIRROR or a mirror of Docker Hub
+func ApplyRegistryFlags(mirrors []string, insecure []string) error {
+	for _, mirror := range mirrors {
+		host, url, ok := strings.Cut(mirror, "=")
+		if !ok {
+			current.RegistryMirrors = append(current.RegistryMirrors, mirror)
+			continue
+		}
+		if host == "" || url == "" {
+			return fmt.Errorf("invalid registry mirror %q, must be [REGISTRY=]MIRROR", mirror)
+		}
+
+		registry := current.registry(host)
+		registry.Mirrors = append(registry.Mirrors, url)
+	}
+
+	current.InsecureRegistries = append(current.InsecureRegistries, insecure...)
+	return nil
+}
+
+// Registry returns the config of the registry host, merged with the registry-mirrors
+// and insecure-registries
+func Registry(host string) RegistryConfig {
+	host = registryHost(host)
+
+	cfg := RegistryConfig{}
+	for name, registry := range current.Registries {
+		if registryHost(name) == host && registry != nil {
+			cfg = *registry
+			cfg.Mirrors = append([]string{}, registry.Mirrors...)
+		}
+	}
+
+	if host == dockerHub {
+		cfg.Mirrors = append(cfg.Mirrors, current.RegistryMirrors...)
+	}
+	for _, insecure := range current.InsecureRegistries {
+		if registryHost(insecure) == host {
+			cfg.Insecure = true
+		}
+	}
+
+	return cfg
+}
+
+// the host of Docker Hub has a few aliases
+const dockerHub = "docker.io"
+
+func registryHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHub
+	}
+	return host
+}
+
+// registry returns the config of the host to be changed, it is added when missing
+func (c *Config) registry(host string) *RegistryConfig {
+	for name, registry := range c.Registries {
+		if registryHost(name) == registryHost(host) && registry != nil {
+			return registry
+		}
+	}
+
+	if c.Registries == nil {
+		c.Registries = map[string]*RegistryConfig{}
+	}
+	registry := &RegistryConfig{}
+	c.Registries[host] = registry
+	return registry
+}
+
+func Get() *Config {
+	return current
+}
+
+// Env returns the environment which makes a child process use the same config
+func Env() []string {
+	return []string{RootEnv + "=" + current.Root, StateEnv + "=" + current.State}
+}
+
+// RootPath returns the absolute path of elem under the root directory
+func RootPath(elem ...string) string {
+	return filepath.Join(append([]string{current.Root}, elem...)...)
+}
+
+// StatePath returns the absolute path of elem under the state directory
+func StatePath(elem ...string) string {
+	return filepath.Join(append([]string{current.State}, elem...)...)
+}
@@ -3,39 +3,132 @@ package container
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+)
+
+const CgroupRootPath = "/sys/fs/cgroup"
+const CgroupSliceName = "container.slice"
+const CgroupPathPrefix = CgroupRootPath + "/" + CgroupSliceName + "/"
 
-	"aproton.tech/container/utils"
+const (
+	CgroupManagerAuto    = "auto"
+	CgroupManagerFs      = "cgroupfs"
+	CgroupManagerFsV1    = "cgroupfs-v1"
+	CgroupManagerFsV2    = "cgroupfs-v2"
+	CgroupManagerSystemd = "systemd"
 )
 
-const CgroupPathPrefix = "/sys/fs/cgroup/container.slice/"
+// CgroupManager creates and controls the cgroup of one container.
+// Every container is placed at container.slice/<containerId>.scope,
+// whatever the driver or the hierarchy version is.
+type CgroupManager interface {
+	Name() string
+	Create(containerId string) error
+	AddProcess(containerId string, pid int) error
+	SetMemoryMax(containerId string, maxMemory uint64) error
+	Freeze(containerId string) error
+	Thaw(containerId string) error
+	IsFrozen(containerId string) bool
+	OOMKillCount(containerId string) (uint64, error)
+	Pids(containerId string) ([]int, error)
+	Destroy(containerId string) error
+}
 
-type SetLimit func(containerId string) error
+type SetLimit func(mgr CgroupManager, containerId string) error
+
+// NewCgroupManager returns the cgroup driver by name, "auto" or an empty
+// name selects the best one for current host
+func NewCgroupManager(name string) (CgroupManager, error) {
+	switch name {
+	case "", CgroupManagerAuto:
+		return detectCgroupManager(), nil
+	case CgroupManagerFs:
+		if isCgroupV2Unified() {
+			return newCgroupfsV2Manager(), nil
+		}
+		return newCgroupfsV1Manager()
+	case CgroupManagerFsV2:
+		return newCgroupfsV2Manager(), nil
+	case CgroupManagerFsV1:
+		return newCgroupfsV1Manager()
+	case CgroupManagerSystemd:
+		return newSystemdManager()
+	}
 
-func SetContainerCgroup(containerId string, setter ...SetLimit) {
-	initCgroup(containerId)
+	return nil, fmt.Errorf("unknown cgroup manager %q, supported: %s, %s, %s", name, CgroupManagerAuto, CgroupManagerFs, CgroupManagerSystemd)
+}
+
+// getContainerCgroupManager returns the driver which created the container cgroup,
+// containers created before drivers were introduced use cgroupfs v2
+func getContainerCgroupManager(cnt *ContainerMeta) (CgroupManager, error) {
+	if cnt.CgroupManager == "" {
+		return newCgroupfsV2Manager(), nil
+	}
+	return NewCgroupManager(cnt.CgroupManager)
+}
+
+func detectCgroupManager() CgroupManager {
+	if isSystemdRunning() {
+		mgr, err := newSystemdManager()
+		if err == nil {
+			return mgr
+		}
+		logrus.Warnf("systemd is running, but connect to it failed(%v), fallback to cgroupfs", err)
+	}
+
+	if isCgroupV2Unified() {
+		return newCgroupfsV2Manager()
+	}
+
+	mgr, err := newCgroupfsV1Manager()
+	if err != nil {
+		logrus.Warnf("cgroup v1 hierarchies are not usable(%v), fallback to cgroup v2", err)
+		return newCgroupfsV2Manager()
+	}
+	return mgr
+}
+
+func isCgroupV2Unified() bool {
+	_, err := os.Stat(filepath.Join(CgroupRootPath, "cgroup.controllers"))
+	return err == nil
+}
+
+func isSystemdRunning() bool {
+	fi, err := os.Lstat("/run/systemd/system")
+	return err == nil && fi.IsDir()
+}
+
+func SetContainerCgroup(mgr CgroupManager, containerId string, setter ...SetLimit) error {
+	if err := mgr.Create(containerId); err != nil {
+		return fmt.Errorf("create cgroup: %w", err)
+	}
 	for _, s := range setter {
-		utils.Assert(s(containerId))
+		if err := s(mgr, containerId); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func RemoveContainerCgroup(containerId string) {
-	utils.Assert(os.RemoveAll(getContainerCGroupPath(containerId)))
+func RemoveContainerCgroup(mgr CgroupManager, containerId string) error {
+	return mgr.Destroy(containerId)
 }
 
 func SetMaxMemory(maxMemory uint64) SetLimit {
-	return func(containerId string) error {
-		return os.WriteFile(getContainerCGroupPath(containerId, "memory.max"), []byte(fmt.Sprintf("%d", maxMemory)), 0644)
+	return func(mgr CgroupManager, containerId string) error {
+		return mgr.SetMemoryMax(containerId, maxMemory)
 	}
 }
 
 func SetProcessId(pid int) SetLimit {
-	return func(containerId string) error {
-		return os.WriteFile(getContainerCGroupPath(containerId, "cgroup.procs"), []byte(fmt.Sprintf("%d", pid)), 0644)
+	return func(mgr CgroupManager, containerId string) error {
+		return mgr.AddProcess(containerId, pid)
 	}
 }
 
@@ -47,52 +140,52 @@ func getContainerCGroupPath(containerId string, subfile ...string) string {
 	return s
 }
 
-func initCgroup(containerId string) {
-	ccpath := getContainerCGroupPath(containerId)
-	_, err := os.Stat(ccpath)
-	if err == nil || !errors.Is(err, os.ErrNotExist) {
-		utils.Assert(err)
+// readCgroupKeyValue reads one entry of a flat keyed file like cgroup.events or memory.events
+func readCgroupKeyValue(file string, key string) (string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
 	}
 
-	utils.Assert(os.MkdirAll(ccpath, 0755))
-
-	isControllerOK := func(controllerspath string) bool {
-		content, err := os.ReadFile(controllerspath)
-		utils.Assert(err)
-		return strings.Contains(string(content), "cpu") && strings.Contains(string(content), "memory")
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			return fields[1], nil
+		}
 	}
 
-	if !isControllerOK(filepath.Join(ccpath, "cgroup.controllers")) {
-		logrus.Infof("not found cpu/memory in controller")
-		if !isControllerOK("/sys/fs/cgroup/cgroup.subtree_control") {
-			content, err := os.ReadFile("/sys/fs/cgroup/cgroup.procs")
-			utils.Assert(err)
-			for _, pid := range strings.Split(string(content), "\n") {
-				pid = strings.Trim(pid, " ")
-				if pid != "" {
-					os.WriteFile(filepath.Join(CgroupPathPrefix, "cgroup.procs"), []byte(pid), 0644)
-				}
-			}
+	return "", fmt.Errorf("not found %s in %s", key, file)
+}
 
-			content, err = os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
-			utils.Assert(err)
-			for _, ctrl := range strings.Split(string(content), " ") {
-				if ctrl != "" {
-					utils.Assert(os.WriteFile("/sys/fs/cgroup/cgroup.subtree_control", []byte("+"+ctrl), 0644))
-				}
-			}
+// readCgroupProcs collects the processes of the cgroup and all of its descendants
+func readCgroupProcs(cgpath string) ([]int, error) {
+	pids := []int{}
+	err := filepath.WalkDir(cgpath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
 		}
 
-		if !isControllerOK(filepath.Join(CgroupPathPrefix, "cgroup.subtree_control")) {
-			logrus.Infof("append subtree_control")
-			content, err := os.ReadFile(filepath.Join(CgroupPathPrefix, "cgroup.controllers"))
-			utils.Assert(err)
-			for _, ctrl := range strings.Split(string(content), " ") {
-				if ctrl != "" {
-					utils.Assert(os.WriteFile(filepath.Join(CgroupPathPrefix, "cgroup.subtree_control"), []byte("+"+ctrl), 0644))
-				}
+		content, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+
+		for _, line := range strings.Fields(string(content)) {
+			pid, err := strconv.Atoi(line)
+			if err != nil {
+				return err
 			}
+			pids = append(pids, pid)
 		}
+		return nil
+	})
+
+	return pids, err
+}
 
+func removeCgroupDir(path string) error {
+	// cgroup directories can only be removed by rmdir, the control files inside can not be unlinked
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
+	return nil
 }
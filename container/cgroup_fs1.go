@@ -0,0 +1,192 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controllers whose hierarchies get a directory for every container
+var cgroupV1Controllers = []string{"cpu", "cpuacct", "memory", "pids", "freezer", "blkio", "name=systemd"}
+
+// cgroupfsV1Manager manages the legacy cgroup v1 hierarchies, one directory per controller
+type cgroupfsV1Manager struct {
+	// controller name -> mount point of its hierarchy
+	mounts map[string]string
+}
+
+func newCgroupfsV1Manager() (*cgroupfsV1Manager, error) {
+	mounts, err := getCgroupV1Mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := mounts["memory"]; !ok {
+		return nil, errors.New("cgroup v1 memory hierarchy is not mounted")
+	}
+
+	return &cgroupfsV1Manager{mounts: mounts}, nil
+}
+
+func (m *cgroupfsV1Manager) Name() string {
+	return CgroupManagerFsV1
+}
+
+func (m *cgroupfsV1Manager) Create(containerId string) error {
+	for _, dir := range m.hierarchyPaths(containerId) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *cgroupfsV1Manager) AddProcess(containerId string, pid int) error {
+	for _, dir := range m.hierarchyPaths(containerId) {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *cgroupfsV1Manager) SetMemoryMax(containerId string, maxMemory uint64) error {
+	return os.WriteFile(m.path("memory", containerId, "memory.limit_in_bytes"), []byte(fmt.Sprintf("%d", maxMemory)), 0644)
+}
+
+func (m *cgroupfsV1Manager) Freeze(containerId string) error {
+	return m.setFreezeState(containerId, "FROZEN")
+}
+
+func (m *cgroupfsV1Manager) Thaw(containerId string) error {
+	return m.setFreezeState(containerId, "THAWED")
+}
+
+func (m *cgroupfsV1Manager) IsFrozen(containerId string) bool {
+	content, err := os.ReadFile(m.path("freezer", containerId, "freezer.state"))
+	return err == nil && strings.TrimSpace(string(content)) == "FROZEN"
+}
+
+func (m *cgroupfsV1Manager) OOMKillCount(containerId string) (uint64, error) {
+	// oom_kill is reported by memory.oom_control since linux 4.13
+	value, err := readCgroupKeyValue(m.path("memory", containerId, "memory.oom_control"), "oom_kill")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (m *cgroupfsV1Manager) Pids(containerId string) ([]int, error) {
+	// every process is added to all hierarchies, the memory one always exists
+	return readCgroupProcs(m.path("memory", containerId))
+}
+
+func (m *cgroupfsV1Manager) Destroy(containerId string) error {
+	for _, dir := range m.hierarchyPaths(containerId) {
+		if err := removeCgroupDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *cgroupfsV1Manager) setFreezeState(containerId string, state string) error {
+	if _, ok := m.mounts["freezer"]; !ok {
+		return errors.New("cgroup v1 freezer hierarchy is not mounted")
+	}
+
+	file := m.path("freezer", containerId, "freezer.state")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// the kernel may stay in FREEZING when a task can not be frozen, so write again while waiting
+		if err := os.WriteFile(file, []byte(state), 0644); err != nil {
+			return err
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(content)) == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %s: timeout waiting for freezer.state=%s", containerId, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (m *cgroupfsV1Manager) path(controller string, containerId string, subfile ...string) string {
+	s := filepath.Join(m.mounts[controller], CgroupSliceName, containerId+".scope")
+	for _, f := range subfile {
+		s = filepath.Join(s, f)
+	}
+	return s
+}
+
+// hierarchyPaths returns the container directory in every mounted hierarchy,
+// co-mounted controllers like cpu,cpuacct share one directory
+func (m *cgroupfsV1Manager) hierarchyPaths(containerId string) []string {
+	paths := []string{}
+	for _, ctrl := range cgroupV1Controllers {
+		if _, ok := m.mounts[ctrl]; !ok {
+			continue
+		}
+		if p := m.path(ctrl, containerId); !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// getCgroupV1Mounts parses /proc/self/mountinfo, the super options of a
+// cgroup mount list the controllers attached to the hierarchy
+func getCgroupV1Mounts() (map[string]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mounts := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 0:30 / /sys/fs/cgroup/memory rw,relatime shared:15 - cgroup cgroup rw,memory
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) != 2 {
+			continue
+		}
+
+		pre, post := strings.Fields(fields[0]), strings.Fields(fields[1])
+		if len(pre) < 5 || len(post) < 3 || post[0] != "cgroup" {
+			continue
+		}
+
+		for _, opt := range strings.Split(post[2], ",") {
+			if opt == "rw" || opt == "ro" {
+				continue
+			}
+			if _, ok := mounts[opt]; !ok {
+				mounts[opt] = pre[4]
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(mounts) == 0 {
+		return nil, errors.New("no cgroup v1 hierarchy is mounted")
+	}
+
+	return mounts, nil
+}
@@ -0,0 +1,138 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// controllers which are delegated to container.slice when the host has them
+var cgroupV2Controllers = []string{"cpu", "io", "memory", "pids"}
+
+// cgroupfsV2Manager manages the cgroup v2 unified hierarchy by writing cgroupfs directly
+type cgroupfsV2Manager struct{}
+
+func newCgroupfsV2Manager() *cgroupfsV2Manager {
+	return &cgroupfsV2Manager{}
+}
+
+func (m *cgroupfsV2Manager) Name() string {
+	return CgroupManagerFsV2
+}
+
+func (m *cgroupfsV2Manager) Create(containerId string) error {
+	ccpath := getContainerCGroupPath(containerId)
+	if _, err := os.Stat(ccpath); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(CgroupPathPrefix, 0755); err != nil {
+		return err
+	}
+
+	// the root cgroup is exempt from the "no internal processes" rule, and container.slice
+	// never holds a process, so controllers can be enabled without moving any host process
+	for _, parent := range []string{CgroupRootPath, CgroupPathPrefix} {
+		if err := enableCgroupV2Controllers(parent); err != nil {
+			logrus.Warnf("enable controllers in %s failed, resource limits may not work: %v", parent, err)
+			break
+		}
+	}
+
+	return os.MkdirAll(ccpath, 0755)
+}
+
+func (m *cgroupfsV2Manager) AddProcess(containerId string, pid int) error {
+	return os.WriteFile(getContainerCGroupPath(containerId, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+func (m *cgroupfsV2Manager) SetMemoryMax(containerId string, maxMemory uint64) error {
+	return os.WriteFile(getContainerCGroupPath(containerId, "memory.max"), []byte(fmt.Sprintf("%d", maxMemory)), 0644)
+}
+
+func (m *cgroupfsV2Manager) Freeze(containerId string) error {
+	return m.setFreezeState(containerId, "1")
+}
+
+func (m *cgroupfsV2Manager) Thaw(containerId string) error {
+	return m.setFreezeState(containerId, "0")
+}
+
+func (m *cgroupfsV2Manager) IsFrozen(containerId string) bool {
+	frozen, err := readCgroupKeyValue(getContainerCGroupPath(containerId, "cgroup.events"), "frozen")
+	return err == nil && frozen == "1"
+}
+
+func (m *cgroupfsV2Manager) OOMKillCount(containerId string) (uint64, error) {
+	value, err := readCgroupKeyValue(getContainerCGroupPath(containerId, "memory.events"), "oom_kill")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (m *cgroupfsV2Manager) Pids(containerId string) ([]int, error) {
+	return readCgroupProcs(getContainerCGroupPath(containerId))
+}
+
+func (m *cgroupfsV2Manager) Destroy(containerId string) error {
+	return removeCgroupDir(getContainerCGroupPath(containerId))
+}
+
+func (m *cgroupfsV2Manager) setFreezeState(containerId string, state string) error {
+	if err := os.WriteFile(getContainerCGroupPath(containerId, "cgroup.freeze"), []byte(state), 0644); err != nil {
+		return err
+	}
+
+	// cgroup.freeze only requests the transition, cgroup.events reports when it is done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		frozen, err := readCgroupKeyValue(getContainerCGroupPath(containerId, "cgroup.events"), "frozen")
+		if err != nil {
+			return err
+		}
+		if frozen == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %s: timeout waiting for frozen=%s", containerId, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func enableCgroupV2Controllers(cgpath string) error {
+	content, err := os.ReadFile(filepath.Join(cgpath, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	enabled, err := os.ReadFile(filepath.Join(cgpath, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+
+	available := strings.Fields(string(content))
+	current := strings.Fields(string(enabled))
+	for _, ctrl := range cgroupV2Controllers {
+		if !slices.Contains(available, ctrl) || slices.Contains(current, ctrl) {
+			continue
+		}
+
+		if err := os.WriteFile(filepath.Join(cgpath, "cgroup.subtree_control"), []byte("+"+ctrl), 0644); err != nil {
+			return fmt.Errorf("enable controller %s: %w", ctrl, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+const systemdJobTimeout = 30 * time.Second
+
+// systemdManager asks systemd to create a transient scope unit for every container,
+// so systemd stays the only writer of the cgroup tree. The scope is created in
+// container.slice with Delegate=yes, so its cgroup files are read and written
+// through the cgroupfs driver of the host hierarchy.
+type systemdManager struct {
+	conn *systemdDbus.Conn
+	fs   CgroupManager
+
+	// properties set before the scope exists, applied when the first process is added
+	mu      sync.Mutex
+	pending map[string][]systemdDbus.Property
+}
+
+// systemdConn is the connection shared by all systemd managers of the process
+var systemdConn struct {
+	mu   sync.Mutex
+	conn *systemdDbus.Conn
+}
+
+// getSystemdConn opens the connection to systemd on the first use, and opens it
+// again if it was lost
+func getSystemdConn() (*systemdDbus.Conn, error) {
+	systemdConn.mu.Lock()
+	defer systemdConn.mu.Unlock()
+
+	if systemdConn.conn != nil && systemdConn.conn.Connected() {
+		return systemdConn.conn, nil
+	}
+	if systemdConn.conn != nil {
+		systemdConn.conn.Close()
+		systemdConn.conn = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	conn, err := systemdDbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect to systemd: %w", err)
+	}
+	systemdConn.conn = conn
+	return conn, nil
+}
+
+func newSystemdManager() (*systemdManager, error) {
+	conn, err := getSystemdConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var fs CgroupManager
+	if isCgroupV2Unified() {
+		fs = newCgroupfsV2Manager()
+	} else if fs, err = newCgroupfsV1Manager(); err != nil {
+		return nil, err
+	}
+
+	return &systemdManager{
+		conn:    conn,
+		fs:      fs,
+		pending: map[string][]systemdDbus.Property{},
+	}, nil
+}
+
+func (m *systemdManager) Name() string {
+	return CgroupManagerSystemd
+}
+
+// Create does nothing, systemd can not create a scope without any process
+func (m *systemdManager) Create(containerId string) error {
+	return nil
+}
+
+func (m *systemdManager) AddProcess(containerId string, pid int) error {
+	m.mu.Lock()
+	pending := m.pending[containerId]
+	delete(m.pending, containerId)
+	m.mu.Unlock()
+
+	properties := append([]systemdDbus.Property{
+		systemdDbus.PropDescription("container " + containerId),
+		systemdDbus.PropSlice(CgroupSliceName),
+		systemdDbus.PropPids(uint32(pid)),
+		{Name: "Delegate", Value: dbus.MakeVariant(true)},
+		{Name: "DefaultDependencies", Value: dbus.MakeVariant(false)},
+	}, pending...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	ch := make(chan string, 1)
+	if _, err := m.conn.StartTransientUnitContext(ctx, getSystemdUnitName(containerId), "replace", properties, ch); err != nil {
+		return fmt.Errorf("start transient unit %s: %w", getSystemdUnitName(containerId), err)
+	}
+
+	return waitSystemdJob(ctx, ch)
+}
+
+func (m *systemdManager) SetMemoryMax(containerId string, maxMemory uint64) error {
+	name := "MemoryMax"
+	if m.fs.Name() == CgroupManagerFsV1 {
+		name = "MemoryLimit"
+	}
+	prop := systemdDbus.Property{Name: name, Value: dbus.MakeVariant(maxMemory)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	if err := m.conn.SetUnitPropertiesContext(ctx, getSystemdUnitName(containerId), true, prop); err != nil {
+		if !isSystemdNoSuchUnit(err) {
+			return err
+		}
+
+		m.mu.Lock()
+		m.pending[containerId] = append(m.pending[containerId], prop)
+		m.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (m *systemdManager) Freeze(containerId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	return m.conn.FreezeUnit(ctx, getSystemdUnitName(containerId))
+}
+
+func (m *systemdManager) Thaw(containerId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	return m.conn.ThawUnit(ctx, getSystemdUnitName(containerId))
+}
+
+func (m *systemdManager) IsFrozen(containerId string) bool {
+	return m.fs.IsFrozen(containerId)
+}
+
+func (m *systemdManager) OOMKillCount(containerId string) (uint64, error) {
+	return m.fs.OOMKillCount(containerId)
+}
+
+func (m *systemdManager) Pids(containerId string) ([]int, error) {
+	return m.fs.Pids(containerId)
+}
+
+func (m *systemdManager) Destroy(containerId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), systemdJobTimeout)
+	defer cancel()
+
+	ch := make(chan string, 1)
+	if _, err := m.conn.StopUnitContext(ctx, getSystemdUnitName(containerId), "replace", ch); err != nil {
+		// the scope is garbage collected by systemd once all of its processes exited
+		if isSystemdNoSuchUnit(err) {
+			return nil
+		}
+		return err
+	}
+
+	return waitSystemdJob(ctx, ch)
+}
+
+func getSystemdUnitName(containerId string) string {
+	return containerId + ".scope"
+}
+
+func waitSystemdJob(ctx context.Context, ch <-chan string) error {
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("systemd job finished with result %s", result)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for systemd job: %w", ctx.Err())
+	}
+}
+
+func isSystemdNoSuchUnit(err error) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.NoSuchUnit"
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package container
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syncPipeFd is the read end of the pipe passed by the run command as the first extra file
+const syncPipeFd = 3
+
+// notifyChildReady tells the container init process that its cgroup is ready
+func notifyChildReady(w *os.File) error {
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// waitParentReady blocks until the run command moved this process into the container cgroup,
+// a cgroup namespace takes the cgroup of the unsharing process as its root
+func waitParentReady() error {
+	pipe := os.NewFile(syncPipeFd, "sync-pipe")
+	defer pipe.Close()
+
+	buf := make([]byte, 1)
+	if _, err := pipe.Read(buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("run command exited before the container is ready")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// buildCgroupFileSystem mounts the cgroup2 filesystem of current cgroup namespace,
+// so the container sees its own scope as /sys/fs/cgroup
+func buildCgroupFileSystem(sandbox string, writable bool) error {
+	if !isCgroupV2Unified() {
+		logrus.Warnf("cgroup v2 unified hierarchy is not available, skip mounting /sys/fs/cgroup")
+		return nil
+	}
+
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RELATIME)
+	if !writable {
+		flags |= syscall.MS_RDONLY
+	}
+
+	return syscall.Mount("cgroup2", filepath.Join(sandbox, "/sys/fs/cgroup"), "cgroup2", flags, "")
+}
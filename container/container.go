@@ -1,36 +1,142 @@
 package container
 
 import (
-	"encoding/json"
 	"errors"
-	"os"
+	"io"
 	"time"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/cobra"
 
-	"aproton.tech/container/utils"
+	"aproton.tech/container/config"
+	"aproton.tech/container/events"
 )
 
 const ReExecRunCommand = "inner-container-run"
-const ContainerMetaFile = "var/container.json"
+
+// DefaultStopTimeout is how long stop waits after SIGTERM before it kills the container
+const DefaultStopTimeout = 5 * time.Second
+
+// the status of a container, a running container whose process is gone has exited
+const (
+	StatusCreated = "Created"
+	StatusRunning = "Running"
+	StatusPaused  = "Paused"
+	StatusExited  = "Exited"
+)
+
+// RuntimeFiles are written by the runtime for every start into the state directory and
+// bind mounted into the rootfs, they are not part of the image
+var RuntimeFiles = []string{"/etc/hosts", "/etc/resolv.conf"}
+
+// ErrContainerNotFound is wrapped by the errors of a container name or id which does not exist
+var ErrContainerNotFound = errors.New("no such container")
+
+// ErrContainerNameInUse is wrapped by the error of creating a container with the name of another one
+var ErrContainerNameInUse = errors.New("container name is already in use")
+
+// RunOptions describes the container to run, the zero value of a field means the default
+type RunOptions struct {
+	// Image is the reference of the image, it is pulled when it is not in the repository
+	Image string
+	// Rootfs is the image of the root filesystem instead of the one named Image, which
+	// only names it then, e.g. the image of a step of a build
+	Rootfs v1.Image
+	// Cmd overrides the cmd of the image, it is passed to the entrypoint
+	Cmd []string
+	// Entrypoint overrides the entrypoint of the image, the cmd of the image is not used then
+	Entrypoint []string
+	// Env is added to the environment of the image
+	Env        []string
+	WorkingDir string
+	User       string
+	// Platform is the os/arch[/variant] of the image, an image of another platform is pulled
+	// for it. Any platform of an image in the repository is used when it is empty.
+	Platform string
+	// Name is random when it is empty
+	Name   string
+	Labels map[string]string
+	// AutoRemove removes the container and its anonymous volumes when it exits
+	AutoRemove bool
+
+	// Mounts are validated and copied, the container does not change them
+	Mounts         []*Mount
+	ShmSize        uint64
+	ReadonlyRootfs bool
+	CgroupWritable bool
+	CgroupManager  string
+	Memory         uint64
+	OOMScoreAdj    *int
+
+	// Tty, Stdin, Stdout, Stderr and OnEvent are passed to StartContainer, see StartOptions
+	Tty     bool
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+	OnEvent events.Handler
+}
+
+// StartOptions connects a created container to the caller
+type StartOptions struct {
+	// Tty runs the container in the foreground process group of the terminal of Stdin,
+	// the stdio of the terminal is passed to the container as it is and not logged
+	Tty   bool
+	Stdin io.Reader
+	// the output of the container is written to its log, and copied to Stdout and Stderr
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// OnEvent receives the lifecycle events of this container
+	OnEvent events.Handler
+}
+
+// RunResult is the outcome of a container which has exited
+type RunResult struct {
+	ContainerID string `json:"containerId"`
+	Name        string `json:"name"`
+	// ExitCode is 128+signal when the container was killed by a signal
+	ExitCode  int  `json:"exitCode"`
+	OOMKilled bool `json:"oomKilled"`
+}
 
 type ContainerMeta struct {
 	Name        string    `json:"name"`
-	ProcessID   int       `json:"processId"`
 	ContainerID string    `json:"containerId"`
 	Image       string    `json:"image"`
 	Command     string    `json:"command"`
 	Created     time.Time `json:"created"`
-	Status      string    `json:"status"`
 	Ports       string    `json:"ports"`
 	Sandbox     string    `json:"sandbox"`
 	Overlay     *Overlay  `json:"overlay"`
+	Mounts      []*Mount  `json:"mounts"`
+	ReadOnly    bool      `json:"readOnly"`
+	ShmSize     uint64    `json:"shmSize"`
+	Platform    string    `json:"platform,omitempty"`
+
+	CgroupManager string            `json:"cgroupManager"`
+	Memory        uint64            `json:"memory,omitempty"`
+	OOMScoreAdj   *int              `json:"oomScoreAdj,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	AutoRemove    bool              `json:"autoRemove,omitempty"`
+
+	ContainerState
+}
+
+// ContainerState is the part of ContainerMeta which changes while the container runs
+type ContainerState struct {
+	ProcessID  int       `json:"processId,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	OOMKilled  bool      `json:"oomKilled,omitempty"`
+	ExitCode   int       `json:"exitCode"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
 }
 
 type Overlay struct {
-	Working    string `json:"working"`
-	Upper      string `json:"upper"`
-	MountPoint string `json:"mountPoint"`
+	Lower      []string `json:"lower"`
+	Working    string   `json:"working"`
+	Upper      string   `json:"upper"`
+	MountPoint string   `json:"mountPoint"`
 }
 
 func ContainerCommands() []*cobra.Command {
@@ -52,27 +158,37 @@ func getCommands() []*cobra.Command {
 		Use:   "run container",
 		Short: "start and run a container",
 		Args:  cobra.MinimumNArgs(1),
-		Run:   ContainerRunCommand,
+		RunE:  ContainerRunCommand,
 	}
 
 	run.Flags().BoolP("interactive", "i", false, "Keep STDIN open even if not attached")
 	run.Flags().BoolP("tty", "t", false, "Allocate a pseudo-TTY")
 	run.Flags().BoolP("detach", "d", false, "Run container in background and print container ID")
 	run.Flags().BoolP("rm", "", false, "Automatically remove the container when it exits")
+	run.Flags().String("name", "", "Assign a name to the container")
+	run.Flags().String("platform", "", "Run the image of the platform os/arch[/variant], it is pulled when the image is of another one")
 	run.Flags().StringP("memory", "m", "", "Memory limit")
+	run.Flags().Int("oom-score-adj", 0, "Tune host's OOM preferences (-1000 to 1000)")
+	run.Flags().String("cgroup-manager", CgroupManagerAuto, "Cgroup driver: auto, cgroupfs or systemd")
+	run.Flags().StringArrayP("volume", "v", []string{}, "Bind mount a volume, [SOURCE:]DESTINATION[:ro]")
+	run.Flags().StringArray("mount", []string{}, "Attach a filesystem mount to the container, type=bind|volume|tmpfs,source=...,target=...[,readonly]")
+	run.Flags().StringArray("tmpfs", []string{}, "Mount a tmpfs directory, DESTINATION[:size=64m,mode=1777,ro,noexec]")
+	run.Flags().String("shm-size", "", "Size of /dev/shm (default 64MB)")
+	run.Flags().Bool("read-only", false, "Mount the container's root filesystem as read only")
+	run.Flags().Bool("cgroup-rw", false, "Mount /sys/fs/cgroup writable inside the container, e.g. to run nested containers")
 
 	list := &cobra.Command{
 		Use:     "ps",
 		Short:   "list containers",
 		Aliases: []string{"list", "ls"},
-		Run:     ContainerListCommand,
+		RunE:    ContainerListCommand,
 	}
 
 	stop := &cobra.Command{
 		Use:   "stop",
 		Short: "stop containers",
 		Args:  cobra.MinimumNArgs(1),
-		Run:   ContainerStopCommand,
+		RunE:  ContainerStopCommand,
 	}
 
 	remove := &cobra.Command{
@@ -80,79 +196,59 @@ func getCommands() []*cobra.Command {
 		Short:   "remove containers",
 		Args:    cobra.MinimumNArgs(1),
 		Aliases: []string{"rm"},
-		Run:     ContainerRemoveCommand,
+		RunE:    ContainerRemoveCommand,
 	}
 
-	return []*cobra.Command{run, list, stop, remove}
-}
-
-func getContainerMetas() ([]*ContainerMeta, error) {
-	content, err := os.ReadFile(ContainerMetaFile)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return []*ContainerMeta{}, nil
-		}
+	pause := &cobra.Command{
+		Use:   "pause",
+		Short: "pause all processes within containers",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  ContainerPauseCommand,
 	}
 
-	var containers []*ContainerMeta
-	utils.Assert(json.Unmarshal(content, &containers))
-	return containers, nil
-}
-
-func getContainerMetasMap() (map[string]*ContainerMeta, error) {
-	containers, err := getContainerMetas()
-	if err != nil {
-		return nil, err
+	unpause := &cobra.Command{
+		Use:   "unpause",
+		Short: "unpause all processes within containers",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  ContainerUnpauseCommand,
 	}
 
-	cmap := map[string]*ContainerMeta{}
-	for idx, cnt := range containers {
-		cmap[cnt.ContainerID] = containers[idx]
-		cmap[cnt.Name] = containers[idx]
+	inspect := &cobra.Command{
+		Use:   "inspect",
+		Short: "display detailed information on containers",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  ContainerInspectCommand,
 	}
 
-	return cmap, nil
-}
-
-func removeContainerMeta(remove *ContainerMeta) {
-	containers, err := getContainerMetas()
-	utils.Assert(err)
+	top := &cobra.Command{
+		Use:   "top CONTAINER [-- ps OPTIONS]",
+		Short: "display the running processes of a container",
+		// the arguments after container are passed to ps, options after "--"
+		Args: cobra.MinimumNArgs(1),
+		RunE: ContainerTopCommand,
+	}
 
-	left := []*ContainerMeta{}
-	for _, cnt := range containers {
-		if cnt.ContainerID != remove.ContainerID {
-			left = append(left, cnt)
-		}
+	logs := &cobra.Command{
+		Use:   "logs CONTAINER",
+		Short: "fetch the logs of a container",
+		Args:  cobra.ExactArgs(1),
+		RunE:  ContainerLogsCommand,
 	}
+	logs.Flags().BoolP("follow", "f", false, "Follow log output")
+	logs.Flags().String("tail", "all", "Number of lines to show from the end of the logs")
+	logs.Flags().BoolP("timestamps", "t", false, "Show timestamps")
 
-	content, err := json.Marshal(left)
-	utils.Assert(err)
-	utils.Assert(os.WriteFile(ContainerMetaFile, content, 0644))
+	return []*cobra.Command{run, list, stop, remove, pause, unpause, inspect, top, logs}
 }
 
-func appendContainerMeta(cnt *ContainerMeta) {
-	containers, err := getContainerMetas()
-	utils.Assert(err)
-
-	containers = append(containers, cnt)
-
-	content, err := json.Marshal(containers)
-	utils.Assert(err)
-	utils.Assert(os.WriteFile(ContainerMetaFile, content, 0644))
+// runtimeConfigFile is the RuntimeConfig passed to the init process of the container,
+// it is kept with the container, a created container may be started later
+func runtimeConfigFile(containerId string) string {
+	return getContainerPath(containerId, containerRuntimeFile)
 }
 
-func updateContainerMeta(update *ContainerMeta) {
-	containers, err := getContainerMetas()
-	utils.Assert(err)
-
-	for _, cnt := range containers {
-		if cnt.ContainerID == update.ContainerID {
-			*cnt = *update
-			break
-		}
-	}
-
-	content, err := json.Marshal(containers)
-	utils.Assert(err)
-	utils.Assert(os.WriteFile(ContainerMetaFile, content, 0644))
+// runtimeFilesPath is the directory of the RuntimeFiles of the container, they only live
+// as long as the container runs, so they are in the state directory
+func runtimeFilesPath(containerId string) string {
+	return config.StatePath("containers", containerId)
 }
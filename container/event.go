@@ -0,0 +1,40 @@
+package container
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/events"
+)
+
+// emitContainerEvent reports a lifecycle event of the container to the log, the
+// subscribers of the events package and the handler of the caller
+func emitContainerEvent(cnt *ContainerMeta, action string, handler events.Handler) {
+	logrus.WithFields(logrus.Fields{
+		"type":   "container",
+		"action": action,
+		"id":     cnt.ContainerID,
+		"name":   cnt.Name,
+		"image":  cnt.Image,
+	}).Infof("event: container %s %s", action, cnt.ContainerID)
+
+	event := events.Event{
+		Type:   events.TypeContainer,
+		Action: action,
+		ID:     cnt.ContainerID,
+		Time:   time.Now(),
+		Attributes: map[string]string{
+			"name":  cnt.Name,
+			"image": cnt.Image,
+		},
+	}
+	if action == "die" {
+		event.Attributes["exitCode"] = strconv.Itoa(cnt.ExitCode)
+	}
+	events.Publish(event)
+	if handler != nil {
+		handler(event)
+	}
+}
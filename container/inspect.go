@@ -0,0 +1,41 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func ContainerInspectCommand(cmd *cobra.Command, args []string) error {
+	errs := []error{}
+	found := []*ContainerMeta{}
+	for _, c := range args {
+		cnt, err := InspectContainer(c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		found = append(found, cnt)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(found); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+// InspectContainer returns the container with the id or name, with its current status
+func InspectContainer(idOrName string) (*ContainerMeta, error) {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return nil, err
+	}
+
+	cnt.Status = getContainerStatus(cnt)
+	return cnt, nil
+}
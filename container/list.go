@@ -1,8 +1,6 @@
 package container
 
 import (
-	"encoding/json"
-	"errors"
 	"os"
 
 	"github.com/olekukonko/tablewriter"
@@ -11,26 +9,46 @@ import (
 	"aproton.tech/container/utils"
 )
 
-func ContainerListCommand(cmd *cobra.Command, args []string) {
-	_, err := os.Stat(ContainerMetaFile)
-	if errors.Is(err, os.ErrNotExist) {
-		return
+func ContainerListCommand(cmd *cobra.Command, args []string) error {
+	containers, err := ListContainers()
+	if err != nil {
+		return err
 	}
 
-	content, err := os.ReadFile(ContainerMetaFile)
-	utils.Assert(err)
-
-	var containers []ContainerMeta
-	utils.Assert(json.Unmarshal(content, &containers))
-
 	table := newContainerListTableRender()
 	for _, c := range containers {
-		if !utils.IsProcessExists(c.ProcessID, c.Command) {
-			c.Status = "Exited"
-		}
 		table.Append([]string{c.ContainerID, c.Image, c.Command, c.Created.Format("2006-01-02 15:04:05"), c.Status, c.Ports, c.Name})
 	}
 	table.Render()
+	return nil
+}
+
+// ListContainers returns all containers ordered by creation time, with their current status
+func ListContainers() ([]*ContainerMeta, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range containers {
+		c.Status = getContainerStatus(c)
+	}
+	return containers, nil
+}
+
+func getContainerStatus(c *ContainerMeta) string {
+	if c.Status == StatusCreated {
+		return StatusCreated
+	}
+
+	if !utils.IsProcessExists(c.ProcessID, c.Command) {
+		if c.OOMKilled {
+			return StatusExited + " (OOMKilled)"
+		}
+		return StatusExited
+	}
+
+	return c.Status
 }
 
 func newContainerListTableRender() *tablewriter.Table {
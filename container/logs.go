@@ -0,0 +1,234 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/utils"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// how often a followed log is checked for new output
+const logFollowInterval = 200 * time.Millisecond
+
+// LogEntry is an output of the container, one line of its log file
+type LogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// LogsOptions selects the entries returned by ContainerLogs
+type LogsOptions struct {
+	// Follow keeps reading the new output until the container exits
+	Follow bool
+	// Tail is the number of entries from the end, all entries when it is negative
+	Tail int
+	// Since skips the entries written before it
+	Since time.Time
+}
+
+func ContainerLogsCommand(cmd *cobra.Command, args []string) error {
+	opts := LogsOptions{
+		Follow: cmd.Flag("follow").Value.String() == "true",
+		Tail:   -1,
+	}
+
+	if flag := cmd.Flag("tail"); flag.Value.String() != "all" {
+		tail, err := strconv.Atoi(flag.Value.String())
+		if err != nil {
+			return fmt.Errorf("invalid tail: %w", err)
+		}
+		opts.Tail = tail
+	}
+	timestamps := cmd.Flag("timestamps").Value.String() == "true"
+
+	return ContainerLogs(cmd.Context(), args[0], opts, func(entry *LogEntry) error {
+		out := os.Stdout
+		if entry.Stream == StreamStderr {
+			out = os.Stderr
+		}
+
+		if timestamps {
+			fmt.Fprintf(out, "%s ", entry.Time.Format(time.RFC3339Nano))
+		}
+		_, err := io.WriteString(out, entry.Log)
+		return err
+	})
+}
+
+// ContainerLogs calls fn with the output of the container in the order it was written
+func ContainerLogs(ctx context.Context, idOrName string, opts LogsOptions, fn func(*LogEntry) error) error {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(getContainerPath(cnt.ContainerID, containerLogFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// never started
+		file, err = os.Open(os.DevNull)
+		if err != nil {
+			return err
+		}
+	}
+	defer file.Close()
+
+	reader := &logReader{reader: bufio.NewReader(file)}
+	tail := []*LogEntry{}
+	emit := func(entry *LogEntry) error {
+		if entry.Time.Before(opts.Since) {
+			return nil
+		}
+		if opts.Tail >= 0 {
+			tail = append(tail, entry)
+			if len(tail) > opts.Tail {
+				tail = tail[1:]
+			}
+			return nil
+		}
+		return fn(entry)
+	}
+
+	if err := reader.read(emit); err != nil {
+		return err
+	}
+
+	for _, entry := range tail {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(logFollowInterval)
+	defer ticker.Stop()
+	for {
+		running := isContainerRunning(cnt.ContainerID)
+
+		// the output written before the exit is read once more
+		if err := reader.read(fn); err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type logReader struct {
+	reader *bufio.Reader
+	// the end of the log may be a line which is being written
+	partial []byte
+}
+
+// read reads the complete lines until the end of the log
+func (r *logReader) read(fn func(*LogEntry) error) error {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				r.partial = append(r.partial, line...)
+				return nil
+			}
+			return err
+		}
+
+		if len(r.partial) != 0 {
+			line = append(r.partial, line...)
+			r.partial = nil
+		}
+
+		entry := &LogEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return fmt.Errorf("read log: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func isContainerRunning(containerId string) bool {
+	cnt, err := getContainerMeta(containerId)
+	if err != nil {
+		return false
+	}
+	return cnt.Status != StatusCreated && cnt.Status != StatusExited &&
+		utils.IsProcessExists(cnt.ProcessID, cnt.Command)
+}
+
+// containerLogger writes the output of the container into its log file
+type containerLogger struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func openContainerLogger(containerId string) (*containerLogger, error) {
+	file, err := os.OpenFile(getContainerPath(containerId, containerLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &containerLogger{file: file}, nil
+}
+
+// writer returns the writer of a stream, the output is also copied to out when it is not nil
+func (l *containerLogger) writer(stream string, out io.Writer) io.Writer {
+	return &logStreamWriter{logger: l, stream: stream, out: out}
+}
+
+func (l *containerLogger) Close() error {
+	return l.file.Close()
+}
+
+type logStreamWriter struct {
+	logger *containerLogger
+	stream string
+	out    io.Writer
+}
+
+func (w *logStreamWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(&LogEntry{Log: string(p), Stream: w.stream, Time: time.Now().UTC()})
+	if err != nil {
+		return 0, err
+	}
+
+	w.logger.lock.Lock()
+	_, err = w.logger.file.Write(append(line, '\n'))
+	w.logger.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.out != nil {
+		// the error is ignored, the container must not fail because a reader went away
+		w.out.Write(p)
+	}
+	return len(p), nil
+}
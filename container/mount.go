@@ -0,0 +1,273 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// Mount is a filesystem mounted into the container, Source is a host path
+// for bind mounts, a volume name for volumes and unused for tmpfs
+type Mount struct {
+	Type        string `json:"type"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly"`
+	NoCopy      bool   `json:"noCopy,omitempty"`
+	TmpfsSize   uint64 `json:"tmpfsSize,omitempty"`
+	TmpfsMode   uint32 `json:"tmpfsMode,omitempty"`
+	NoExec      bool   `json:"noExec,omitempty"`
+}
+
+// DefaultShmSize is the size of /dev/shm when --shm-size is not set
+const DefaultShmSize = 64 * 1024 * 1024
+
+// parseVolumeSpec parses -v [SOURCE:]DESTINATION[:ro|rw], a SOURCE which is
+// not a path is a named volume, no SOURCE means an anonymous volume
+func parseVolumeSpec(spec string) (*Mount, error) {
+	parts := strings.Split(spec, ":")
+
+	m := &Mount{Type: MountTypeVolume}
+	if len(parts) == 3 || (len(parts) == 2 && (parts[1] == "ro" || parts[1] == "rw")) {
+		mode := parts[len(parts)-1]
+		if mode != "ro" && mode != "rw" {
+			return nil, fmt.Errorf("invalid volume %q: unknown mode %q", spec, mode)
+		}
+		m.ReadOnly = mode == "ro"
+		parts = parts[:len(parts)-1]
+	}
+
+	switch len(parts) {
+	case 1:
+		m.Destination = parts[0]
+	case 2:
+		m.Source, m.Destination = parts[0], parts[1]
+	default:
+		return nil, fmt.Errorf("invalid volume %q", spec)
+	}
+
+	if strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, ".") {
+		m.Type = MountTypeBind
+	}
+
+	return m, validateMount(m)
+}
+
+// parseMountSpec parses --mount type=bind|volume|tmpfs,source=...,target=...[,readonly]
+func parseMountSpec(spec string) (*Mount, error) {
+	m := &Mount{Type: MountTypeVolume}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(field, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		switch key {
+		case "type":
+			m.Type = value
+		case "source", "src":
+			m.Source = value
+		case "target", "destination", "dst":
+			m.Destination = value
+		case "readonly", "ro":
+			ro, err := parseMountBool(value, hasValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mount %q: %w", spec, err)
+			}
+			m.ReadOnly = ro
+		case "volume-nocopy":
+			nocopy, err := parseMountBool(value, hasValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mount %q: %w", spec, err)
+			}
+			m.NoCopy = nocopy
+		case "tmpfs-size":
+			size, err := humanize.ParseBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mount %q: %w", spec, err)
+			}
+			m.TmpfsSize = size
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mount %q: %w", spec, err)
+			}
+			m.TmpfsMode = uint32(mode)
+		default:
+			return nil, fmt.Errorf("invalid mount %q: unknown option %q", spec, key)
+		}
+	}
+
+	return m, validateMount(m)
+}
+
+// parseTmpfsSpec parses --tmpfs DESTINATION[:size=64m,mode=1777,ro,noexec]
+func parseTmpfsSpec(spec string) (*Mount, error) {
+	destination, options, _ := strings.Cut(spec, ":")
+
+	m := &Mount{Type: MountTypeTmpfs, Destination: destination}
+	for _, opt := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "":
+		case "size":
+			size, err := humanize.ParseBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tmpfs %q: %w", spec, err)
+			}
+			m.TmpfsSize = size
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tmpfs %q: %w", spec, err)
+			}
+			m.TmpfsMode = uint32(mode)
+		case "ro", "rw":
+			m.ReadOnly = key == "ro"
+		case "noexec", "exec":
+			m.NoExec = key == "noexec"
+		case "nosuid", "nodev":
+			// a tmpfs is always mounted nosuid and nodev
+		default:
+			return nil, fmt.Errorf("invalid tmpfs %q: unknown option %q", spec, key)
+		}
+	}
+
+	return m, validateMount(m)
+}
+
+func parseMountBool(value string, hasValue bool) (bool, error) {
+	if !hasValue {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func validateMount(m *Mount) error {
+	if m.Destination == "" || !filepath.IsAbs(m.Destination) {
+		return fmt.Errorf("mount destination %q must be an absolute path", m.Destination)
+	}
+	m.Destination = filepath.Clean(m.Destination)
+
+	switch m.Type {
+	case MountTypeBind:
+		if m.Source == "" {
+			return fmt.Errorf("bind mount of %s needs a source", m.Destination)
+		}
+		source, err := filepath.Abs(m.Source)
+		if err != nil {
+			return err
+		}
+		m.Source = source
+	case MountTypeVolume:
+	case MountTypeTmpfs:
+		if m.Source != "" {
+			return fmt.Errorf("tmpfs mount of %s does not support source", m.Destination)
+		}
+	default:
+		return fmt.Errorf("unknown mount type %q", m.Type)
+	}
+
+	return nil
+}
+
+// copyMounts validates the mounts of a container and returns copies of them, the mounts
+// of the caller are not changed when the volumes are prepared
+func copyMounts(mounts []*Mount) ([]*Mount, error) {
+	result := []*Mount{}
+	destinations := map[string]bool{}
+	for _, m := range mounts {
+		if m == nil {
+			continue
+		}
+
+		copied := *m
+		if err := validateMount(&copied); err != nil {
+			return nil, err
+		}
+		if destinations[copied.Destination] {
+			return nil, fmt.Errorf("duplicate mount point: %s", copied.Destination)
+		}
+		destinations[copied.Destination] = true
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+// ParseMounts collects the -v, --mount and --tmpfs options of run command
+func ParseMounts(volumes []string, mounts []string, tmpfs []string) ([]*Mount, error) {
+	result := []*Mount{}
+	destinations := map[string]bool{}
+
+	add := func(m *Mount) error {
+		if destinations[m.Destination] {
+			return fmt.Errorf("duplicate mount point: %s", m.Destination)
+		}
+		destinations[m.Destination] = true
+		result = append(result, m)
+		return nil
+	}
+
+	for _, spec := range volumes {
+		m, err := parseVolumeSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(m); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range mounts {
+		m, err := parseMountSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(m); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range tmpfs {
+		m, err := parseTmpfsSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// prepareVolumes creates the volumes of mounts when they don't exist, and copies
+// the image content at the mount destination into them on first use
+func prepareVolumes(mounts []*Mount, rootfs string) error {
+	for _, m := range mounts {
+		if m.Type != MountTypeVolume {
+			continue
+		}
+
+		vol, err := createVolume(m.Source, map[string]string{})
+		if err != nil {
+			return err
+		}
+		m.Source = vol.Name
+
+		if !m.NoCopy {
+			if err := copyImageContentToVolume(vol.Name, rootfs, m.Destination); err != nil {
+				return fmt.Errorf("copy image content to volume %s: %w", vol.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/sirupsen/logrus"
+)
+
+// buildMounts mounts bind mounts, volumes and tmpfs into the rootfs, it must be called
+// before chroot, a parent directory is always mounted before its children
+func buildMounts(sandbox string, mounts []*Mount) error {
+	sorted := slices.Clone(mounts)
+	slices.SortStableFunc(sorted, func(a, b *Mount) int {
+		return strings.Count(a.Destination, "/") - strings.Count(b.Destination, "/")
+	})
+
+	for _, m := range sorted {
+		// destination is resolved inside the rootfs, a symlink in the image can not point it to host
+		target, err := securejoin.SecureJoin(sandbox, m.Destination)
+		if err != nil {
+			return err
+		}
+
+		logrus.Infof("mount %s(%s) to %s", m.Type, m.Source, m.Destination)
+
+		switch m.Type {
+		case MountTypeBind, MountTypeVolume:
+			source := m.Source
+			if m.Type == MountTypeVolume {
+				source = getVolumeDataPath(m.Source)
+			}
+			if err := bindMount(source, target, m.ReadOnly); err != nil {
+				return err
+			}
+		case MountTypeTmpfs:
+			if err := mountTmpfs(target, m.TmpfsSize, m.TmpfsMode, m.ReadOnly, m.NoExec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func bindMount(source, target string, readOnly bool) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if err := createMountPoint(target, fi.IsDir()); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+
+	if readOnly {
+		// MS_RDONLY is ignored when creating a bind mount, it only works by a remount
+		return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_REC, "")
+	}
+
+	return nil
+}
+
+// buildRuntimeFiles bind mounts the runtime files from filesDir, like docker
+// does, so the image files under them are kept as they are
+func buildRuntimeFiles(sandbox string, filesDir string) error {
+	for _, file := range RuntimeFiles {
+		target, err := securejoin.SecureJoin(sandbox, file)
+		if err != nil {
+			return err
+		}
+
+		if err := bindMount(filepath.Join(filesDir, filepath.Base(file)), target, false); err != nil {
+			return fmt.Errorf("mount %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// buildShm mounts a private /dev/shm, so the container doesn't share the one of host devtmpfs
+func buildShm(sandbox string, size uint64) error {
+	target, err := securejoin.SecureJoin(sandbox, "/dev/shm")
+	if err != nil {
+		return err
+	}
+
+	return mountTmpfs(target, size, 01777, false, true)
+}
+
+func mountTmpfs(target string, size uint64, mode uint32, readOnly bool, noExec bool) error {
+	if err := createMountPoint(target, true); err != nil {
+		return err
+	}
+
+	options := []string{}
+	if size != 0 {
+		options = append(options, "size="+strconv.FormatUint(size, 10))
+	}
+	if mode != 0 {
+		options = append(options, "mode="+strconv.FormatUint(uint64(mode), 8))
+	}
+
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if noExec {
+		flags |= syscall.MS_NOEXEC
+	}
+
+	return syscall.Mount("tmpfs", target, "tmpfs", flags, strings.Join(options, ","))
+}
+
+func createMountPoint(target string, isDir bool) error {
+	if isDir {
+		return os.MkdirAll(target, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,125 @@
+package container
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyMounts(t *testing.T) {
+	mounts := []*Mount{
+		{Type: MountTypeVolume, Destination: "/data/"},
+		{Type: MountTypeBind, Source: "relative", Destination: "/src"},
+	}
+
+	copied, err := copyMounts(mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied[0].Source = "generated"
+
+	// the mounts of the caller can be used for another container
+	if mounts[0].Source != "" || mounts[0].Destination != "/data/" || mounts[1].Source != "relative" {
+		t.Errorf("mounts of the caller changed: %+v, %+v", mounts[0], mounts[1])
+	}
+	if copied[0].Destination != "/data" {
+		t.Errorf("destination %q, want /data", copied[0].Destination)
+	}
+	if want, _ := filepath.Abs("relative"); copied[1].Source != want {
+		t.Errorf("bind source %q, want %q", copied[1].Source, want)
+	}
+
+	for _, invalid := range [][]*Mount{
+		{{Destination: "/x"}},
+		{{Type: "nfs", Destination: "/x"}},
+		{{Type: MountTypeVolume, Destination: "x"}},
+		{{Type: MountTypeBind, Destination: "/x"}},
+		{{Type: MountTypeVolume, Destination: "/x"}, {Type: MountTypeTmpfs, Destination: "/x/"}},
+	} {
+		if _, err := copyMounts(invalid); err == nil {
+			t.Errorf("copyMounts(%+v) should fail", invalid[0])
+		}
+	}
+}
+
+func TestParseMountSpecs(t *testing.T) {
+	rel, err := filepath.Abs("rel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		parse func(string) (*Mount, error)
+		spec  string
+		want  Mount
+	}{
+		{parseVolumeSpec, "name:/x:ro", Mount{Type: MountTypeVolume, Source: "name", Destination: "/x", ReadOnly: true}},
+		{parseVolumeSpec, "name:/x:rw", Mount{Type: MountTypeVolume, Source: "name", Destination: "/x"}},
+		{parseVolumeSpec, "/x", Mount{Type: MountTypeVolume, Destination: "/x"}},
+		{parseVolumeSpec, "/x/:ro", Mount{Type: MountTypeVolume, Destination: "/x", ReadOnly: true}},
+		{parseVolumeSpec, "/host:/x", Mount{Type: MountTypeBind, Source: "/host", Destination: "/x"}},
+		{parseVolumeSpec, "./rel:/x:ro", Mount{Type: MountTypeBind, Source: rel, Destination: "/x", ReadOnly: true}},
+
+		{parseMountSpec, "type=bind,source=/host,target=/x,readonly", Mount{Type: MountTypeBind, Source: "/host", Destination: "/x", ReadOnly: true}},
+		{parseMountSpec, "src=name,dst=/x,ro=false,volume-nocopy", Mount{Type: MountTypeVolume, Source: "name", Destination: "/x", NoCopy: true}},
+		{parseMountSpec, "destination=/x", Mount{Type: MountTypeVolume, Destination: "/x"}},
+		{parseMountSpec, "type=tmpfs,target=/t,tmpfs-size=1MiB,tmpfs-mode=1777", Mount{Type: MountTypeTmpfs, Destination: "/t", TmpfsSize: 1 << 20, TmpfsMode: 01777}},
+
+		{parseTmpfsSpec, "/t", Mount{Type: MountTypeTmpfs, Destination: "/t"}},
+		{parseTmpfsSpec, "/t:size=64k,mode=700,ro,noexec,nosuid,nodev", Mount{Type: MountTypeTmpfs, Destination: "/t", TmpfsSize: 64000, TmpfsMode: 0700, ReadOnly: true, NoExec: true}},
+		{parseTmpfsSpec, "/t:rw,exec", Mount{Type: MountTypeTmpfs, Destination: "/t"}},
+	} {
+		got, err := tc.parse(tc.spec)
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.spec, err)
+			continue
+		}
+		if *got != tc.want {
+			t.Errorf("parse %q = %+v, want %+v", tc.spec, *got, tc.want)
+		}
+	}
+}
+
+func TestParseMountSpecErrors(t *testing.T) {
+	for _, tc := range []struct {
+		parse func(string) (*Mount, error)
+		spec  string
+	}{
+		{parseVolumeSpec, "name:/x:rx"},
+		{parseVolumeSpec, "a:b:c:d"},
+		{parseVolumeSpec, "name:x"},
+		{parseVolumeSpec, "x"},
+		{parseVolumeSpec, ""},
+
+		{parseMountSpec, "type=bind,target=/x"},
+		{parseMountSpec, "type=nfs,target=/x"},
+		{parseMountSpec, "target=/x,bind-propagation=shared"},
+		{parseMountSpec, "target=/x,readonly=maybe"},
+		{parseMountSpec, "source=name"},
+		{parseMountSpec, "type=tmpfs,source=a,target=/t"},
+		{parseMountSpec, "type=tmpfs,target=/t,tmpfs-mode=9"},
+		{parseMountSpec, "type=tmpfs,target=/t,tmpfs-size=lots"},
+
+		{parseTmpfsSpec, "t"},
+		{parseTmpfsSpec, "/t:size=lots"},
+		{parseTmpfsSpec, "/t:mode=rwx"},
+		{parseTmpfsSpec, "/t:uid=1000"},
+	} {
+		if m, err := tc.parse(tc.spec); err == nil {
+			t.Errorf("parse %q = %+v, want an error", tc.spec, *m)
+		}
+	}
+}
+
+func TestParseMountsDuplicate(t *testing.T) {
+	if _, err := ParseMounts([]string{"/x"}, []string{"type=tmpfs,target=/x/"}, nil); err == nil {
+		t.Error("a destination mounted twice should fail")
+	}
+
+	mounts, err := ParseMounts([]string{"v:/a"}, []string{"target=/b"}, []string{"/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 || mounts[0].Destination != "/a" || mounts[1].Destination != "/b" || mounts[2].Destination != "/c" {
+		t.Errorf("mounts %+v, want /a, /b and /c in order", mounts)
+	}
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/events"
+)
+
+// watchOOMEvents polls the memory events of the container cgroup and emits an
+// event every time the oom_kill counter increases. The returned function
+// stops the watcher and returns the final oom_kill counter.
+func watchOOMEvents(mgr CgroupManager, cnt *ContainerMeta, handler events.Handler) func() uint64 {
+	var (
+		oomKills uint64
+		mu       sync.Mutex
+	)
+
+	check := func() {
+		kills, err := mgr.OOMKillCount(cnt.ContainerID)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if kills > oomKills {
+			logrus.Warnf("container %s: %d process(es) killed by the OOM killer", cnt.ContainerID, kills-oomKills)
+			oomKills = kills
+			emitContainerEvent(cnt, "oom", handler)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(500 * time.Millisecond):
+				check()
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		<-stopped
+		// the cgroup is still there, catch the kill which happened right before exiting
+		check()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return oomKills
+	}
+}
+
+func isKilledByOOM(state *os.ProcessState, oomKills uint64) bool {
+	if state == nil || oomKills == 0 {
+		return false
+	}
+
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+func setOOMScoreAdj(pid int, adj int) error {
+	if adj < -1000 || adj > 1000 {
+		return fmt.Errorf("invalid oom-score-adj %d, must be in range [-1000, 1000]", adj)
+	}
+
+	return os.WriteFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid), []byte(strconv.Itoa(adj)), 0644)
+}
@@ -0,0 +1,114 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/utils"
+)
+
+func ContainerPauseCommand(cmd *cobra.Command, args []string) error {
+	errs := []error{}
+	for _, c := range args {
+		if err := PauseContainer(c); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		utils.PrintToConsole("%s\n", c)
+	}
+
+	return errors.Join(errs...)
+}
+
+func ContainerUnpauseCommand(cmd *cobra.Command, args []string) error {
+	errs := []error{}
+	for _, c := range args {
+		if err := UnpauseContainer(c); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		utils.PrintToConsole("%s\n", c)
+	}
+
+	return errors.Join(errs...)
+}
+
+// PauseContainer freezes all processes of a running container
+func PauseContainer(idOrName string) error {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return err
+	}
+
+	if !utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+		return fmt.Errorf("container %s is not running", idOrName)
+	}
+
+	if cnt.Status == StatusPaused {
+		return fmt.Errorf("container %s is already paused", idOrName)
+	}
+
+	if err := pauseContainer(cnt); err != nil {
+		return fmt.Errorf("pause container %s: %w", idOrName, err)
+	}
+	return nil
+}
+
+// UnpauseContainer thaws the processes of a paused container
+func UnpauseContainer(idOrName string) error {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return err
+	}
+
+	if cnt.Status != StatusPaused {
+		return fmt.Errorf("container %s is not paused", idOrName)
+	}
+
+	if err := unpauseContainer(cnt); err != nil {
+		return fmt.Errorf("unpause container %s: %w", idOrName, err)
+	}
+	return nil
+}
+
+func pauseContainer(cnt *ContainerMeta) error {
+	mgr, err := getContainerCgroupManager(cnt)
+	if err != nil {
+		return err
+	}
+
+	if err := mgr.Freeze(cnt.ContainerID); err != nil {
+		return err
+	}
+
+	if err := updateContainerState(cnt, func(state *ContainerState) {
+		state.Status = StatusPaused
+	}); err != nil {
+		return err
+	}
+
+	emitContainerEvent(cnt, "pause", nil)
+	return nil
+}
+
+func unpauseContainer(cnt *ContainerMeta) error {
+	mgr, err := getContainerCgroupManager(cnt)
+	if err != nil {
+		return err
+	}
+
+	if err := mgr.Thaw(cnt.ContainerID); err != nil {
+		return err
+	}
+
+	if err := updateContainerState(cnt, func(state *ContainerState) {
+		state.Status = StatusRunning
+	}); err != nil {
+		return err
+	}
+
+	emitContainerEvent(cnt, "unpause", nil)
+	return nil
+}
@@ -0,0 +1,100 @@
+package container
+
+import (
+	"aproton.tech/container/utils"
+)
+
+// PruneContainers removes all stopped containers, returns their ids and the disk space of their sandboxes
+func PruneContainers(dryRun bool) ([]string, uint64, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	removed := []string{}
+	reclaimed := uint64(0)
+	for _, cnt := range containers {
+		if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+			continue
+		}
+
+		size, err := getContainerSize(cnt)
+		if err != nil {
+			return nil, 0, err
+		}
+		reclaimed += size
+
+		if !dryRun {
+			if err := removeContainer(cnt); err != nil {
+				return nil, 0, err
+			}
+		}
+		removed = append(removed, cnt.ContainerID)
+	}
+
+	return removed, reclaimed, nil
+}
+
+// PruneVolumes removes all volumes not used by any container, returns their names and their disk space
+func PruneVolumes(dryRun bool) ([]string, uint64, error) {
+	unlock, err := lockVolumes(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	volumes, err := getVolumes()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	removed := []string{}
+	reclaimed := uint64(0)
+	for _, vol := range volumes {
+		users, err := getVolumeUsers(vol.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(users) != 0 {
+			continue
+		}
+
+		size, err := utils.DiskUsage(getVolumeDataPath(vol.Name))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if !dryRun {
+			if err := removeVolume(vol.Name); err != nil {
+				return nil, 0, err
+			}
+		}
+		removed = append(removed, vol.Name)
+		reclaimed += size
+	}
+
+	return removed, reclaimed, nil
+}
+
+// GetImagesInUse returns the names of the images used by containers, running or not,
+// the containers in except are ignored
+func GetImagesInUse(except ...string) (map[string]bool, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, err
+	}
+
+	ignored := map[string]bool{}
+	for _, id := range except {
+		ignored[id] = true
+	}
+
+	images := map[string]bool{}
+	for _, cnt := range containers {
+		if !ignored[cnt.ContainerID] {
+			images[cnt.Image] = true
+		}
+	}
+
+	return images, nil
+}
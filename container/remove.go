@@ -1,42 +1,108 @@
 package container
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"syscall"
 
 	"github.com/shirou/gopsutil/disk"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"aproton.tech/container/image"
 	"aproton.tech/container/utils"
 )
 
-func ContainerRemoveCommand(cmd *cobra.Command, args []string) {
+func ContainerRemoveCommand(cmd *cobra.Command, args []string) error {
 	cmap, err := getContainerMetasMap()
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
+	errs := []error{}
 	for _, c := range args {
-		if cnt, ok := cmap[c]; ok {
-			if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
-				utils.PrintToConsole("Container %s is running, please stop it first\n", c)
-				break
-			}
+		cnt, ok := cmap[c]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrContainerNotFound, c))
+			continue
+		}
 
-			removeContainerMeta(cnt)
-			if cnt.Overlay != nil {
-				unmountOverlayFileSystem(cnt.Overlay)
-			}
-			if cnt.Sandbox != "" {
-				os.RemoveAll(cnt.Sandbox)
-			}
-		} else {
-			utils.PrintToConsole("No such container: %s\n", c)
-			break
+		if err := removeStoppedContainer(c, cnt); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		utils.PrintToConsole("%s\n", c)
+	}
+
+	if err := image.RemoveStaleTempFiles(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RemoveContainer removes a container which is not running
+func RemoveContainer(idOrName string) error {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return err
+	}
+
+	if err := removeStoppedContainer(idOrName, cnt); err != nil {
+		return err
+	}
+
+	return image.RemoveStaleTempFiles()
+}
+
+func removeStoppedContainer(name string, cnt *ContainerMeta) error {
+	if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+		return fmt.Errorf("container %s is running, please stop it first", name)
+	}
+
+	if err := removeContainer(cnt); err != nil {
+		return fmt.Errorf("remove container %s: %w", name, err)
+	}
+	return nil
+}
+
+// removeContainer removes the meta, the sandbox and the runtime files of a stopped container,
+// the meta is removed last, so a failed removal can be retried
+func removeContainer(cnt *ContainerMeta) error {
+	if cnt.Overlay != nil {
+		if err := unmountOverlayFileSystem(cnt.Overlay); err != nil {
+			return err
 		}
+		if _, err := image.ReleaseLayers(cnt.ContainerID); err != nil {
+			return err
+		}
+	}
+	if err := removeContainerMeta(cnt); err != nil {
+		return err
+	}
+	if cnt.Sandbox != "" {
+		os.RemoveAll(cnt.Sandbox)
+	}
+	os.RemoveAll(runtimeFilesPath(cnt.ContainerID))
+
+	emitContainerEvent(cnt, "destroy", nil)
+	return nil
+}
+
+// autoRemoveContainer removes a container and its anonymous volumes, like docker run --rm
+func autoRemoveContainer(cnt *ContainerMeta) {
+	if err := removeContainer(cnt); err != nil {
+		logrus.Warnf("remove container %s: %v", cnt.ContainerID, err)
+		return
+	}
+	if err := removeAnonymousVolumes(cnt.Mounts); err != nil {
+		logrus.Warnf("remove volumes of container %s: %v", cnt.ContainerID, err)
 	}
 }
 
-func unmountOverlayFileSystem(overlay *Overlay) {
+func unmountOverlayFileSystem(overlay *Overlay) error {
 	mountPoint := overlay.MountPoint
 
 	if !filepath.IsAbs(overlay.MountPoint) {
@@ -46,11 +112,15 @@ func unmountOverlayFileSystem(overlay *Overlay) {
 	}
 
 	ps, err := disk.Partitions(true)
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
 	for _, p := range ps {
 		if p.Mountpoint == mountPoint {
-			utils.Assert(syscall.Unmount(overlay.MountPoint, 0))
+			if err := syscall.Unmount(overlay.MountPoint, 0); err != nil {
+				return fmt.Errorf("unmount %s: %w", overlay.MountPoint, err)
+			}
 			break
 		}
 	}
@@ -61,4 +131,5 @@ func unmountOverlayFileSystem(overlay *Overlay) {
 	if overlay.Upper != "" {
 		os.RemoveAll(overlay.Working)
 	}
+	return nil
 }
@@ -4,16 +4,22 @@ package container
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"aproton.tech/container/config"
 	"aproton.tech/container/image"
 	"aproton.tech/container/utils"
 	"github.com/dustin/go-humanize"
@@ -27,42 +33,309 @@ import (
 	"github.com/spf13/cobra"
 )
 
-const upperPath = "var/overlay/upper"
-const WorkingPath = "var/overlay/working"
 const CAP_SYS_ADMIN uint64 = 1 << 21
 
-func ContainerRunCommand(cmd *cobra.Command, args []string) {
-	imgname, err := name.ParseReference(args[0])
-	utils.Assert(err)
-	img, err := image.GetImage(imgname.Name(), false)
-	utils.Assert(err)
+// RuntimeConfig is passed from the run command to the container init process
+type RuntimeConfig struct {
+	v1.Config
+
+	CgroupWritable bool     `json:"cgroupWritable"`
+	Mounts         []*Mount `json:"mounts"`
+	ReadonlyRootfs bool     `json:"readonlyRootfs"`
+	ShmSize        uint64   `json:"shmSize"`
+}
+
+// GetRuntimeConfig returns the process config of the container
+func GetRuntimeConfig(idOrName string) (*RuntimeConfig, error) {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeConfig := &RuntimeConfig{}
+	if err := readJSONFile(runtimeConfigFile(cnt.ContainerID), runtimeConfig); err != nil {
+		return nil, err
+	}
+	return runtimeConfig, nil
+}
+
+func init() {
+	reexec.Register(ReExecRunCommand, func() {
+		utils.SetSubProcessFlag()
+		err := config.Init("", "", "")
+		if err == nil {
+			err = Run(os.Args[1], os.Args[2], os.Args[3])
+		}
+		// Run only returns when the command was not executed
+		logrus.Errorf("run failed: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(utils.ExitCode(err))
+	})
+}
+
+func ContainerRunCommand(cmd *cobra.Command, args []string) error {
+	opts := RunOptions{
+		Image:          args[0],
+		Cmd:            args[1:],
+		Name:           cmd.Flag("name").Value.String(),
+		AutoRemove:     cmd.Flag("rm").Value.String() == "true",
+		ReadonlyRootfs: cmd.Flag("read-only").Value.String() == "true",
+		CgroupWritable: cmd.Flag("cgroup-rw").Value.String() == "true",
+		CgroupManager:  cmd.Flag("cgroup-manager").Value.String(),
+		Platform:       cmd.Flag("platform").Value.String(),
+	}
+
+	volumes, err := cmd.Flags().GetStringArray("volume")
+	if err != nil {
+		return err
+	}
+	mountSpecs, err := cmd.Flags().GetStringArray("mount")
+	if err != nil {
+		return err
+	}
+	tmpfs, err := cmd.Flags().GetStringArray("tmpfs")
+	if err != nil {
+		return err
+	}
+	if opts.Mounts, err = ParseMounts(volumes, mountSpecs, tmpfs); err != nil {
+		return err
+	}
+
+	if flag := cmd.Flag("shm-size"); flag.Value.String() != "" {
+		if opts.ShmSize, err = humanize.ParseBytes(flag.Value.String()); err != nil {
+			return fmt.Errorf("invalid shm-size: %w", err)
+		}
+	}
+
+	if flag := cmd.Flag("memory"); flag.Value.String() != "" {
+		if opts.Memory, err = humanize.ParseBytes(flag.Value.String()); err != nil {
+			return fmt.Errorf("invalid memory: %w", err)
+		}
+	}
+
+	if flag := cmd.Flag("oom-score-adj"); flag.Changed {
+		adj, err := strconv.Atoi(flag.Value.String())
+		if err != nil {
+			return fmt.Errorf("invalid oom-score-adj: %w", err)
+		}
+		opts.OOMScoreAdj = &adj
+	}
+
+	if cmd.Flag("tty").Value.String() == "true" {
+		opts.Tty = true
+		opts.Stdin = os.Stdin
+		opts.Stdout = os.Stdout
+		opts.Stderr = os.Stderr
+	}
+
+	result, err := RunContainer(cmd.Context(), opts)
+	if err != nil {
+		return err
+	}
+
+	if result.ExitCode != 0 {
+		return &utils.ExitError{Code: result.ExitCode}
+	}
+	return nil
+}
+
+// RunningContainer is a container started by StartContainer, Wait must be called
+// to reap the container process and release its resources
+type RunningContainer struct {
+	ID   string
+	Name string
+
+	ctx          context.Context
+	opts         StartOptions
+	meta         *ContainerMeta
+	process      *exec.Cmd
+	logger       *containerLogger
+	stopOOMWatch func() uint64
+	cleanup      func()
+}
+
+// RunContainer creates and starts the container, then waits until it exits
+func RunContainer(ctx context.Context, opts RunOptions) (*RunResult, error) {
+	cnt, err := CreateContainer(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := StartContainer(ctx, cnt.ContainerID, StartOptions{
+		Tty:     opts.Tty,
+		Stdin:   opts.Stdin,
+		Stdout:  opts.Stdout,
+		Stderr:  opts.Stderr,
+		OnEvent: opts.OnEvent,
+	})
+	if err != nil {
+		if opts.AutoRemove {
+			autoRemoveContainer(cnt)
+		}
+		return nil, err
+	}
+	return rc.Wait()
+}
+
+// CreateContainer prepares the sandbox of the container from the image, pulling it
+// when needed, the container can be started by StartContainer then
+func CreateContainer(ctx context.Context, opts RunOptions) (*ContainerMeta, error) {
+	imgname, err := name.ParseReference(opts.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ShmSize == 0 {
+		opts.ShmSize = DefaultShmSize
+	}
+	if opts.CgroupManager == "" {
+		opts.CgroupManager = CgroupManagerAuto
+	}
+	if opts.Mounts, err = copyMounts(opts.Mounts); err != nil {
+		return nil, err
+	}
 
 	containerId := shortuuid.New()
 
-	var sdx *Overlay
-	var sandbox string
-	if canUseOverlay() {
-		sdx = buildOverlaySandbox(img, containerId)
-		sandbox = sdx.MountPoint
+	var endCreate func(recorded bool)
+	if opts.Name != "" {
+		if endCreate, err = reserveContainerName(opts.Name, containerId); err != nil {
+			return nil, err
+		}
 	} else {
-		sandbox = image.BuildSandbox(img, containerId)
+		// a generated name may be taken, another one is tried
+		for i := 0; ; i++ {
+			opts.Name = faker.Username()
+			if endCreate, err = reserveContainerName(opts.Name, containerId); err == nil {
+				break
+			} else if !errors.Is(err, ErrContainerNameInUse) || i == 10 {
+				return nil, err
+			}
+		}
 	}
 
-	config, _ := image.GetImageConfig(img)
+	// until the container is recorded, nothing else knows about its name and sandbox
+	recorded := false
+	defer func() {
+		endCreate(recorded)
+	}()
+
+	mgr, err := NewCgroupManager(opts.CgroupManager)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("cgroup manager = %s", mgr.Name())
 
-	cnt := buildProcessCmd(config, args[1:])
+	img, platform, sdx, sandbox, err := buildContainerSandbox(ctx, imgname.Name(), opts.Rootfs, opts.Platform, containerId)
+	if err != nil {
+		return nil, err
+	}
 
-	os.MkdirAll("var/runtime", 0755)
-	tmpFile := fmt.Sprintf("var/runtime/%s.json", containerId)
+	defer func() {
+		if !recorded {
+			removeContainerSandbox(containerId, sdx, sandbox)
+			if err := removeAnonymousVolumes(opts.Mounts); err != nil {
+				logrus.Warnf("remove volumes of container %s: %v", containerId, err)
+			}
+		}
+	}()
 
-	if err := os.WriteFile(tmpFile, cnt, 440); err != nil {
-		utils.Assert(err)
+	// the volumes are not removed by volume rm or prune until the container is recorded
+	unlockVolumes, err := lockVolumes(false)
+	if err != nil {
+		return nil, err
 	}
+	unlockVolumes = sync.OnceFunc(unlockVolumes)
+	defer unlockVolumes()
 
-	defer os.Remove(tmpFile)
+	if err := prepareVolumes(opts.Mounts, sandbox); err != nil {
+		return nil, err
+	}
 
-	childcmd := reexec.Command(ReExecRunCommand, sandbox, tmpFile)
+	imgConfig, err := image.GetImageConfig(img)
+	if err != nil {
+		return nil, err
+	}
 
+	runtimeConfig := buildProcessCmd(imgConfig, &opts)
+	if len(runtimeConfig.Cmd) == 0 {
+		return nil, errors.New("no command specified")
+	}
+	runtimeConfig.Mounts = opts.Mounts
+	runtimeConfig.ReadonlyRootfs = opts.ReadonlyRootfs
+	runtimeConfig.ShmSize = opts.ShmSize
+	runtimeConfig.CgroupWritable = opts.CgroupWritable
+
+	cntMeta := &ContainerMeta{
+		Name:        opts.Name,
+		Image:       imgname.Name(),
+		ContainerID: containerId,
+		Created:     time.Now(),
+		Command:     runtimeConfig.Cmd[0],
+		Ports:       "",
+		Sandbox:     sandbox,
+		Overlay:     sdx,
+		Mounts:      opts.Mounts,
+		ReadOnly:    opts.ReadonlyRootfs,
+		ShmSize:     opts.ShmSize,
+		Platform:    platform,
+
+		CgroupManager: mgr.Name(),
+		Memory:        opts.Memory,
+		OOMScoreAdj:   opts.OOMScoreAdj,
+		Labels:        opts.Labels,
+		AutoRemove:    opts.AutoRemove,
+
+		ContainerState: ContainerState{Status: StatusCreated},
+	}
+
+	if warning := image.PlatformWarning(platform); warning != "" {
+		logrus.Warnf("container %s: %s", opts.Name, warning)
+	}
+
+	if err := appendContainerMeta(cntMeta); err != nil {
+		return nil, err
+	}
+	recorded = true
+	unlockVolumes()
+
+	if err := writeJSONFile(runtimeConfigFile(containerId), runtimeConfig); err != nil {
+		autoRemoveContainer(cntMeta)
+		return nil, err
+	}
+
+	emitContainerEvent(cntMeta, "create", opts.OnEvent)
+	return cntMeta, nil
+}
+
+// StartContainer starts the command of a container which is not running,
+// the container is killed when ctx is done before it exits
+func StartContainer(ctx context.Context, idOrName string, opts StartOptions) (*RunningContainer, error) {
+	cntMeta, err := findContainer(idOrName)
+	if err != nil {
+		return nil, err
+	}
+	containerId := cntMeta.ContainerID
+
+	if isContainerRunning(containerId) {
+		return nil, fmt.Errorf("container %s is already running", idOrName)
+	}
+
+	mgr, err := getContainerCgroupManager(cntMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	// the runtime files are written again by every start
+	if err := os.MkdirAll(runtimeFilesPath(containerId), 0755); err != nil {
+		return nil, err
+	}
+
+	childcmd := reexec.Command(ReExecRunCommand, cntMeta.Sandbox, runtimeConfigFile(containerId), runtimeFilesPath(containerId))
+	childcmd.Env = append(os.Environ(), config.Env()...)
+
+	// CLONE_NEWCGROUP is not set here, the child unshares the cgroup namespace
+	// after it was moved into its own cgroup, see waitParentReady
 	childcmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 		Cloneflags: syscall.CLONE_NEWNS |
@@ -70,109 +343,399 @@ func ContainerRunCommand(cmd *cobra.Command, args []string) {
 			syscall.CLONE_NEWPID,
 	}
 
-	if cmd.Flag("tty") != nil && cmd.Flag("tty").Value.String() == "true" {
-		if cmd.Flag("interactive") != nil || cmd.Flag("interactive").Value.String() == "true" {
-			childcmd.Stdin = os.Stdin
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer syncWriter.Close()
+	defer syncReader.Close()
+	childcmd.ExtraFiles = []*os.File{syncReader}
+
+	var logger *containerLogger
+	childcmd.Stdin = opts.Stdin
+	if opts.Tty {
+		childcmd.Stdout = opts.Stdout
+		childcmd.Stderr = opts.Stderr
+		if opts.Stdin != nil {
 			childcmd.SysProcAttr.Foreground = true
 		}
+	} else {
+		if logger, err = openContainerLogger(containerId); err != nil {
+			return nil, err
+		}
+		childcmd.Stdout = logger.writer(StreamStdout, opts.Stdout)
+		childcmd.Stderr = logger.writer(StreamStderr, opts.Stderr)
+	}
+
+	cleanup := func() {
+		if err := RemoveContainerCgroup(mgr, containerId); err != nil {
+			logrus.Warnf("remove cgroup of container %s: %v", containerId, err)
+		}
+		if logger != nil {
+			logger.Close()
+		}
+	}
+	started := false
+	defer func() {
+		if !started {
+			cleanup()
+		}
+	}()
 
-		childcmd.Stdout = os.Stdout
-		childcmd.Stderr = os.Stderr
+	if cntMeta.Memory != 0 {
+		logrus.Infof("memory = %d", cntMeta.Memory)
+		if err := SetContainerCgroup(mgr, containerId, SetMaxMemory(cntMeta.Memory)); err != nil {
+			return nil, err
+		}
 	}
 
-	cntMeta := &ContainerMeta{
-		Name:        faker.Username(),
-		ProcessID:   0,
-		Image:       imgname.Name(),
-		ContainerID: containerId,
-		Created:     time.Now(),
-		Command:     config.Cmd[0],
-		Status:      "Exit",
-		Ports:       "",
-		Sandbox:     sandbox,
-		Overlay:     sdx,
+	if err := childcmd.Start(); err != nil {
+		return nil, fmt.Errorf("start container process: %w", err)
 	}
+	syncReader.Close()
 
-	if cmd.Flag("rm") != nil && cmd.Flag("rm").Value.String() == "true" {
-		//defer
+	// the child waits for the notification, it must not be left waiting when the setup fails
+	err = setupContainerProcess(mgr, containerId, childcmd.Process.Pid, cntMeta.OOMScoreAdj)
+	if err == nil {
+		err = notifyChildReady(syncWriter)
+	}
+	if err == nil {
+		err = updateContainerState(cntMeta, func(state *ContainerState) {
+			*state = ContainerState{
+				ProcessID: childcmd.Process.Pid,
+				Status:    StatusRunning,
+				StartedAt: time.Now(),
+			}
+		})
 	}
+	if err != nil {
+		syscall.Kill(-childcmd.Process.Pid, syscall.SIGKILL)
+		childcmd.Wait()
+		return nil, err
+	}
+	emitContainerEvent(cntMeta, "start", opts.OnEvent)
+	started = true
+
+	return &RunningContainer{
+		ID:           containerId,
+		Name:         cntMeta.Name,
+		ctx:          ctx,
+		opts:         opts,
+		meta:         cntMeta,
+		process:      childcmd,
+		logger:       logger,
+		stopOOMWatch: watchOOMEvents(mgr, cntMeta, opts.OnEvent),
+		cleanup:      cleanup,
+	}, nil
+}
 
-	appendContainerMeta(cntMeta)
+// Wait waits for the container to exit, the exit code of the container is in the result,
+// the error is only about the runtime
+func (rc *RunningContainer) Wait() (*RunResult, error) {
+	defer rc.cleanup()
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-rc.ctx.Done():
+			logrus.Infof("kill container %s: %v", rc.ID, rc.ctx.Err())
+			syscall.Kill(-rc.process.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
 
-	defer RemoveContainerCgroup(containerId)
+	if err := rc.process.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			rc.stopOOMWatch()
+			return nil, err
+		}
+	}
 
-	if cmd.Flag("memory") != nil && cmd.Flag("memory").Value.String() != "" {
-		size, err := humanize.ParseBytes(cmd.Flag("memory").Value.String())
-		logrus.Infof("memory = %d", size)
-		utils.Assert(err)
-		SetContainerCgroup(containerId, SetMaxMemory(size))
+	result := &RunResult{
+		ContainerID: rc.ID,
+		Name:        rc.Name,
+		ExitCode:    getExitCode(rc.process.ProcessState),
+		OOMKilled:   isKilledByOOM(rc.process.ProcessState, rc.stopOOMWatch()),
 	}
 
-	utils.Assert(childcmd.Start(), "start failed with error ")
+	if err := updateContainerState(rc.meta, func(state *ContainerState) {
+		state.Status = StatusExited
+		state.ExitCode = result.ExitCode
+		state.OOMKilled = result.OOMKilled
+		state.FinishedAt = time.Now()
+	}); err != nil {
+		logrus.Warnf("update state of container %s: %v", rc.ID, err)
+	}
+	emitContainerEvent(rc.meta, "die", rc.opts.OnEvent)
+
+	if rc.meta.AutoRemove {
+		autoRemoveContainer(rc.meta)
+	}
+
+	return result, nil
+}
+
+// buildContainerSandbox prepares the root filesystem of the container from the image of
+// the platform, or from rootfs when it is set, it returns the platform of the image as
+// os/arch[/variant]
+func buildContainerSandbox(ctx context.Context, imgname string, rootfs v1.Image, platform string, containerId string) (v1.Image, string, *Overlay, string, error) {
+	// garbage collection must not remove the image and its layers until the container uses them
+	unlock, err := image.LockRepository(false)
+	if err != nil {
+		return nil, "", nil, "", err
+	}
+	defer unlock()
 
-	SetContainerCgroup(containerId, SetProcessId(childcmd.Process.Pid))
+	img, imgPlatform := rootfs, (*v1.Platform)(nil)
+	if img == nil {
+		if img, imgPlatform, err = image.GetImage(ctx, imgname, platform, false); err != nil {
+			return nil, "", nil, "", err
+		}
+	} else if config, err := img.ConfigFile(); err == nil {
+		imgPlatform = config.Platform()
+	}
+	if imgPlatform != nil {
+		platform = imgPlatform.String()
+	}
 
-	cntMeta.ProcessID = childcmd.Process.Pid
-	cntMeta.Status = "RUNNING"
-	updateContainerMeta(cntMeta)
+	useOverlay, err := canUseOverlay()
+	if err != nil {
+		return nil, "", nil, "", err
+	}
 
-	if err := childcmd.Wait(); err != nil {
-		if !strings.Contains(err.Error(), "exit status") {
-			utils.Assert(err)
+	if useOverlay {
+		sdx, err := buildOverlaySandbox(img, containerId)
+		if err != nil {
+			return nil, "", nil, "", err
 		}
+		return img, platform, sdx, sdx.MountPoint, nil
+	}
+
+	sandbox, err := image.BuildSandbox(img, containerId)
+	if err != nil {
+		return nil, "", nil, "", err
 	}
+	return img, platform, nil, sandbox, nil
 }
 
-func Run(sandbox, cmdpath string) error {
+func removeContainerSandbox(containerId string, sdx *Overlay, sandbox string) {
+	if sdx != nil {
+		if err := unmountOverlayFileSystem(sdx); err != nil {
+			logrus.Warnf("unmount sandbox of container %s: %v", containerId, err)
+		}
+		if _, err := image.ReleaseLayers(containerId); err != nil {
+			logrus.Warnf("release layers of container %s: %v", containerId, err)
+		}
+	}
+	os.RemoveAll(sandbox)
+}
+
+// setupContainerProcess moves the container process into its cgroup before it runs the command
+func setupContainerProcess(mgr CgroupManager, containerId string, pid int, oomScoreAdj *int) error {
+	if err := SetContainerCgroup(mgr, containerId, SetProcessId(pid)); err != nil {
+		return err
+	}
+
+	if oomScoreAdj != nil {
+		if err := setOOMScoreAdj(pid, *oomScoreAdj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getExitCode returns the exit code of the process, 128+signal when it was killed by a signal
+func getExitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+func Run(sandbox, cmdpath, filesDir string) error {
+	// unshare, chroot and setuid apply to the calling thread, it stays locked until the
+	// exec, so they all happen on the same thread which execs the command
+	runtime.LockOSThread()
+
 	cnt, err := os.ReadFile(cmdpath)
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
 	logrus.Infof("mypid=%d", syscall.Getpid())
 
 	logrus.Infof("Config=%s", string(cnt))
 
-	var config v1.Config
-	json.Unmarshal(cnt, &config)
-	utils.Assert(err)
+	var config RuntimeConfig
+	if err := json.Unmarshal(cnt, &config); err != nil {
+		return err
+	}
 
-	utils.Assert(buildNetworkEnv(sandbox))
+	if err := waitParentReady(); err != nil {
+		return err
+	}
 
-	utils.Assert(buildFileSystem(sandbox))
+	if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("unshare cgroup namespace: %w", err)
+	}
 
-	if config.User != "" {
-		utils.Assert(buildUser(config.User))
+	if err := buildNetworkEnv(filesDir); err != nil {
+		return fmt.Errorf("build network: %w", err)
+	}
+
+	if err := buildFileSystem(sandbox, filesDir, &config); err != nil {
+		return fmt.Errorf("build filesystem: %w", err)
 	}
 
 	if config.WorkingDir == "" {
 		config.WorkingDir = "/"
 	}
 
-	utils.Assert(syscall.Chdir(config.WorkingDir))
+	// like runc, a working directory which is not in the image is created, as root
+	if err := os.MkdirAll(config.WorkingDir, 0755); err != nil {
+		return fmt.Errorf("create working directory %s: %w", config.WorkingDir, err)
+	}
+
+	if config.User != "" {
+		if err := buildUser(config.User); err != nil {
+			return fmt.Errorf("set user %s: %w", config.User, err)
+		}
+	}
+
+	if err := syscall.Chdir(config.WorkingDir); err != nil {
+		return fmt.Errorf("chdir to %s: %w", config.WorkingDir, err)
+	}
 
 	logrus.Infof("++++++++++++++++++++++++++++++++++++++++++++++")
 	logrus.Infof("WorkingDir(%s),Command(%s)", config.WorkingDir, strings.Join(config.Cmd, " "))
 
-	return syscall.Exec(config.Cmd[0], config.Cmd, config.Env)
+	path, err := lookupCommand(config.Cmd[0], config.Env)
+	if err != nil {
+		return err
+	}
+
+	return execError(config.Cmd[0], syscall.Exec(path, config.Cmd, config.Env))
 }
 
-func buildOverlaySandbox(img v1.Image, containerId string) *Overlay {
-	layers := image.FlatImageFiles(img)
-	upper := filepath.Join(upperPath, containerId)
-	utils.Assert(os.MkdirAll(upper, 0755))
-	workpath := filepath.Join(WorkingPath, containerId)
-	utils.Assert(os.MkdirAll(workpath, 0755))
-	sandbox := filepath.Join(image.SandboxPath, containerId)
-	utils.Assert(os.MkdirAll(sandbox, 0755))
-	utils.Assert(syscall.Mount("overlay", sandbox, "overlay", 0,
-		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(layers, ":"), upper, workpath)))
-	return &Overlay{
-		Working:    workpath,
-		Upper:      upper,
-		MountPoint: sandbox,
+// lookupCommand searches the command in the PATH of the container, like a shell does
+func lookupCommand(command string, env []string) (string, error) {
+	if strings.Contains(command, "/") {
+		return command, nil
+	}
+
+	for _, e := range env {
+		if value, ok := strings.CutPrefix(e, "PATH="); ok {
+			os.Setenv("PATH", value)
+		}
+	}
+
+	path, err := exec.LookPath(command)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", utils.WithExitCode(utils.ExitCodeNotFound, fmt.Errorf("%s: executable file not found in $PATH", command))
+		}
+		return "", execError(command, err)
+	}
+	return path, nil
+}
+
+// execError maps the failure of exec to the exit codes of a shell
+func execError(command string, err error) error {
+	if errors.Is(err, syscall.ENOENT) {
+		return utils.WithExitCode(utils.ExitCodeNotFound, fmt.Errorf("exec %s: %w", command, err))
+	}
+	return utils.WithExitCode(utils.ExitCodeCannotInvoke, fmt.Errorf("exec %s: %w", command, err))
+}
+
+func upperPath() string {
+	return config.RootPath("overlay", "upper")
+}
+
+// emptyLowerPath is the lowerdir of the image without layers, overlay needs one
+func emptyLowerPath() string {
+	return config.RootPath("overlay", "empty")
+}
+
+func WorkingPath() string {
+	return config.RootPath("overlay", "working")
+}
+
+func buildOverlaySandbox(img v1.Image, containerId string) (*Overlay, error) {
+	layers, err := image.ExtractImageLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs, err := image.GetImageDiffIDs(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := image.RetainLayers(containerId, diffIDs); err != nil {
+		return nil, err
+	}
+
+	overlay := &Overlay{
+		Lower:      layers,
+		Working:    filepath.Join(WorkingPath(), containerId),
+		Upper:      filepath.Join(upperPath(), containerId),
+		MountPoint: filepath.Join(image.SandboxPath(), containerId),
+	}
+
+	// the lowerdirs are the short links relative to the overlay directory, from the top-most layer
+	lowers := []string{}
+	for _, diffID := range diffIDs {
+		lowers = append([]string{image.GetLayerLink(diffID)}, lowers...)
+	}
+	if len(lowers) == 0 {
+		lowers = []string{filepath.Base(emptyLowerPath())}
+	}
+
+	err = func() error {
+		for _, dir := range []string{overlay.Upper, overlay.Working, overlay.MountPoint, emptyLowerPath()} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+
+		if err := mountInDir(filepath.Dir(emptyLowerPath()), "overlay", overlay.MountPoint, "overlay", 0,
+			fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), overlay.Upper, overlay.Working)); err != nil {
+			return fmt.Errorf("mount overlay: %w", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		removeContainerSandbox(containerId, overlay, overlay.MountPoint)
+		return nil, err
 	}
+
+	return overlay, nil
+}
+
+// mountInDir mounts with the working directory dir, so the relative paths of data are
+// resolved from it. It runs on its own thread which does not share the working directory
+// of the process, the thread is not unlocked and exits with the goroutine.
+func mountInDir(dir, source, target, fstype string, flags uintptr, data string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+			errCh <- fmt.Errorf("unshare fs: %w", err)
+			return
+		}
+		if err := syscall.Chdir(dir); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- syscall.Mount(source, target, fstype, flags, data)
+	}()
+	return <-errCh
 }
 
-func buildNetworkEnv(sandbox string) error {
+// buildNetworkEnv writes the runtime files into filesDir, they are bind mounted into the rootfs
+func buildNetworkEnv(filesDir string) error {
 	hostname := shortuuid.New()
 	if err := syscall.Sethostname([]byte(hostname)); err != nil {
 		return err
@@ -187,7 +750,7 @@ func buildNetworkEnv(sandbox string) error {
 		"ff02::2 ip6-allrouters",
 		"172.17.0.2 " + hostname,
 	}
-	if err := os.WriteFile(filepath.Join(sandbox, "/etc/hosts"), []byte(strings.Join(hosts, "\n")), 644); err != nil {
+	if err := os.WriteFile(filepath.Join(filesDir, "hosts"), []byte(strings.Join(hosts, "\n")), 0644); err != nil {
 		return err
 	}
 
@@ -196,7 +759,7 @@ func buildNetworkEnv(sandbox string) error {
 		return err
 	}
 
-	if err := os.WriteFile(filepath.Join(sandbox, "/etc/resolv.conf"), content, 644); err != nil {
+	if err := os.WriteFile(filepath.Join(filesDir, "resolv.conf"), content, 0644); err != nil {
 		return err
 	}
 
@@ -205,11 +768,19 @@ func buildNetworkEnv(sandbox string) error {
 	return nil
 }
 
-func buildFileSystem(sandbox string) error {
+func buildFileSystem(sandbox string, filesDir string, config *RuntimeConfig) error {
 	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE, ""); err != nil {
 		return err
 	}
 
+	if config.ReadonlyRootfs {
+		// the rootfs must be a mount point of its own to be remounted read-only,
+		// and the bind mount only belongs to this mount namespace
+		if err := syscall.Mount(sandbox, sandbox, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+
 	if err := syscall.Mount("proc", filepath.Join(sandbox, "/proc"), "proc", 0, ""); err != nil {
 		return err
 	}
@@ -222,6 +793,30 @@ func buildFileSystem(sandbox string) error {
 		return err
 	}
 
+	if err := buildCgroupFileSystem(sandbox, config.CgroupWritable); err != nil {
+		return err
+	}
+
+	if err := buildShm(sandbox, config.ShmSize); err != nil {
+		return err
+	}
+
+	// before the mounts of the container, so they can replace the runtime files
+	if err := buildRuntimeFiles(sandbox, filesDir); err != nil {
+		return err
+	}
+
+	if err := buildMounts(sandbox, config.Mounts); err != nil {
+		return err
+	}
+
+	if config.ReadonlyRootfs {
+		// not recursive, so /proc, /dev and the mounts above stay writable
+		if err := syscall.Mount("", sandbox, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return err
+		}
+	}
+
 	if err := syscall.Chroot(sandbox); err != nil {
 		return err
 	}
@@ -229,49 +824,130 @@ func buildFileSystem(sandbox string) error {
 	return nil
 }
 
-func buildUser(uname string) error {
+// buildUser switches to the user, a name or uid with an optional group, user[:group].
+// The groups are changed before the uid, the process can not change them once it is not root.
+func buildUser(spec string) error {
+	uname, gname, hasGroup := strings.Cut(spec, ":")
+
+	uid, gid, groups, err := lookupUser(uname)
+	if err != nil {
+		return err
+	}
+	if hasGroup {
+		if gid, err = lookupGroup(gname); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	return nil
+}
+
+// lookupUser returns the uid, gid and supplementary groups of the user in the passwd of the
+// container, a uid which is not there runs with gid 0, like docker
+func lookupUser(uname string) (int, int, []int, error) {
 	u, err := user.Lookup(uname)
-	if err == nil {
-		setId := func(setter func(int) error, sid string) error {
-			uid, err := strconv.Atoi(sid)
-			if err != nil {
-				return err
-			}
-			return setter(uid)
+	if err != nil {
+		uid, convErr := strconv.Atoi(uname)
+		if convErr != nil {
+			return 0, 0, nil, fmt.Errorf("unable to find user %s: %w", uname, err)
 		}
-		if u.Uid != "" {
-			setId(syscall.Setuid, u.Uid)
+		if u, err = user.LookupId(uname); err != nil {
+			return uid, 0, []int{}, nil
 		}
-		if u.Gid != "" {
-			setId(syscall.Setgid, u.Gid)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	groups := []int{}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil && g != gid {
+				groups = append(groups, g)
+			}
 		}
 	}
+	return uid, gid, groups, nil
+}
 
-	return nil
+func lookupGroup(gname string) (int, error) {
+	if gid, err := strconv.Atoi(gname); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(gname)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find group %s: %w", gname, err)
+	}
+	return strconv.Atoi(g.Gid)
 }
 
-func buildProcessCmd(config *v1.Config, cmds []string) []byte {
-	args := []string{}
-	if len(cmds) != 0 {
-		args = cmds
-	} else {
-		if len(config.Entrypoint) != 0 {
-			args = append(args, config.Entrypoint...)
-		}
+// buildProcessCmd merges the run options into the config of the image, the command
+// is the entrypoint followed by the cmd, like docker does
+func buildProcessCmd(config *v1.Config, opts *RunOptions) *RuntimeConfig {
+	entrypoint, cmd := config.Entrypoint, config.Cmd
+	if opts.Entrypoint != nil {
+		// the cmd of the image are the arguments of its own entrypoint
+		entrypoint, cmd = opts.Entrypoint, nil
 	}
+	if len(opts.Cmd) != 0 {
+		cmd = opts.Cmd
+	}
+	config.Cmd = append(append([]string{}, entrypoint...), cmd...)
 
-	config.Cmd = args
+	config.Env = mergeEnv(config.Env, opts.Env)
+	if opts.WorkingDir != "" {
+		config.WorkingDir = opts.WorkingDir
+	}
+	if opts.User != "" {
+		config.User = opts.User
+	}
+
+	return &RuntimeConfig{Config: *config}
+}
 
-	r, _ := json.Marshal(config)
-	return r
+// mergeEnv returns env with the variables of override added or replaced
+func mergeEnv(env []string, override []string) []string {
+	result := append([]string{}, env...)
+	for _, e := range override {
+		key, _, _ := strings.Cut(e, "=")
+		replaced := false
+		for i := range result {
+			if k, _, _ := strings.Cut(result[i], "="); k == key {
+				result[i] = e
+				replaced = true
+			}
+		}
+		if !replaced {
+			result = append(result, e)
+		}
+	}
+	return result
 }
 
-func canUseOverlay() bool {
+func canUseOverlay() (bool, error) {
 	partitions, err := disk.Partitions(true)
-	utils.Assert(err)
+	if err != nil {
+		return false, err
+	}
 	var matched *disk.PartitionStat
 	for _, partition := range partitions {
-		if strings.HasPrefix(image.SandboxPath, partition.Mountpoint) {
+		if strings.HasPrefix(image.SandboxPath(), partition.Mountpoint) {
 			if matched == nil || (len(matched.Mountpoint) < len(partition.Mountpoint)) {
 				matched = &partition
 			}
@@ -279,11 +955,13 @@ func canUseOverlay() bool {
 	}
 
 	if matched != nil && matched.Fstype == "overlay" {
-		return false
+		return false, nil
 	}
 
 	file, err := os.Open("/proc/self/status")
-	utils.Assert(err)
+	if err != nil {
+		return false, err
+	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
@@ -291,10 +969,12 @@ func canUseOverlay() bool {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "CapEff:\t") {
 			cap, err := strconv.ParseUint(line[len("CapEff:\t"):], 16, 64)
-			utils.Assert(err)
-			return (cap & CAP_SYS_ADMIN) == CAP_SYS_ADMIN
+			if err != nil {
+				return false, err
+			}
+			return (cap & CAP_SYS_ADMIN) == CAP_SYS_ADMIN, nil
 		}
 	}
 
-	return true
+	return true, nil
 }
@@ -1,6 +1,9 @@
 package container
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"syscall"
 	"time"
@@ -10,26 +13,62 @@ import (
 	"aproton.tech/container/utils"
 )
 
-func ContainerStopCommand(cmd *cobra.Command, args []string) {
+func ContainerStopCommand(cmd *cobra.Command, args []string) error {
 	cmap, err := getContainerMetasMap()
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
+	errs := make([]error, len(args))
 	wg := &sync.WaitGroup{}
-	for _, c := range args {
-		if cnt, ok := cmap[c]; ok {
-			if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
-				wg.Add(1)
-				go func(cnt *ContainerMeta) {
-					defer wg.Done()
-					stopContainer(cnt)
-				}(cnt)
-			}
+	for i, c := range args {
+		cnt, ok := cmap[c]
+		if !ok {
+			errs[i] = fmt.Errorf("%w: %s", ErrContainerNotFound, c)
+			continue
+		}
+
+		if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+			wg.Add(1)
+			go func(i int, cnt *ContainerMeta) {
+				defer wg.Done()
+				if err := stopContainer(cmd.Context(), cnt, DefaultStopTimeout); err != nil {
+					errs[i] = fmt.Errorf("stop container %s: %w", args[i], err)
+				}
+			}(i, cnt)
 		}
 	}
 	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// StopContainer sends SIGTERM to the container and kills it when it is still running after timeout,
+// or when ctx is done. A container which is not running is left as it is.
+func StopContainer(ctx context.Context, idOrName string, timeout time.Duration) error {
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return err
+	}
+
+	if !utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+		return nil
+	}
+	return stopContainer(ctx, cnt, timeout)
 }
 
-func stopContainer(cnt *ContainerMeta) error {
+func stopContainer(ctx context.Context, cnt *ContainerMeta, timeout time.Duration) error {
+	// a frozen process can not handle SIGTERM, so thaw it first
+	mgr, err := getContainerCgroupManager(cnt)
+	if err != nil {
+		return err
+	}
+	if cnt.Status == StatusPaused || mgr.IsFrozen(cnt.ContainerID) {
+		if err := unpauseContainer(cnt); err != nil {
+			return err
+		}
+	}
+
 	ch := make(chan struct{})
 	go func() {
 		defer close(ch)
@@ -37,12 +76,23 @@ func stopContainer(cnt *ContainerMeta) error {
 			time.Sleep(500 * time.Millisecond)
 		}
 	}()
-	syscall.Kill(cnt.ProcessID, syscall.SIGTERM)
+	if err := syscall.Kill(cnt.ProcessID, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
-	case <-time.After(5 * time.Second):
-		syscall.Kill(-cnt.ProcessID, syscall.SIGKILL)
+	case <-timer.C:
+		if err := syscall.Kill(-cnt.ProcessID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	case <-ctx.Done():
+		if err := syscall.Kill(-cnt.ProcessID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
 	case <-ch:
 	}
 
+	emitContainerEvent(cnt, "stop", nil)
 	return nil
 }
@@ -0,0 +1,420 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+// Every container is stored in its own directory ContainersPath/<id>: config.json and
+// runtime.json are written once when the container is created, state.json is rewritten
+// when the process changes, and container.log collects the output of the process.
+// Writers hold the flock of the lock file, and replace the files by rename, so readers
+// never see a partial write. The name of every container is reserved by a file in
+// ContainersPath/.names, which is created under the lock of the store.
+const (
+	containerConfigFile  = "config.json"
+	containerStateFile   = "state.json"
+	containerLockFile    = "lock"
+	containerRuntimeFile = "runtime.json"
+	containerLogFile     = "container.log"
+	containerNamesDir    = ".names"
+	storeLockFile        = ".lock"
+)
+
+// containerNamePattern is the name of a container, like docker
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+func ContainersPath() string {
+	return config.RootPath("containers")
+}
+
+// legacyContainerMetaFile is the single file which kept all containers before, the old
+// layout was relative to the working directory
+const legacyContainerMetaFile = "var/container.json"
+
+func getContainerPath(containerId string, elem ...string) string {
+	return filepath.Join(append([]string{ContainersPath(), containerId}, elem...)...)
+}
+
+func openContainerStore() error {
+	if err := os.MkdirAll(ContainersPath(), 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(legacyContainerMetaFile); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return migrateContainerMetas()
+}
+
+// migrateContainerMetas moves the containers of the legacy file into the store
+func migrateContainerMetas() error {
+	unlock, err := utils.LockFile(filepath.Join(ContainersPath(), storeLockFile), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// another process may have migrated it while waiting for the lock
+	content, err := os.ReadFile(legacyContainerMetaFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var containers []*ContainerMeta
+	if err := json.Unmarshal(content, &containers); err != nil {
+		return fmt.Errorf("migrate %s: %w", legacyContainerMetaFile, err)
+	}
+
+	// the paths were relative to the working directory, which contains "var"
+	base, err := filepath.Abs(filepath.Dir(filepath.Dir(legacyContainerMetaFile)))
+	if err != nil {
+		return err
+	}
+	for _, cnt := range containers {
+		if _, err := os.Stat(getContainerPath(cnt.ContainerID)); err == nil {
+			continue
+		}
+
+		// the legacy file wrote the running status in upper case
+		if cnt.Status == "RUNNING" {
+			cnt.Status = StatusRunning
+		}
+
+		cnt.Sandbox = absContainerPath(base, cnt.Sandbox)
+		if cnt.Overlay != nil {
+			for i := range cnt.Overlay.Lower {
+				cnt.Overlay.Lower[i] = absContainerPath(base, cnt.Overlay.Lower[i])
+			}
+			cnt.Overlay.Working = absContainerPath(base, cnt.Overlay.Working)
+			cnt.Overlay.Upper = absContainerPath(base, cnt.Overlay.Upper)
+			cnt.Overlay.MountPoint = absContainerPath(base, cnt.Overlay.MountPoint)
+		}
+
+		if err := writeContainerMeta(cnt); err != nil {
+			return fmt.Errorf("migrate container %s: %w", cnt.ContainerID, err)
+		}
+		logrus.Infof("migrate container %s", cnt.ContainerID)
+	}
+
+	return os.Rename(legacyContainerMetaFile, legacyContainerMetaFile+".migrated")
+}
+
+func absContainerPath(base string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+// writeContainerMeta creates the directory of a new container, it is prepared under
+// a temporary name and renamed, a container is either complete or not there
+func writeContainerMeta(cnt *ContainerMeta) error {
+	tmp, err := os.MkdirTemp(ContainersPath(), ".tmp-"+cnt.ContainerID+"-")
+	if err != nil {
+		return err
+	}
+
+	static := *cnt
+	static.ContainerState = ContainerState{}
+	if err := writeJSONFile(filepath.Join(tmp, containerConfigFile), &static); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := writeJSONFile(filepath.Join(tmp, containerStateFile), &cnt.ContainerState); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, getContainerPath(cnt.ContainerID)); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("create container %s: %w", cnt.ContainerID, err)
+	}
+
+	return nil
+}
+
+func writeJSONFile(name string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(name, content, 0644)
+}
+
+func readJSONFile(name string, v interface{}) error {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func lockContainer(containerId string, exclusive bool) (func(), error) {
+	unlock, err := utils.LockFile(getContainerPath(containerId, containerLockFile), exclusive)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerId)
+		}
+		return nil, err
+	}
+	return unlock, nil
+}
+
+func getContainerMeta(containerId string) (*ContainerMeta, error) {
+	unlock, err := lockContainer(containerId, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cnt := &ContainerMeta{}
+	if err := readJSONFile(getContainerPath(containerId, containerConfigFile), cnt); err != nil {
+		return nil, err
+	}
+
+	if err := readJSONFile(getContainerPath(containerId, containerStateFile), &cnt.ContainerState); err != nil {
+		return nil, err
+	}
+
+	return cnt, nil
+}
+
+func getContainerMetas() ([]*ContainerMeta, error) {
+	if err := openContainerStore(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(ContainersPath())
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*ContainerMeta{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		cnt, err := getContainerMeta(entry.Name())
+		if err != nil {
+			// removed after the directory was read
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrContainerNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		containers = append(containers, cnt)
+	}
+
+	sort.SliceStable(containers, func(i, j int) bool {
+		return containers[i].Created.Before(containers[j].Created)
+	})
+
+	return containers, nil
+}
+
+func getContainerMetasMap() (map[string]*ContainerMeta, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, err
+	}
+
+	cmap := map[string]*ContainerMeta{}
+	for idx, cnt := range containers {
+		cmap[cnt.ContainerID] = containers[idx]
+		cmap[cnt.Name] = containers[idx]
+	}
+
+	return cmap, nil
+}
+
+// findContainer returns the container with the id or name
+func findContainer(idOrName string) (*ContainerMeta, error) {
+	cmap, err := getContainerMetasMap()
+	if err != nil {
+		return nil, err
+	}
+
+	cnt, ok := cmap[idOrName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, idOrName)
+	}
+	return cnt, nil
+}
+
+func getContainerNamePath(name string) string {
+	return filepath.Join(ContainersPath(), containerNamesDir, name)
+}
+
+// reserveContainerName reserves the name for the container, the check and the reservation
+// are made under the lock of the store, so two containers never get the same name. The
+// returned function ends the creation, the name is released when the container was not
+// recorded. The reservation of a creation which was interrupted is taken over.
+func reserveContainerName(name string, containerId string) (func(recorded bool), error) {
+	if !containerNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	if err := openContainerStore(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(ContainersPath(), containerNamesDir), 0755); err != nil {
+		return nil, err
+	}
+
+	unlockStore, err := utils.LockFile(filepath.Join(ContainersPath(), storeLockFile), true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockStore()
+
+	// the containers created before names were reserved only have their name in the config
+	if cnt, err := findContainer(name); err == nil {
+		if cnt.ContainerID != containerId {
+			return nil, fmt.Errorf("%w: %s", ErrContainerNameInUse, name)
+		}
+	} else if !errors.Is(err, ErrContainerNotFound) {
+		return nil, err
+	}
+
+	path := getContainerNamePath(name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err == nil {
+		f.Close()
+	} else if !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+
+	// the creating process holds the lock of the reservation until the container is recorded
+	unlock, err := utils.TryLockFile(path, true)
+	if err != nil {
+		if errors.Is(err, utils.ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrContainerNameInUse, name)
+		}
+		return nil, err
+	}
+
+	owner, err := os.ReadFile(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if len(owner) > 0 && string(owner) != containerId {
+		if _, err := os.Stat(getContainerPath(string(owner))); err == nil {
+			unlock()
+			return nil, fmt.Errorf("%w: %s", ErrContainerNameInUse, name)
+		}
+		logrus.Infof("take over the name %s of interrupted container %s", name, owner)
+	}
+
+	if err := os.WriteFile(path, []byte(containerId), 0644); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return func(recorded bool) {
+		if !recorded {
+			releaseContainerName(name, containerId)
+		}
+		unlock()
+	}, nil
+}
+
+// releaseContainerName removes the reservation of the name when it belongs to the container
+func releaseContainerName(name string, containerId string) {
+	if !containerNamePattern.MatchString(name) {
+		return
+	}
+
+	unlock, err := utils.LockFile(filepath.Join(ContainersPath(), storeLockFile), true)
+	if err != nil {
+		logrus.Warnf("release container name %s: %v", name, err)
+		return
+	}
+	defer unlock()
+
+	path := getContainerNamePath(name)
+	if owner, err := os.ReadFile(path); err == nil && string(owner) == containerId {
+		if err := os.Remove(path); err != nil {
+			logrus.Warnf("release container name %s: %v", name, err)
+		}
+	}
+}
+
+func appendContainerMeta(cnt *ContainerMeta) error {
+	if err := openContainerStore(); err != nil {
+		return err
+	}
+
+	return writeContainerMeta(cnt)
+}
+
+// updateContainerState changes the state of the container under its lock, the state is
+// read again after locking, the changes made by other processes in between are kept
+func updateContainerState(cnt *ContainerMeta, update func(state *ContainerState)) error {
+	unlock, err := lockContainer(cnt.ContainerID, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := &ContainerState{}
+	if err := readJSONFile(getContainerPath(cnt.ContainerID, containerStateFile), state); err != nil {
+		return err
+	}
+
+	update(state)
+	if err := writeJSONFile(getContainerPath(cnt.ContainerID, containerStateFile), state); err != nil {
+		return err
+	}
+
+	cnt.ContainerState = *state
+	return nil
+}
+
+func removeContainerMeta(cnt *ContainerMeta) error {
+	unlock, err := lockContainer(cnt.ContainerID, true)
+	if err != nil {
+		return err
+	}
+
+	// renamed first, the container disappears at once even if the removal is interrupted
+	removing := filepath.Join(ContainersPath(), ".removing-"+cnt.ContainerID)
+	err = os.Rename(getContainerPath(cnt.ContainerID), removing)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	releaseContainerName(cnt.Name, cnt.ContainerID)
+
+	return os.RemoveAll(removing)
+}
@@ -0,0 +1,178 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/shirou/gopsutil/process"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/utils"
+)
+
+func ContainerTopCommand(cmd *cobra.Command, args []string) error {
+	cmap, err := getContainerMetasMap()
+	if err != nil {
+		return err
+	}
+
+	cnt, ok := cmap[args[0]]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, args[0])
+	}
+
+	if !utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+		return fmt.Errorf("container %s is not running", args[0])
+	}
+
+	mgr, err := getContainerCgroupManager(cnt)
+	if err != nil {
+		return err
+	}
+
+	pids, err := mgr.Pids(cnt.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	// ps options are handled by the ps of host, the image does not need one
+	if len(args) > 1 {
+		return printHostPs(pids, args[1:])
+	}
+
+	table := newContainerTopTableRender()
+	for _, pid := range pids {
+		if row, err := newContainerTopRow(pid); err == nil {
+			table.Append(row)
+		}
+	}
+	table.Render()
+	return nil
+}
+
+func newContainerTopTableRender() *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"USER", "PID", "CONTAINER PID", "%CPU", "RSS", "TIME", "COMMAND"})
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetBorder(false)
+	table.SetHeaderLine(false)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+
+	return table
+}
+
+func newContainerTopRow(pid int) ([]string, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+
+	username, err := p.Username()
+	if err != nil {
+		// the uid of the container may not exist on host
+		uids, err := p.Uids()
+		if err != nil || len(uids) == 0 {
+			return nil, err
+		}
+		username = strconv.Itoa(int(uids[0]))
+	}
+
+	nspid, err := getNamespacePid(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	cpu, _ := p.CPUPercent()
+
+	rss := "-"
+	if mem, err := p.MemoryInfo(); err == nil {
+		rss = humanize.IBytes(mem.RSS)
+	}
+
+	cputime := "-"
+	if times, err := p.Times(); err == nil {
+		cputime = (time.Duration(times.User+times.System) * time.Second).String()
+	}
+
+	cmdline, err := p.Cmdline()
+	if err != nil || cmdline == "" {
+		// kernel threads and zombies have no command line
+		name, _ := p.Name()
+		cmdline = "[" + name + "]"
+	}
+
+	return []string{
+		username,
+		strconv.Itoa(pid),
+		strconv.Itoa(nspid),
+		fmt.Sprintf("%.1f", cpu),
+		rss,
+		cputime,
+		cmdline,
+	}, nil
+}
+
+// getNamespacePid returns the pid in the innermost pid namespace, which is the last field of NSpid
+func getNamespacePid(pid int) (int, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "NSpid:" {
+			return strconv.Atoi(fields[len(fields)-1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// NSpid is reported since linux 4.1
+	return pid, nil
+}
+
+// printHostPs runs ps of host with the options, and only prints the lines of the container processes
+func printHostPs(pids []int, options []string) error {
+	output, err := exec.Command("ps", options...).Output()
+	if err != nil {
+		return fmt.Errorf("ps %s: %w", strings.Join(options, " "), err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	pidIndex := slices.Index(strings.Fields(lines[0]), "PID")
+	if pidIndex < 0 {
+		return fmt.Errorf("couldn't find PID field in ps output")
+	}
+
+	utils.PrintToConsole("%s\n", lines[0])
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) <= pidIndex {
+			continue
+		}
+
+		if pid, err := strconv.Atoi(fields[pidIndex]); err == nil && slices.Contains(pids, pid) {
+			utils.PrintToConsole("%s\n", line)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package container
+
+import (
+	"time"
+
+	"aproton.tech/container/utils"
+)
+
+// ContainerUsage is the disk space of the writable layer of a container
+type ContainerUsage struct {
+	ContainerID string    `json:"containerId"`
+	Image       string    `json:"image"`
+	Command     string    `json:"command"`
+	Created     time.Time `json:"created"`
+	Status      string    `json:"status"`
+	Running     bool      `json:"running"`
+	Size        uint64    `json:"size"`
+}
+
+// VolumeUsage is the disk space of a volume, Links is the number of containers using it
+type VolumeUsage struct {
+	Name  string `json:"name"`
+	Links int    `json:"links"`
+	Size  uint64 `json:"size"`
+}
+
+func GetContainersUsage() ([]*ContainerUsage, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, err
+	}
+
+	usages := []*ContainerUsage{}
+	for _, cnt := range containers {
+		size, err := getContainerSize(cnt)
+		if err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, &ContainerUsage{
+			ContainerID: cnt.ContainerID,
+			Image:       cnt.Image,
+			Command:     cnt.Command,
+			Created:     cnt.Created,
+			Status:      getContainerStatus(cnt),
+			Running:     utils.IsProcessExists(cnt.ProcessID, cnt.Command),
+			Size:        size,
+		})
+	}
+
+	return usages, nil
+}
+
+func GetVolumesUsage() ([]*VolumeUsage, error) {
+	volumes, err := getVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	usages := []*VolumeUsage{}
+	for _, vol := range volumes {
+		users, err := getVolumeUsers(vol.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := utils.DiskUsage(getVolumeDataPath(vol.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, &VolumeUsage{Name: vol.Name, Links: len(users), Size: size})
+	}
+
+	return usages, nil
+}
+
+// getContainerSize returns the size of the overlay upper dir, or of the whole
+// sandbox when the image was extracted without overlay
+func getContainerSize(cnt *ContainerMeta) (uint64, error) {
+	path := cnt.Sandbox
+	if cnt.Overlay != nil {
+		path = cnt.Overlay.Upper
+	}
+	if path == "" {
+		return 0, nil
+	}
+
+	return utils.DiskUsage(path)
+}
@@ -0,0 +1,422 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/dustin/go-humanize"
+	"github.com/lithammer/shortuuid"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+const VolumeDriverLocal = "local"
+
+const volumesLockFile = ".lock"
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	Created    time.Time         `json:"created"`
+	Labels     map[string]string `json:"labels"`
+	Anonymous  bool              `json:"anonymous"`
+}
+
+func VolumeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "volume",
+		Aliases: []string{"volumes"},
+		Short:   "volume commands",
+	}
+
+	create := &cobra.Command{
+		Use:   "create [VOLUME]",
+		Short: "create a volume",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  VolumeCreateCommand,
+	}
+	create.Flags().StringArrayP("label", "l", []string{}, "Set metadata for a volume")
+
+	cmd.AddCommand(create)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "list volumes",
+		Args:    cobra.NoArgs,
+		RunE:    VolumeListCommand,
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "inspect VOLUME [VOLUME...]",
+		Short: "display detailed information on volumes",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  VolumeInspectCommand,
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "remove VOLUME [VOLUME...]",
+		Aliases: []string{"rm"},
+		Short:   "remove volumes",
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    VolumeRemoveCommand,
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "prune",
+		Short: "remove all volumes not used by any container",
+		Args:  cobra.NoArgs,
+		RunE:  VolumePruneCommand,
+	})
+
+	return cmd
+}
+
+func VolumeCreateCommand(cmd *cobra.Command, args []string) error {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	labels := map[string]string{}
+	values, err := cmd.Flags().GetStringArray("label")
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		key, value, _ := strings.Cut(v, "=")
+		labels[key] = value
+	}
+
+	vol, err := createVolume(name, labels)
+	if err != nil {
+		return err
+	}
+
+	utils.PrintToConsole("%s\n", vol.Name)
+	return nil
+}
+
+func VolumeListCommand(cmd *cobra.Command, args []string) error {
+	volumes, err := getVolumes()
+	if err != nil {
+		return err
+	}
+
+	table := newVolumeListTableRender()
+	for _, vol := range volumes {
+		table.Append([]string{vol.Driver, vol.Name})
+	}
+	table.Render()
+	return nil
+}
+
+func VolumeInspectCommand(cmd *cobra.Command, args []string) error {
+	errs := []error{}
+	found := []*Volume{}
+	for _, name := range args {
+		vol, err := getVolume(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("no such volume: %s", name))
+			continue
+		}
+		found = append(found, vol)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(found); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+func VolumeRemoveCommand(cmd *cobra.Command, args []string) error {
+	unlock, err := lockVolumes(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	errs := []error{}
+	for _, name := range args {
+		if _, err := getVolume(name); err != nil {
+			errs = append(errs, fmt.Errorf("no such volume: %s", name))
+			continue
+		}
+
+		users, err := getVolumeUsers(name)
+		if err != nil {
+			return err
+		}
+		if len(users) != 0 {
+			errs = append(errs, fmt.Errorf("volume %s is in use by container %s", name, strings.Join(users, ", ")))
+			continue
+		}
+
+		if err := removeVolume(name); err != nil {
+			errs = append(errs, fmt.Errorf("remove volume %s: %w", name, err))
+			continue
+		}
+		utils.PrintToConsole("%s\n", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+func VolumePruneCommand(cmd *cobra.Command, args []string) error {
+	removed, reclaimed, err := PruneVolumes(false)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		utils.PrintToConsole("Deleted Volume: %s\n", name)
+	}
+
+	utils.PrintToConsole("Total reclaimed space: %s\n", humanize.Bytes(reclaimed))
+	return nil
+}
+
+func newVolumeListTableRender() *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"DRIVER", "VOLUME NAME"})
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetBorder(false)
+	table.SetHeaderLine(false)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+
+	return table
+}
+
+// createVolume creates a local volume, an empty name creates an anonymous volume with a generated name
+func createVolume(name string, labels map[string]string) (*Volume, error) {
+	anonymous := name == ""
+	if anonymous {
+		name = strings.ToLower(shortuuid.New())
+	}
+
+	if !volumeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	if vol, err := getVolume(name); err == nil {
+		return vol, nil
+	}
+
+	data, err := filepath.Abs(getVolumeDataPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(data, 0755); err != nil {
+		return nil, err
+	}
+
+	vol := &Volume{
+		Name:       name,
+		Driver:     VolumeDriverLocal,
+		Mountpoint: data,
+		Created:    time.Now(),
+		Labels:     labels,
+		Anonymous:  anonymous,
+	}
+
+	content, err := json.Marshal(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(getVolumePath(name), "volume.json"), content, 0644); err != nil {
+		os.RemoveAll(getVolumePath(name))
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+func getVolume(name string) (*Volume, error) {
+	if !volumeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name %q", name)
+	}
+
+	content, err := os.ReadFile(filepath.Join(getVolumePath(name), "volume.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var vol Volume
+	if err := json.Unmarshal(content, &vol); err != nil {
+		return nil, err
+	}
+
+	return &vol, nil
+}
+
+func getVolumes() ([]*Volume, error) {
+	entries, err := os.ReadDir(VolumePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*Volume{}, nil
+		}
+		return nil, err
+	}
+
+	volumes := []*Volume{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if vol, err := getVolume(entry.Name()); err == nil {
+			volumes = append(volumes, vol)
+		}
+	}
+
+	return volumes, nil
+}
+
+// getVolumeUsers returns the containers whose mounts reference the volume, running or not
+func getVolumeUsers(name string) ([]string, error) {
+	containers, err := getContainerMetas()
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, cnt := range containers {
+		for _, m := range cnt.Mounts {
+			if m.Type == MountTypeVolume && m.Source == name {
+				users = append(users, cnt.ContainerID)
+				break
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// removeAnonymousVolumes removes the anonymous volumes of the mounts which are not used by
+// any container, like docker does for a container removed by --rm
+func removeAnonymousVolumes(mounts []*Mount) error {
+	unlock, err := lockVolumes(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	errs := []error{}
+	for _, m := range mounts {
+		if m.Type != MountTypeVolume || m.Source == "" {
+			continue
+		}
+
+		vol, err := getVolume(m.Source)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if !vol.Anonymous {
+			continue
+		}
+
+		users, err := getVolumeUsers(vol.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(users) != 0 {
+			continue
+		}
+
+		if err := removeVolume(vol.Name); err != nil {
+			errs = append(errs, fmt.Errorf("remove volume %s: %w", vol.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// lockVolumes keeps the volumes which are not used from being removed, a container being
+// created holds it shared until it is recorded, volume rm and prune hold it exclusive
+// while they check the users of the volumes
+func lockVolumes(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(VolumePath(), 0755); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(filepath.Join(VolumePath(), volumesLockFile), exclusive)
+}
+
+func removeVolume(name string) error {
+	return os.RemoveAll(getVolumePath(name))
+}
+
+func VolumePath() string {
+	return config.RootPath("volumes")
+}
+
+func getVolumePath(name string) string {
+	return filepath.Join(VolumePath(), name)
+}
+
+func getVolumeDataPath(name string) string {
+	return filepath.Join(VolumePath(), name, "_data")
+}
+
+func isEmptyDir(path string) (bool, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
+
+// copyImageContentToVolume fills an empty volume with the content of the image at the mount destination
+func copyImageContentToVolume(name string, rootfs string, destination string) error {
+	empty, err := isEmptyDir(getVolumeDataPath(name))
+	if err != nil || !empty {
+		return err
+	}
+
+	src, err := securejoin.SecureJoin(rootfs, destination)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	return utils.CopyDir(src, getVolumeDataPath(name))
+}
@@ -0,0 +1,93 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"aproton.tech/container/utils"
+)
+
+// the conditions of WaitContainer, like the wait API of docker
+const (
+	WaitConditionNotRunning = "not-running"
+	WaitConditionNextExit   = "next-exit"
+	WaitConditionRemoved    = "removed"
+)
+
+const (
+	waitInterval = 100 * time.Millisecond
+	// the process of a running container is gone, but its state is not updated yet,
+	// the state stays running forever when the process which waited for it was killed
+	waitStaleState = 2 * time.Second
+)
+
+// WaitContainer blocks until the container reaches the condition and returns its exit code,
+// not-running returns at once for a container which is not running, next-exit waits for
+// the container to exit after the call, removed waits for the container to be removed
+func WaitContainer(ctx context.Context, idOrName string, condition string) (int, error) {
+	switch condition {
+	case "":
+		condition = WaitConditionNotRunning
+	case WaitConditionNotRunning, WaitConditionNextExit, WaitConditionRemoved:
+	default:
+		return 0, fmt.Errorf("invalid wait condition: %s", condition)
+	}
+
+	cnt, err := findContainer(idOrName)
+	if err != nil {
+		return 0, err
+	}
+
+	since := time.Now()
+	exitCode := cnt.ExitCode
+	var gone time.Time
+
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for {
+		cnt, err := getContainerMeta(cnt.ContainerID)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrContainerNotFound) {
+				return 0, err
+			}
+			if condition == WaitConditionRemoved {
+				return exitCode, nil
+			}
+			return 0, fmt.Errorf("%w: %s", ErrContainerNotFound, idOrName)
+		}
+		exitCode = cnt.ExitCode
+
+		running := false
+		if cnt.Status == StatusRunning || cnt.Status == StatusPaused {
+			if utils.IsProcessExists(cnt.ProcessID, cnt.Command) {
+				running = true
+				gone = time.Time{}
+			} else if gone.IsZero() {
+				gone = time.Now()
+				running = true
+			} else {
+				running = time.Since(gone) < waitStaleState
+			}
+		}
+
+		switch condition {
+		case WaitConditionNotRunning:
+			if !running {
+				return exitCode, nil
+			}
+		case WaitConditionNextExit:
+			if !running && cnt.FinishedAt.After(since) {
+				return exitCode, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
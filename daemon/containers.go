@@ -0,0 +1,546 @@
+package daemon
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/container"
+	"aproton.tech/container/image"
+)
+
+// the stream types of the multiplexed logs
+const (
+	stdoutStream = 1
+	stderrStream = 2
+)
+
+func (d *Daemon) createContainer(w http.ResponseWriter, r *http.Request) {
+	req := &containerCreateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errInvalidParameter, err))
+		return
+	}
+
+	opts, err := newRunOptions(strings.TrimPrefix(r.URL.Query().Get("name"), "/"), req)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errInvalidParameter, err))
+		return
+	}
+	if opts.Platform = r.URL.Query().Get("platform"); opts.Platform != "" {
+		if _, err := image.ParsePlatform(opts.Platform); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errInvalidParameter, err))
+			return
+		}
+	}
+
+	cnt, err := container.CreateContainer(r.Context(), *opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	warnings := []string{}
+	if req.Tty || req.OpenStdin {
+		warnings = append(warnings, "attaching to a container is not supported, the output is only available in its logs")
+	}
+	if warning := image.PlatformWarning(cnt.Platform); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	writeJSON(w, http.StatusCreated, &containerCreateResponse{ID: cnt.ContainerID, Warnings: warnings})
+}
+
+func newRunOptions(name string, req *containerCreateRequest) (*container.RunOptions, error) {
+	specs := []string{}
+	for _, m := range req.HostConfig.Mounts {
+		spec := fmt.Sprintf("type=%s,target=%s", strings.ToLower(m.Type), m.Target)
+		if m.Source != "" {
+			spec += ",source=" + m.Source
+		}
+		if m.ReadOnly {
+			spec += ",readonly"
+		}
+		specs = append(specs, spec)
+	}
+
+	tmpfs := []string{}
+	for destination, options := range req.HostConfig.Tmpfs {
+		if options == "" {
+			tmpfs = append(tmpfs, destination)
+		} else {
+			tmpfs = append(tmpfs, destination+":"+options)
+		}
+	}
+
+	mounts, err := container.ParseMounts(req.HostConfig.Binds, specs, tmpfs)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &container.RunOptions{
+		Image:          req.Image,
+		Cmd:            req.Cmd,
+		Entrypoint:     req.Entrypoint,
+		Env:            req.Env,
+		WorkingDir:     req.WorkingDir,
+		User:           req.User,
+		Name:           name,
+		Labels:         req.Labels,
+		AutoRemove:     req.HostConfig.AutoRemove,
+		Mounts:         mounts,
+		ReadonlyRootfs: req.HostConfig.ReadonlyRootfs,
+	}
+
+	if req.HostConfig.Memory > 0 {
+		opts.Memory = uint64(req.HostConfig.Memory)
+	}
+	if req.HostConfig.ShmSize > 0 {
+		opts.ShmSize = uint64(req.HostConfig.ShmSize)
+	}
+	if req.HostConfig.OomScoreAdj != 0 {
+		adj := req.HostConfig.OomScoreAdj
+		opts.OOMScoreAdj = &adj
+	}
+
+	return opts, nil
+}
+
+func (d *Daemon) listContainers(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseFilters(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	containers, err := container.ListContainers()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	all := boolValue(r, "all")
+	result := []*containerSummary{}
+	for _, cnt := range containers {
+		state, _ := getContainerState(cnt)
+		if !all && state != "running" && state != "paused" {
+			continue
+		}
+		if !matchFilters(filters, cnt, state) {
+			continue
+		}
+		result = append(result, newContainerSummary(cnt))
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (d *Daemon) inspectContainer(w http.ResponseWriter, r *http.Request) {
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	runtimeConfig, err := container.GetRuntimeConfig(cnt.ContainerID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeError(w, err)
+		return
+	}
+	if runtimeConfig == nil {
+		runtimeConfig = &container.RuntimeConfig{}
+	}
+
+	state, _ := getContainerState(cnt)
+	result := &containerJSON{
+		ID:      cnt.ContainerID,
+		Created: cnt.Created.UTC().Format(time.RFC3339Nano),
+		State: containerState{
+			Status:     state,
+			Running:    state == "running" || state == "paused",
+			Paused:     state == "paused",
+			OOMKilled:  cnt.OOMKilled,
+			ExitCode:   cnt.ExitCode,
+			StartedAt:  cnt.StartedAt.UTC().Format(time.RFC3339Nano),
+			FinishedAt: cnt.FinishedAt.UTC().Format(time.RFC3339Nano),
+		},
+		Image:    cnt.Image,
+		Name:     "/" + cnt.Name,
+		Driver:   "overlay",
+		Platform: "linux",
+		Mounts:   newMountPoints(cnt.Mounts),
+		Config: containerConfig{
+			Image:      cnt.Image,
+			Cmd:        runtimeConfig.Cmd,
+			Env:        runtimeConfig.Env,
+			WorkingDir: runtimeConfig.WorkingDir,
+			User:       runtimeConfig.User,
+			Labels:     cnt.Labels,
+		},
+		HostConfig: hostConfig{
+			Binds:          []string{},
+			Memory:         int64(cnt.Memory),
+			ShmSize:        int64(cnt.ShmSize),
+			ReadonlyRootfs: cnt.ReadOnly,
+			AutoRemove:     cnt.AutoRemove,
+			NetworkMode:    "host",
+		},
+	}
+	if result.State.Running {
+		result.State.Pid = cnt.ProcessID
+	}
+	if len(runtimeConfig.Cmd) != 0 {
+		result.Path, result.Args = runtimeConfig.Cmd[0], runtimeConfig.Cmd[1:]
+	}
+	if cnt.OOMScoreAdj != nil {
+		result.HostConfig.OomScoreAdj = *cnt.OOMScoreAdj
+	}
+	for _, m := range cnt.Mounts {
+		if m.Type == container.MountTypeBind {
+			bind := m.Source + ":" + m.Destination
+			if m.ReadOnly {
+				bind += ":ro"
+			}
+			result.HostConfig.Binds = append(result.HostConfig.Binds, bind)
+		}
+	}
+	result.NetworkSettings.Ports = map[string]interface{}{}
+	result.NetworkSettings.Networks = map[string]interface{}{}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (d *Daemon) startContainer(w http.ResponseWriter, r *http.Request) {
+	d.startLock.Lock()
+	defer d.startLock.Unlock()
+
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if state, _ := getContainerState(cnt); state == "running" || state == "paused" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// the container lives as long as the daemon, not as the request
+	rc, err := container.StartContainer(context.Background(), cnt.ContainerID, container.StartOptions{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	d.track(rc)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) stopContainer(w http.ResponseWriter, r *http.Request) {
+	timeout := container.DefaultStopTimeout
+	if t := r.URL.Query().Get("t"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: t: %v", errInvalidParameter, err))
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if state, _ := getContainerState(cnt); state != "running" && state != "paused" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if err := container.StopContainer(r.Context(), cnt.ContainerID, timeout); err != nil {
+		writeError(w, err)
+		return
+	}
+	d.waitTracked(cnt.ContainerID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) waitContainer(w http.ResponseWriter, r *http.Request) {
+	condition := r.URL.Query().Get("condition")
+	switch condition {
+	case "", container.WaitConditionNotRunning, container.WaitConditionNextExit, container.WaitConditionRemoved:
+	default:
+		writeError(w, fmt.Errorf("%w: invalid condition %q", errInvalidParameter, condition))
+		return
+	}
+
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the clients wait for the headers before they start the container
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	result := &containerWaitResponse{}
+	code, err := container.WaitContainer(r.Context(), cnt.ContainerID, condition)
+	if err != nil {
+		result.Error = &waitError{Message: err.Error()}
+	}
+	result.StatusCode = code
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logrus.Warnf("write response: %v", err)
+	}
+}
+
+func (d *Daemon) containerLogs(w http.ResponseWriter, r *http.Request) {
+	stdout, stderr := boolValue(r, "stdout"), boolValue(r, "stderr")
+	if !stdout && !stderr {
+		writeError(w, fmt.Errorf("%w: you must choose at least one stream", errInvalidParameter))
+		return
+	}
+
+	opts := container.LogsOptions{Follow: boolValue(r, "follow"), Tail: -1}
+	if tail := r.URL.Query().Get("tail"); tail != "" && tail != "all" {
+		n, err := strconv.Atoi(tail)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: tail: %v", errInvalidParameter, err))
+			return
+		}
+		opts.Tail = n
+	}
+	if since := r.URL.Query().Get("since"); since != "" && since != "0" {
+		seconds, err := strconv.ParseFloat(since, 64)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: since: %v", errInvalidParameter, err))
+			return
+		}
+		opts.Since = time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+	timestamps := boolValue(r, "timestamps")
+
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	err = container.ContainerLogs(r.Context(), cnt.ContainerID, opts, func(entry *container.LogEntry) error {
+		stream := byte(stdoutStream)
+		if entry.Stream == container.StreamStderr {
+			if !stderr {
+				return nil
+			}
+			stream = stderrStream
+		} else if !stdout {
+			return nil
+		}
+
+		payload := entry.Log
+		if timestamps {
+			payload = entry.Time.UTC().Format(time.RFC3339Nano) + " " + payload
+		}
+
+		header := make([]byte, 8)
+		header[0] = stream
+		binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+		if _, err := w.Write(append(header, payload...)); err != nil {
+			return err
+		}
+
+		if opts.Follow {
+			flush(w)
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		logrus.Warnf("logs of container %s: %v", cnt.ContainerID, err)
+	}
+}
+
+func (d *Daemon) removeContainer(w http.ResponseWriter, r *http.Request) {
+	cnt, err := container.InspectContainer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if state, _ := getContainerState(cnt); (state == "running" || state == "paused") && boolValue(r, "force") {
+		if err := container.StopContainer(r.Context(), cnt.ContainerID, 0); err != nil {
+			writeError(w, err)
+			return
+		}
+		d.waitTracked(cnt.ContainerID)
+	}
+
+	if err := container.RemoveContainer(cnt.ContainerID); err != nil {
+		if errors.Is(err, container.ErrContainerNotFound) {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusConflict, &errorMessage{Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getContainerState returns the state of docker and the text of its status
+func getContainerState(cnt *container.ContainerMeta) (string, string) {
+	switch cnt.Status {
+	case container.StatusCreated:
+		return "created", "Created"
+	case container.StatusRunning:
+		return "running", "Up " + humanDuration(time.Since(cnt.StartedAt))
+	case container.StatusPaused:
+		return "paused", "Up " + humanDuration(time.Since(cnt.StartedAt)) + " (Paused)"
+	default:
+		return "exited", fmt.Sprintf("Exited (%d) %s ago", cnt.ExitCode, humanDuration(time.Since(cnt.FinishedAt)))
+	}
+}
+
+func newContainerSummary(cnt *container.ContainerMeta) *containerSummary {
+	state, status := getContainerState(cnt)
+
+	command := cnt.Command
+	if runtimeConfig, err := container.GetRuntimeConfig(cnt.ContainerID); err == nil {
+		command = strings.Join(runtimeConfig.Cmd, " ")
+	}
+
+	summary := &containerSummary{
+		ID:      cnt.ContainerID,
+		Names:   []string{"/" + cnt.Name},
+		Image:   cnt.Image,
+		Command: command,
+		Created: cnt.Created.Unix(),
+		Ports:   []interface{}{},
+		Labels:  cnt.Labels,
+		State:   state,
+		Status:  status,
+		Mounts:  newMountPoints(cnt.Mounts),
+	}
+	if summary.Labels == nil {
+		summary.Labels = map[string]string{}
+	}
+	summary.HostConfig.NetworkMode = "host"
+
+	return summary
+}
+
+func newMountPoints(mounts []*container.Mount) []mountPoint {
+	result := []mountPoint{}
+	for _, m := range mounts {
+		mp := mountPoint{Type: m.Type, Destination: m.Destination, RW: !m.ReadOnly}
+		if m.Type == container.MountTypeVolume {
+			mp.Name = m.Source
+		} else {
+			mp.Source = m.Source
+		}
+		result = append(result, mp)
+	}
+	return result
+}
+
+// parseFilters parses the filters parameter, {"label":["a=b"]}, or {"label":{"a=b":true}} of the old versions
+func parseFilters(value string) (map[string][]string, error) {
+	filters := map[string][]string{}
+	if value == "" {
+		return filters, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &filters); err == nil {
+		return filters, nil
+	}
+
+	legacy := map[string]map[string]bool{}
+	if err := json.Unmarshal([]byte(value), &legacy); err != nil {
+		return nil, fmt.Errorf("%w: filters: %v", errInvalidParameter, err)
+	}
+	for key, values := range legacy {
+		for v := range values {
+			filters[key] = append(filters[key], v)
+		}
+	}
+	return filters, nil
+}
+
+// matchFilters matches the container with the id, name, label and status filters,
+// the values of a filter are alternatives, different filters must all match
+func matchFilters(filters map[string][]string, cnt *container.ContainerMeta, state string) bool {
+	for key, values := range filters {
+		matched := false
+		for _, value := range values {
+			switch key {
+			case "id":
+				matched = strings.HasPrefix(cnt.ContainerID, value)
+			case "name":
+				matched = strings.Contains(cnt.Name, strings.TrimPrefix(value, "/"))
+			case "status":
+				matched = state == value
+			case "label":
+				k, v, hasValue := strings.Cut(value, "=")
+				label, ok := cnt.Labels[k]
+				matched = ok && (!hasValue || label == v)
+			default:
+				matched = true
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func humanDuration(d time.Duration) string {
+	switch seconds := int(d.Seconds()); {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+
+	switch minutes := int(d.Minutes()); {
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+
+	switch hours := int(d.Hours() + 0.5); {
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*7*2:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*30*2:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	}
+	return fmt.Sprintf("%d years", int(d.Hours())/24/365)
+}
@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/container"
+	"aproton.tech/container/image"
+)
+
+const (
+	APIVersion    = "1.41"
+	MinAPIVersion = "1.24"
+)
+
+// how long the running requests may take when the daemon shuts down
+const shutdownTimeout = 10 * time.Second
+
+// the docker clients put the API version before the path, e.g. /v1.41/containers/json
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)*/`)
+
+var errInvalidParameter = errors.New("invalid parameter")
+
+func DefaultSocketPath() string {
+	return config.StatePath("container.sock")
+}
+
+func DaemonCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "serve a subset of the docker engine API on a unix socket",
+		Args:  cobra.NoArgs,
+		RunE:  DaemonRunCommand,
+	}
+	cmd.Flags().StringP("host", "H", "", "Unix socket to listen on (default \"<state>/container.sock\")")
+
+	return cmd
+}
+
+func DaemonRunCommand(cmd *cobra.Command, args []string) error {
+	socket := strings.TrimPrefix(cmd.Flag("host").Value.String(), "unix://")
+	if socket == "" {
+		socket = DefaultSocketPath()
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return Serve(ctx, socket, cmd.Root().Version)
+}
+
+// Daemon owns the containers started through the API, it waits for them and
+// records their exit
+type Daemon struct {
+	version string
+
+	// a container must not be started twice by concurrent requests
+	startLock sync.Mutex
+
+	lock       sync.Mutex
+	containers map[string]chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Serve serves the API on the unix socket until ctx is done, then the containers
+// started by the daemon are stopped
+func Serve(ctx context.Context, socket string, version string) error {
+	listener, err := listenUnix(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	d := &Daemon{version: version, containers: map[string]chan struct{}{}}
+	server := &http.Server{Handler: d.Handler()}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	logrus.Infof("API listening on %s", socket)
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logrus.Infof("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// the followed logs and waits never finish by themselves
+		server.Close()
+	}
+
+	d.stopContainers()
+	return nil
+}
+
+func listenUnix(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return nil, err
+	}
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another daemon is listening on %s", socket)
+	}
+
+	// left behind by a daemon which was killed
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socket, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Handler returns the handler of the API
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", d.ping)
+	mux.HandleFunc("GET /version", d.getVersion)
+
+	mux.HandleFunc("POST /containers/create", d.createContainer)
+	mux.HandleFunc("GET /containers/json", d.listContainers)
+	mux.HandleFunc("GET /containers/{id}/json", d.inspectContainer)
+	mux.HandleFunc("POST /containers/{id}/start", d.startContainer)
+	mux.HandleFunc("POST /containers/{id}/stop", d.stopContainer)
+	mux.HandleFunc("POST /containers/{id}/wait", d.waitContainer)
+	mux.HandleFunc("GET /containers/{id}/logs", d.containerLogs)
+	mux.HandleFunc("DELETE /containers/{id}", d.removeContainer)
+
+	mux.HandleFunc("POST /images/create", d.createImage)
+	mux.HandleFunc("GET /images/json", d.listImages)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logrus.Debugf("%s %s", r.Method, r.URL.Path)
+
+		if prefix := versionPrefix.FindString(r.URL.Path); prefix != "" {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, prefix)
+		}
+
+		w.Header().Set("API-Version", APIVersion)
+		w.Header().Set("Server", "container/"+d.version)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// track waits for a container started by the daemon in background
+func (d *Daemon) track(rc *container.RunningContainer) {
+	done := make(chan struct{})
+
+	d.lock.Lock()
+	d.containers[rc.ID] = done
+	d.lock.Unlock()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(done)
+
+		result, err := rc.Wait()
+		if err != nil {
+			logrus.Errorf("wait container %s: %v", rc.ID, err)
+		} else {
+			logrus.Infof("container %s exited with %d", rc.ID, result.ExitCode)
+		}
+
+		d.lock.Lock()
+		delete(d.containers, rc.ID)
+		d.lock.Unlock()
+	}()
+}
+
+// waitTracked waits until the daemon recorded the exit of the container, if it started it
+func (d *Daemon) waitTracked(containerId string) {
+	d.lock.Lock()
+	done, ok := d.containers[containerId]
+	d.lock.Unlock()
+
+	if ok {
+		<-done
+	}
+}
+
+func (d *Daemon) stopContainers() {
+	d.lock.Lock()
+	ids := []string{}
+	for id := range d.containers {
+		ids = append(ids, id)
+	}
+	d.lock.Unlock()
+
+	for _, id := range ids {
+		logrus.Infof("stop container %s", id)
+		if err := container.StopContainer(context.Background(), id, container.DefaultStopTimeout); err != nil {
+			logrus.Warnf("stop container %s: %v", id, err)
+		}
+	}
+
+	d.wg.Wait()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Warnf("write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInvalidParameter):
+		status = http.StatusBadRequest
+	case errors.Is(err, container.ErrContainerNotFound), errors.Is(err, image.ErrImageNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, container.ErrContainerNameInUse):
+		status = http.StatusConflict
+	}
+
+	writeJSON(w, status, &errorMessage{Message: err.Error()})
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// boolValue parses the boolean query parameters of docker, 1 or true
+func boolValue(r *http.Request, key string) bool {
+	value := strings.ToLower(r.URL.Query().Get(key))
+	return value == "1" || value == "true"
+}
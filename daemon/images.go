@@ -0,0 +1,174 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/image"
+)
+
+// how often the progress of a download is sent
+const progressInterval = 100 * time.Millisecond
+
+func (d *Daemon) createImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("fromSrc") != "" {
+		writeError(w, fmt.Errorf("%w: importing an image is not supported", errInvalidParameter))
+		return
+	}
+
+	from := query.Get("fromImage")
+	if from == "" {
+		writeError(w, fmt.Errorf("%w: fromImage is required", errInvalidParameter))
+		return
+	}
+	if tag := query.Get("tag"); tag != "" {
+		if strings.Contains(tag, ":") {
+			from += "@" + tag
+		} else {
+			from += ":" + tag
+		}
+	}
+
+	ref, err := name.ParseReference(from)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errInvalidParameter, err))
+		return
+	}
+
+	auth, err := registryAuth(r)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: X-Registry-Auth: %v", errInvalidParameter, err))
+		return
+	}
+
+	platform := query.Get("platform")
+	if platform != "" {
+		if _, err := image.ParsePlatform(platform); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errInvalidParameter, err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	progress := func(msg *progressMessage) {
+		if err := encoder.Encode(msg); err != nil {
+			logrus.Warnf("write response: %v", err)
+		}
+		flush(w)
+	}
+
+	progress(&progressMessage{ID: ref.Identifier(), Status: "Pulling from " + ref.Context().RepositoryStr()})
+
+	// the downloads report concurrently, and the bytes of every write
+	var lock sync.Mutex
+	reported := map[string]time.Time{}
+	opts := image.PullOptions{Auth: auth, Platform: platform, Progress: func(p image.PullProgress) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		msg := &progressMessage{ID: p.ID, Status: p.Status}
+		if p.Status == image.ProgressDownloading {
+			if time.Since(reported[p.ID]) < progressInterval {
+				return
+			}
+			reported[p.ID] = time.Now()
+			msg.ProgressDetail = &progressDetail{Current: p.Current, Total: p.Total}
+		}
+		progress(msg)
+	}}
+
+	summary, err := image.PullImage(r.Context(), ref.Name(), opts)
+	if err != nil {
+		progress(&progressMessage{Error: err.Error(), ErrorDetail: &errorMessage{Message: err.Error()}})
+		return
+	}
+
+	progress(&progressMessage{Status: "Digest: " + summary.Digest.String()})
+	progress(&progressMessage{Status: "Status: Downloaded newer image for " + familiarName(ref.Name())})
+}
+
+// registryAuth decodes the credentials sent by the docker client, the credentials stored
+// by login are used when there are none
+func registryAuth(r *http.Request) (authn.Authenticator, error) {
+	header := r.Header.Get("X-Registry-Auth")
+	if header == "" {
+		return nil, nil
+	}
+
+	content, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		// some clients pad, others don't
+		if content, err = base64.RawURLEncoding.DecodeString(header); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := authn.AuthConfig{}
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg == (authn.AuthConfig{}) {
+		return nil, nil
+	}
+	return authn.FromConfig(cfg), nil
+}
+
+func (d *Daemon) listImages(w http.ResponseWriter, r *http.Request) {
+	images, err := image.ListImages()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result := []*imageSummary{}
+	for _, img := range images {
+		created := int64(0)
+		if !img.Created.IsZero() {
+			created = img.Created.Unix()
+		}
+
+		summary := &imageSummary{
+			ID:          img.Digest.String(),
+			RepoTags:    []string{},
+			RepoDigests: []string{},
+			Created:     created,
+			Size:        img.Size,
+			VirtualSize: img.Size,
+			SharedSize:  -1,
+			Labels:      map[string]string{},
+			Containers:  -1,
+		}
+		if img.Tag != "" {
+			summary.RepoTags = append(summary.RepoTags, familiarName(img.Name))
+		}
+		if img.RepoDigest != "" {
+			summary.RepoDigests = append(summary.RepoDigests, familiarName(img.Repository)+"@"+img.RepoDigest)
+		}
+		result = append(result, summary)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// familiarName shortens the names of docker hub like the docker CLI, index.docker.io/library/busybox:latest is busybox:latest
+func familiarName(name string) string {
+	for _, prefix := range []string{"index.docker.io/library/", "docker.io/library/", "index.docker.io/", "docker.io/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
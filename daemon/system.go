@@ -0,0 +1,38 @@
+package daemon
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func (d *Daemon) ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Experimental", "false")
+	w.Header().Set("OSType", runtime.GOOS)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, "OK")
+	}
+}
+
+func (d *Daemon) getVersion(w http.ResponseWriter, r *http.Request) {
+	kernel := ""
+	uts := &unix.Utsname{}
+	if err := unix.Uname(uts); err == nil {
+		kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+
+	writeJSON(w, http.StatusOK, &versionResponse{
+		Version:       d.version,
+		APIVersion:    APIVersion,
+		MinAPIVersion: MinAPIVersion,
+		GoVersion:     runtime.Version(),
+		Os:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		KernelVersion: kernel,
+	})
+}
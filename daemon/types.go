@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"encoding/json"
+)
+
+// the subset of the docker engine API types used by the handlers
+
+// strSlice is a list of strings which may also be sent as a single string
+type strSlice []string
+
+func (s *strSlice) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = []string{str}
+	return nil
+}
+
+type containerCreateRequest struct {
+	Image      string            `json:"Image"`
+	Cmd        strSlice          `json:"Cmd"`
+	Entrypoint strSlice          `json:"Entrypoint"`
+	Env        []string          `json:"Env"`
+	WorkingDir string            `json:"WorkingDir"`
+	User       string            `json:"User"`
+	Labels     map[string]string `json:"Labels"`
+	Tty        bool              `json:"Tty"`
+	OpenStdin  bool              `json:"OpenStdin"`
+	HostConfig hostConfig        `json:"HostConfig"`
+}
+
+type hostConfig struct {
+	Binds          []string          `json:"Binds"`
+	Mounts         []mountRequest    `json:"Mounts,omitempty"`
+	Tmpfs          map[string]string `json:"Tmpfs,omitempty"`
+	Memory         int64             `json:"Memory"`
+	ShmSize        int64             `json:"ShmSize"`
+	ReadonlyRootfs bool              `json:"ReadonlyRootfs"`
+	AutoRemove     bool              `json:"AutoRemove"`
+	OomScoreAdj    int               `json:"OomScoreAdj"`
+	NetworkMode    string            `json:"NetworkMode"`
+}
+
+type mountRequest struct {
+	Type     string `json:"Type"`
+	Source   string `json:"Source"`
+	Target   string `json:"Target"`
+	ReadOnly bool   `json:"ReadOnly"`
+}
+
+type containerCreateResponse struct {
+	ID       string   `json:"Id"`
+	Warnings []string `json:"Warnings"`
+}
+
+type containerWaitResponse struct {
+	StatusCode int        `json:"StatusCode"`
+	Error      *waitError `json:"Error,omitempty"`
+}
+
+type waitError struct {
+	Message string `json:"Message"`
+}
+
+type mountPoint struct {
+	Type        string `json:"Type"`
+	Name        string `json:"Name,omitempty"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	RW          bool   `json:"RW"`
+}
+
+type containerSummary struct {
+	ID         string            `json:"Id"`
+	Names      []string          `json:"Names"`
+	Image      string            `json:"Image"`
+	ImageID    string            `json:"ImageID"`
+	Command    string            `json:"Command"`
+	Created    int64             `json:"Created"`
+	Ports      []interface{}     `json:"Ports"`
+	Labels     map[string]string `json:"Labels"`
+	State      string            `json:"State"`
+	Status     string            `json:"Status"`
+	Mounts     []mountPoint      `json:"Mounts"`
+	HostConfig struct {
+		NetworkMode string `json:"NetworkMode"`
+	} `json:"HostConfig"`
+}
+
+type containerState struct {
+	Status     string `json:"Status"`
+	Running    bool   `json:"Running"`
+	Paused     bool   `json:"Paused"`
+	Restarting bool   `json:"Restarting"`
+	OOMKilled  bool   `json:"OOMKilled"`
+	Dead       bool   `json:"Dead"`
+	Pid        int    `json:"Pid"`
+	ExitCode   int    `json:"ExitCode"`
+	Error      string `json:"Error"`
+	StartedAt  string `json:"StartedAt"`
+	FinishedAt string `json:"FinishedAt"`
+}
+
+type containerConfig struct {
+	Hostname   string            `json:"Hostname"`
+	Image      string            `json:"Image"`
+	Cmd        []string          `json:"Cmd"`
+	Entrypoint []string          `json:"Entrypoint"`
+	Env        []string          `json:"Env"`
+	WorkingDir string            `json:"WorkingDir"`
+	User       string            `json:"User"`
+	Labels     map[string]string `json:"Labels"`
+	Tty        bool              `json:"Tty"`
+	OpenStdin  bool              `json:"OpenStdin"`
+}
+
+type containerJSON struct {
+	ID              string          `json:"Id"`
+	Created         string          `json:"Created"`
+	Path            string          `json:"Path"`
+	Args            []string        `json:"Args"`
+	State           containerState  `json:"State"`
+	Image           string          `json:"Image"`
+	Name            string          `json:"Name"`
+	RestartCount    int             `json:"RestartCount"`
+	Driver          string          `json:"Driver"`
+	Platform        string          `json:"Platform"`
+	Mounts          []mountPoint    `json:"Mounts"`
+	Config          containerConfig `json:"Config"`
+	HostConfig      hostConfig      `json:"HostConfig"`
+	NetworkSettings struct {
+		Ports    map[string]interface{} `json:"Ports"`
+		Networks map[string]interface{} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type imageSummary struct {
+	ID          string            `json:"Id"`
+	ParentID    string            `json:"ParentId"`
+	RepoTags    []string          `json:"RepoTags"`
+	RepoDigests []string          `json:"RepoDigests"`
+	Created     int64             `json:"Created"`
+	Size        int64             `json:"Size"`
+	VirtualSize int64             `json:"VirtualSize"`
+	SharedSize  int64             `json:"SharedSize"`
+	Labels      map[string]string `json:"Labels"`
+	Containers  int64             `json:"Containers"`
+}
+
+type progressMessage struct {
+	ID             string          `json:"id,omitempty"`
+	Status         string          `json:"status,omitempty"`
+	ProgressDetail *progressDetail `json:"progressDetail,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	ErrorDetail    *errorMessage   `json:"errorDetail,omitempty"`
+}
+
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+type errorMessage struct {
+	Message string `json:"message"`
+}
+
+type versionResponse struct {
+	Version       string `json:"Version"`
+	APIVersion    string `json:"ApiVersion"`
+	MinAPIVersion string `json:"MinAPIVersion"`
+	GitCommit     string `json:"GitCommit"`
+	GoVersion     string `json:"GoVersion"`
+	Os            string `json:"Os"`
+	Arch          string `json:"Arch"`
+	KernelVersion string `json:"KernelVersion"`
+}
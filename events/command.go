@@ -0,0 +1,90 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func EventsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "show the events of containers and images",
+		Long: `show the events of containers and images
+
+The events are read from the journal under the root and followed until --until
+or until interrupted. Without --since only the new events are shown.`,
+		Args: cobra.NoArgs,
+		RunE: EventsRunCommand,
+	}
+	cmd.Flags().String("since", "", "Show the events since a time, e.g. 10m, 1700000000 or 2006-01-02T15:04:05Z")
+	cmd.Flags().String("until", "", "Stream the events until a time")
+	cmd.Flags().StringArrayP("filter", "f", []string{}, "Filter the events, type=container|image, event=<action>, container=<id or name>, image=<name>")
+	cmd.Flags().String("format", "", "Format of the events, json prints one JSON object per line")
+
+	return cmd
+}
+
+func EventsRunCommand(cmd *cobra.Command, args []string) error {
+	now := time.Now()
+	opts := ReadOptions{Since: now, Follow: true}
+
+	if since := cmd.Flag("since").Value.String(); since != "" {
+		t, err := ParseTime(since, now)
+		if err != nil {
+			return err
+		}
+		opts.Since = t
+	}
+
+	if until := cmd.Flag("until").Value.String(); until != "" {
+		t, err := ParseTime(until, now)
+		if err != nil {
+			return err
+		}
+		opts.Until = t
+	}
+
+	values, err := cmd.Flags().GetStringArray("filter")
+	if err != nil {
+		return err
+	}
+	if opts.Filters, err = ParseFilters(values); err != nil {
+		return err
+	}
+
+	format := cmd.Flag("format").Value.String()
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q, only json is supported", format)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	return Read(cmd.Context(), opts, func(event Event) error {
+		if format == "json" {
+			return encoder.Encode(&event)
+		}
+		_, err := fmt.Println(formatEvent(event))
+		return err
+	})
+}
+
+// formatEvent formats the event like docker: time type action id (attributes)
+func formatEvent(event Event) string {
+	text := fmt.Sprintf("%s %s %s %s", event.Time.Local().Format(time.RFC3339Nano), event.Type, event.Action, event.ID)
+	if len(event.Attributes) == 0 {
+		return text
+	}
+
+	attributes := make([]string, 0, len(event.Attributes))
+	for key, value := range event.Attributes {
+		attributes = append(attributes, key+"="+value)
+	}
+	sort.Strings(attributes)
+
+	return text + " (" + strings.Join(attributes, ", ") + ")"
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TypeContainer = "container"
+	TypeImage     = "image"
+)
+
+// Event is a lifecycle change of a container or an image, e.g. container start or image pull
+type Event struct {
+	Type       string            `json:"type"`
+	Action     string            `json:"action"`
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Handler is called synchronously for every event, it must not block
+type Handler func(Event)
+
+var (
+	handlersLock sync.RWMutex
+	handlers     = map[int]Handler{}
+	nextHandler  = 0
+)
+
+// Subscribe registers the handler for the events of this process, the returned
+// function unregisters it
+func Subscribe(handler Handler) func() {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	id := nextHandler
+	nextHandler++
+	handlers[id] = handler
+
+	return func() {
+		handlersLock.Lock()
+		defer handlersLock.Unlock()
+		delete(handlers, id)
+	}
+}
+
+// Publish records the event in the journal and sends it to all subscribed handlers
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if err := record(event); err != nil {
+		logrus.Warnf("record event %s %s: %v", event.Type, event.Action, err)
+	}
+
+	// a handler may unsubscribe itself, so it is called without the lock
+	handlersLock.RLock()
+	list := make([]Handler, 0, len(handlers))
+	for _, handler := range handlers {
+		list = append(list, handler)
+	}
+	handlersLock.RUnlock()
+
+	for _, handler := range list {
+		handler(event)
+	}
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// the keys of the filters
+const (
+	FilterType      = "type"
+	FilterEvent     = "event"
+	FilterContainer = "container"
+	FilterImage     = "image"
+)
+
+// ParseFilters parses the key=value filters of the command line
+func ParseFilters(values []string) (map[string][]string, error) {
+	filters := map[string][]string{}
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("invalid filter %q, must be key=value", value)
+		}
+
+		switch key {
+		case FilterType:
+			if val != TypeContainer && val != TypeImage {
+				return nil, fmt.Errorf("invalid filter %q, type must be %s or %s", value, TypeContainer, TypeImage)
+			}
+		case FilterEvent, FilterContainer, FilterImage:
+		default:
+			return nil, fmt.Errorf("invalid filter %q, unknown key %s", value, key)
+		}
+		filters[key] = append(filters[key], val)
+	}
+
+	return filters, nil
+}
+
+// Match returns whether the event matches any value of every filter: type, event is the
+// action, container is the id or the name of a container, image is the name of an image
+// or the image of a container
+func Match(event Event, filters map[string][]string) bool {
+	for key, values := range filters {
+		matched := false
+		for _, value := range values {
+			if matchFilter(event, key, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchFilter(event Event, key string, value string) bool {
+	switch key {
+	case FilterType:
+		return event.Type == value
+	case FilterEvent:
+		return event.Action == value
+	case FilterContainer:
+		return event.Type == TypeContainer && (event.ID == value || event.Attributes["name"] == value)
+	case FilterImage:
+		image := event.ID
+		if event.Type == TypeContainer {
+			image = event.Attributes["image"]
+		}
+		if image == value {
+			return true
+		}
+		// the images are recorded with their full names, e.g. index.docker.io/library/busybox:latest
+		ref, err := name.ParseReference(value)
+		return err == nil && image == ref.Name()
+	}
+	return false
+}
+
+// ParseTime parses the time of --since and --until: a duration before now, e.g. 10m,
+// a unix timestamp in seconds, an RFC 3339 time or a date
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		sec := int64(seconds)
+		return time.Unix(sec, int64((seconds-float64(sec))*float64(time.Second))), nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, must be a duration, a unix timestamp or an RFC 3339 time", value)
+}
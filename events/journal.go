@@ -0,0 +1,294 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+const (
+	// how often a followed journal is checked for new events
+	journalFollowInterval = 200 * time.Millisecond
+	// the journal is rotated when it grows larger, the rotated journal is kept until the next rotation
+	journalMaxSize = 16 << 20
+	// concurrent processes may append their events slightly out of order,
+	// seeking the time of since starts this much earlier
+	journalSeekSlack = time.Second
+)
+
+// JournalFile is the append-only journal of the events of all processes using the root,
+// one JSON event per line
+func JournalFile() string {
+	return config.RootPath("events.log")
+}
+
+// rotatedJournalFile keeps the events before the last rotation
+func rotatedJournalFile() string {
+	return JournalFile() + ".1"
+}
+
+// record appends the event to the journal, every event is a single write of an
+// O_APPEND file, so the lines of concurrent processes don't interleave
+func record(event Event) error {
+	line, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(JournalFile()), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(JournalFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if fi, err := file.Stat(); err == nil && fi.Size() > journalMaxSize {
+		return rotateJournal()
+	}
+	return nil
+}
+
+// rotateJournal renames the journal to the rotated one, the writers which opened it
+// before still append to the rotated journal
+func rotateJournal() error {
+	unlock, err := utils.LockFile(JournalFile()+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// rotated by another process while waiting for the lock
+	fi, err := os.Stat(JournalFile())
+	if err != nil || fi.Size() <= journalMaxSize {
+		return nil
+	}
+	return os.Rename(JournalFile(), rotatedJournalFile())
+}
+
+// ReadOptions selects the events returned by Read
+type ReadOptions struct {
+	// Since skips the events before it
+	Since time.Time
+	// Until stops reading at it, a followed journal is read until it passes
+	Until time.Time
+	// Follow keeps reading the new events until ctx is done or Until passes
+	Follow bool
+	// Filters keeps the events matching any value of every key, see Match
+	Filters map[string][]string
+}
+
+// Read calls fn with the events of the journal in the order they were recorded
+func Read(ctx context.Context, opts ReadOptions, fn func(Event) error) error {
+	emit := func(event Event) error {
+		if event.Time.Before(opts.Since) || (!opts.Until.IsZero() && event.Time.After(opts.Until)) {
+			return nil
+		}
+		if !Match(event, opts.Filters) {
+			return nil
+		}
+		return fn(event)
+	}
+
+	// the rotated journal is skipped when all its events are before since
+	if fi, err := os.Stat(rotatedJournalFile()); err == nil && !fi.ModTime().Before(opts.Since) {
+		file, reader, err := openJournal(rotatedJournalFile(), opts.Since)
+		if err != nil {
+			return err
+		}
+		err = reader.read(emit)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, reader, err := openJournal(JournalFile(), opts.Since)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	ticker := time.NewTicker(journalFollowInterval)
+	defer ticker.Stop()
+	for {
+		if err := reader.read(emit); err != nil {
+			return err
+		}
+
+		if !opts.Follow || (!opts.Until.IsZero() && time.Now().After(opts.Until)) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// the journal is created by the first event and replaced by a rotation,
+		// the rest of the old one is read before following the new one
+		if replaced, err := isJournalReplaced(file); err != nil {
+			return err
+		} else if replaced {
+			if err := reader.read(emit); err != nil {
+				return err
+			}
+			file.Close()
+			if file, reader, err = openJournal(JournalFile(), time.Time{}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// openJournal opens the journal at the first event since the time, a journal which
+// does not exist yet is read as an empty one
+func openJournal(name string, since time.Time) (*os.File, *journalReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		if file, err = os.Open(os.DevNull); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !since.IsZero() {
+		offset, err := seekJournal(file, since.Add(-journalSeekSlack))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	return file, &journalReader{reader: bufio.NewReader(file)}, nil
+}
+
+func isJournalReplaced(file *os.File) (bool, error) {
+	fi, err := os.Stat(JournalFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	current, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(fi, current), nil
+}
+
+// seekJournal returns the offset of the first event at or after the time, by a binary
+// search of the lines, the events are appended in the order of their time
+func seekJournal(file *os.File, target time.Time) (int64, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	lo, hi := int64(0), fi.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, eventTime, err := journalLineAt(file, mid, fi.Size())
+		if err != nil {
+			return 0, err
+		}
+		if start >= fi.Size() || !eventTime.Before(target) {
+			hi = mid
+		} else {
+			// the lines starting up to start are the same line
+			lo = start + 1
+		}
+	}
+
+	start, _, err := journalLineAt(file, lo, fi.Size())
+	return start, err
+}
+
+// journalLineAt returns the offset and the time of the first complete line starting
+// at or after offset, the offset is size when there is none
+func journalLineAt(file *os.File, offset int64, size int64) (int64, time.Time, error) {
+	start := offset
+	if offset > 0 {
+		// the line starts after the newline which ends the previous one
+		reader := bufio.NewReader(io.NewSectionReader(file, offset-1, size-offset+1))
+		skipped, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return size, time.Time{}, nil
+			}
+			return 0, time.Time{}, err
+		}
+		start = offset - 1 + int64(len(skipped))
+	}
+
+	line, err := bufio.NewReader(io.NewSectionReader(file, start, size-start)).ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			return size, time.Time{}, nil
+		}
+		return 0, time.Time{}, err
+	}
+
+	event := Event{}
+	if err := json.Unmarshal(line, &event); err != nil {
+		return 0, time.Time{}, fmt.Errorf("read events journal: %w", err)
+	}
+	return start, event.Time, nil
+}
+
+type journalReader struct {
+	reader *bufio.Reader
+	// the end of the journal may be an event which is being written
+	partial []byte
+}
+
+// read reads the complete events until the end of the journal
+func (r *journalReader) read(fn func(Event) error) error {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				r.partial = append(r.partial, line...)
+				return nil
+			}
+			return err
+		}
+
+		if len(r.partial) != 0 {
+			line = append(r.partial, line...)
+			r.partial = nil
+		}
+
+		event := Event{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("read events journal: %w", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package image
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+
+	"aproton.tech/container/config"
+)
+
+// The credentials are kept in the docker config.json ($DOCKER_CONFIG or ~/.docker), so the
+// logins of docker are shared. The credsStore and credHelpers of the file select the
+// docker-credential-* helper binaries which store them instead of the file.
+
+// ErrNotLoggedIn is returned by Logout when there are no credentials of the registry
+var ErrNotLoggedIn = errors.New("not logged in")
+
+func RegistryCommands() []*cobra.Command {
+	login := &cobra.Command{
+		Use:   "login [SERVER]",
+		Short: "log in to a registry, the default is Docker Hub",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  LoginCommand,
+	}
+	login.Flags().StringP("username", "u", "", "Username")
+	login.Flags().StringP("password", "p", "", "Password")
+	login.Flags().Bool("password-stdin", false, "Take the password from stdin")
+
+	logout := &cobra.Command{
+		Use:   "logout [SERVER]",
+		Short: "log out from a registry, the default is Docker Hub",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  LogoutCommand,
+	}
+
+	return []*cobra.Command{login, logout}
+}
+
+func LoginCommand(cmd *cobra.Command, args []string) error {
+	server := name.DefaultRegistry
+	if len(args) != 0 {
+		server = args[0]
+	}
+
+	username := cmd.Flag("username").Value.String()
+	password := cmd.Flag("password").Value.String()
+	stdin := bufio.NewReader(os.Stdin)
+
+	if cmd.Flag("password-stdin").Value.String() == "true" {
+		if password != "" {
+			return errors.New("--password and --password-stdin are mutually exclusive")
+		}
+		if username == "" {
+			return errors.New("--username is required with --password-stdin")
+		}
+
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+
+	if username == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("read username: %w", err)
+		}
+		username = strings.TrimSpace(line)
+	}
+
+	if password == "" {
+		fmt.Print("Password: ")
+		line, err := readPassword(stdin)
+		fmt.Println()
+		if err != nil {
+			return fmt.Errorf("read password: %w", err)
+		}
+		password = line
+	}
+
+	if err := Login(cmd.Context(), server, username, password); err != nil {
+		return err
+	}
+
+	fmt.Println("Login Succeeded")
+	return nil
+}
+
+func LogoutCommand(cmd *cobra.Command, args []string) error {
+	server := name.DefaultRegistry
+	if len(args) != 0 {
+		server = args[0]
+	}
+
+	if err := Logout(server); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removing login credentials for %s\n", server)
+	return nil
+}
+
+// readPassword reads a line from the terminal without echoing it
+func readPassword(stdin *bufio.Reader) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		silent := *termios
+		silent.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &silent); err != nil {
+			return "", err
+		}
+		defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Login checks the credentials with the registry and stores them
+func Login(ctx context.Context, server string, username string, password string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+
+	reg, err := parseRegistry(server)
+	if err != nil {
+		return err
+	}
+
+	auth := authn.FromConfig(authn.AuthConfig{Username: username, Password: password})
+	if err := checkLogin(ctx, reg, auth); err != nil {
+		return fmt.Errorf("login %s: %w", reg.RegistryStr(), err)
+	}
+
+	cf, err := dockerconfig.Load(dockerconfig.Dir())
+	if err != nil {
+		return err
+	}
+
+	key := credentialsKey(reg)
+	return cf.GetCredentialsStore(key).Store(types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: key,
+	})
+}
+
+// Logout removes the stored credentials of the registry
+func Logout(server string) error {
+	reg, err := parseRegistry(server)
+	if err != nil {
+		return err
+	}
+
+	cf, err := dockerconfig.Load(dockerconfig.Dir())
+	if err != nil {
+		return err
+	}
+
+	key := credentialsKey(reg)
+	store := cf.GetCredentialsStore(key)
+	if auth, err := store.Get(key); err != nil || (auth.Username == "" && auth.IdentityToken == "") {
+		return fmt.Errorf("%w to %s", ErrNotLoggedIn, reg.RegistryStr())
+	}
+
+	return store.Erase(key)
+}
+
+// parseRegistry accepts the server of docker login, e.g. https://registry.example.com/v2/
+func parseRegistry(server string) (name.Registry, error) {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server, _, _ = strings.Cut(server, "/")
+	if server == "docker.io" {
+		server = name.DefaultRegistry
+	}
+
+	if config.Registry(server).Insecure {
+		return name.NewRegistry(server, name.Insecure)
+	}
+	return name.NewRegistry(server)
+}
+
+// credentialsKey is the key of the registry in config.json, Docker Hub has a legacy one
+func credentialsKey(reg name.Registry) string {
+	if reg.RegistryStr() == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return reg.RegistryStr()
+}
+
+// checkLogin authenticates like docker login: the token of a bearer registry is fetched,
+// the credentials of a basic one are checked by the base endpoint /v2/
+func checkLogin(ctx context.Context, reg name.Registry, auth authn.Authenticator) error {
+	t, err := registryTransport(reg.RegistryStr())
+	if err != nil {
+		return err
+	}
+
+	rt, err := transport.NewWithContext(ctx, reg, auth, t, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr()), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return transport.CheckError(resp, http.StatusOK)
+}
+
+// authOption selects the credentials of a registry request, the stored ones when
+// auth is nil
+func authOption(auth authn.Authenticator) remote.Option {
+	if auth != nil {
+		return remote.WithAuth(auth)
+	}
+	return remote.WithAuthFromKeychain(authn.DefaultKeychain)
+}
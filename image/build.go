@@ -0,0 +1,98 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// AnnotationBuildCache is the cache key of the image of a build step. The descriptor
+// has no name, so the build cache is removed by image prune.
+const AnnotationBuildCache = "tech.aproton.container.build.cache"
+
+// FindBuildCache returns the image of the build step with the cache key, the caller
+// holds the repository lock
+func FindBuildCache(key string) (v1.Image, error) {
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range imf.Manifests {
+		if desc.MediaType.IsImage() && desc.Annotations[AnnotationBuildCache] == key {
+			return lp.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%w: build cache %s", ErrImageNotFound, key)
+}
+
+// StoreBuildCache writes the image of a build step into the repository under the cache
+// key, the returned image is the one read from the repository
+func StoreBuildCache(img v1.Image, key string) (v1.Image, error) {
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeImageBlobs(lp, img); err != nil {
+		return nil, err
+	}
+
+	desc, err := partial.Descriptor(img)
+	if err != nil {
+		return nil, err
+	}
+	desc.Annotations = map[string]string{AnnotationBuildCache: key}
+
+	err = updateIndex(lp, func(ii v1.ImageIndex) v1.ImageIndex {
+		stale := func(desc v1.Descriptor) bool { return desc.Annotations[AnnotationBuildCache] == key }
+		return mutate.AppendManifests(mutate.RemoveManifests(ii, stale), mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: *desc,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lp.Image(desc.Digest)
+}
+
+// StoreImage writes the built image into the repository with the name, the image which
+// had the name before is removed
+func StoreImage(img v1.Image, image string) (*ImageSummary, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := replaceImage(lp, img, ref.Name(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := newImageSummary(lp, *desc)
+	if err != nil {
+		return nil, err
+	}
+
+	emitImageEvent(ref.Name(), "build", nil)
+	return summary, nil
+}
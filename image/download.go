@@ -0,0 +1,181 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultMaxConcurrentDownloads is the number of layers downloaded at the same time
+const DefaultMaxConcurrentDownloads = 3
+
+// how often the download of a layer is tried, and how long it waits before the next try
+const (
+	downloadAttempts     = 5
+	downloadRetryBackoff = time.Second
+)
+
+// the status of a layer in PullProgress
+const (
+	ProgressWaiting       = "Waiting"
+	ProgressDownloading   = "Downloading"
+	ProgressRetrying      = "Retrying"
+	ProgressComplete      = "Download complete"
+	ProgressAlreadyExists = "Already exists"
+)
+
+// PullProgress is the progress of a layer of the pulled image
+type PullProgress struct {
+	// ID is the short digest of the layer
+	ID     string
+	Status string
+	// Current is the bytes downloaded and Total the size of the layer
+	Current int64
+	Total   int64
+	// Error is the failure of the last try when Status is ProgressRetrying
+	Error error
+}
+
+// blobFetcher downloads the blobs of a repository, a download may start at an offset
+type blobFetcher struct {
+	repo   name.Repository
+	client *http.Client
+}
+
+func newBlobFetcher(ctx context.Context, repo name.Repository, auth authn.Authenticator) (*blobFetcher, error) {
+	t, err := registryTransport(repo.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		if auth, err = authn.Resolve(ctx, authn.DefaultKeychain, repo); err != nil {
+			return nil, err
+		}
+	}
+
+	rt, err := transport.NewWithContext(ctx, repo.Registry, auth, t, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobFetcher{repo: repo, client: &http.Client{Transport: rt}}, nil
+}
+
+// open returns the content of the blob of size from offset, when the registry ignores or
+// rejects the range it is the whole blob and the returned offset is 0
+func (f *blobFetcher) open(ctx context.Context, digest v1.Hash, size int64, offset int64) (io.ReadCloser, int64, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", f.repo.Scheme(), f.repo.RegistryStr(), f.repo.RepositoryStr(), digest.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		// some registries only understand a range with an end
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, size-1))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		if offset > 0 && ctx.Err() == nil {
+			return f.open(ctx, digest, size, 0)
+		}
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, offset, nil
+	}
+	return resp.Body, 0, nil
+}
+
+// downloadLayers downloads the layers of the image into the repository, at most parallel
+// at the same time. A failed download is tried again from where it stopped.
+func downloadLayers(ctx context.Context, lp layout.Path, img v1.Image, fetcher *blobFetcher, parallel int, progress func(PullProgress)) error {
+	if progress == nil {
+		progress = func(PullProgress) {}
+	}
+	if parallel <= 0 {
+		parallel = DefaultMaxConcurrentDownloads
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	type pendingLayer struct {
+		id     string
+		digest v1.Hash
+		size   int64
+	}
+
+	pending := []pendingLayer{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+
+		id := digest.Hex[:12]
+		if hasBlob(filepath.Join(string(lp), "blobs", digest.Algorithm, digest.Hex), size) {
+			progress(PullProgress{ID: id, Status: ProgressAlreadyExists, Current: size, Total: size})
+			continue
+		}
+		progress(PullProgress{ID: id, Status: ProgressWaiting, Total: size})
+		pending = append(pending, pendingLayer{id: id, digest: digest, size: size})
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(parallel)
+
+	for _, layer := range pending {
+		group.Go(func() error {
+			open := func(offset int64) (io.ReadCloser, int64, error) {
+				return fetcher.open(ctx, layer.digest, layer.size, offset)
+			}
+			written := func(n int64) {
+				progress(PullProgress{ID: layer.id, Status: ProgressDownloading, Current: n, Total: layer.size})
+			}
+
+			for attempt := 1; ; attempt++ {
+				err := storeBlob(lp, layer.digest, layer.size, open, written)
+				if err == nil {
+					progress(PullProgress{ID: layer.id, Status: ProgressComplete, Current: layer.size, Total: layer.size})
+					return nil
+				}
+				if ctx.Err() != nil || attempt == downloadAttempts {
+					return fmt.Errorf("download layer %s: %w", layer.digest.String(), err)
+				}
+
+				progress(PullProgress{ID: layer.id, Status: ProgressRetrying, Total: layer.size, Error: err})
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Duration(attempt) * downloadRetryBackoff):
+				}
+			}
+		})
+	}
+
+	return group.Wait()
+}
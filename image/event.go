@@ -0,0 +1,30 @@
+package image
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/events"
+)
+
+// emitImageEvent reports a change of the image to the log, the subscribers of
+// the events package and the handler of the caller
+func emitImageEvent(name string, action string, handler events.Handler) {
+	logrus.WithFields(logrus.Fields{
+		"type":   "image",
+		"action": action,
+		"id":     name,
+	}).Infof("event: image %s %s", action, name)
+
+	event := events.Event{
+		Type:   events.TypeImage,
+		Action: action,
+		ID:     name,
+		Time:   time.Now(),
+	}
+	events.Publish(event)
+	if handler != nil {
+		handler(event)
+	}
+}
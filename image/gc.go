@@ -0,0 +1,323 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+// temporary files younger than this may belong to a running pull or extraction
+const tempFileExpiration = time.Hour
+
+// GCReport lists what garbage collection removed, or would remove in dry-run mode
+type GCReport struct {
+	Images []string  `json:"images"`
+	Blobs  []v1.Hash `json:"blobs"`
+	Lowers []string  `json:"lowers"`
+	Temps  []string  `json:"temps"`
+	Bytes  uint64    `json:"bytes"`
+}
+
+// PruneImages removes the images without a name, and all images not used by any
+// container when all is set, then collects the blobs and layers left behind
+func PruneImages(all bool, inUse map[string]bool, dryRun bool) (*GCReport, error) {
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	isPruned := func(desc v1.Descriptor) bool {
+		name, ok := desc.Annotations[oci.AnnotationRefName]
+		return !ok || (all && !inUse[name])
+	}
+
+	images := []string{}
+	for _, desc := range imf.Manifests {
+		if !isPruned(desc) {
+			continue
+		}
+
+		if name, ok := desc.Annotations[oci.AnnotationRefName]; ok {
+			images = append(images, name)
+		} else {
+			images = append(images, desc.Digest.String())
+		}
+	}
+
+	if !dryRun && len(images) != 0 {
+		if err := removeDescriptors(lp, isPruned); err != nil {
+			return nil, err
+		}
+	}
+
+	// in dry-run mode the images are still in the index, skip them when marking
+	report, err := collectGarbage(lp, isPruned, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Images = images
+	return report, nil
+}
+
+// GarbageCollect marks every blob and layer reachable from the repository index and
+// sweeps the others: unreferenced manifests, configs and layer blobs, extracted
+// lower directories not used by any image or container, and stale temporary files
+func GarbageCollect(dryRun bool) (*GCReport, error) {
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return collectGarbage(lp, nil, dryRun)
+}
+
+func collectGarbage(lp layout.Path, skip match.Matcher, dryRun bool) (*GCReport, error) {
+	blobs, diffIDs, err := markImageBlobs(lp, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := GetLayerRefs()
+	if err != nil {
+		return nil, err
+	}
+	for hex := range refs {
+		diffIDs[hex] = true
+	}
+
+	report := &GCReport{Images: []string{}, Blobs: []v1.Hash{}, Lowers: []string{}, Temps: []string{}}
+
+	if err := sweepBlobs(lp, blobs, report, dryRun); err != nil {
+		return nil, err
+	}
+
+	if err := sweepDirs(ImageLowerPath(), func(entry os.DirEntry) bool {
+		return !diffIDs[entry.Name()]
+	}, &report.Lowers, &report.Bytes, dryRun); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := removeDanglingLayerLinks(); err != nil {
+			return nil, err
+		}
+		// no blob is written while the repository is locked exclusive, none of their locks is held
+		if err := os.RemoveAll(blobLockPath()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sweepTempFiles(report, dryRun); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// RemoveStaleTempFiles removes the temporary files left by interrupted pulls and extractions,
+// it is skipped when the repository is in use
+func RemoveStaleTempFiles() error {
+	if err := os.MkdirAll(config.Get().Root, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := utils.TryLockFile(repositoryLockFile(), true)
+	if err != nil {
+		if errors.Is(err, utils.ErrLocked) {
+			return nil
+		}
+		return err
+	}
+	defer unlock()
+
+	return sweepTempFiles(&GCReport{}, false)
+}
+
+func sweepTempFiles(report *GCReport, dryRun bool) error {
+	return sweepDirs(TempPath(), func(entry os.DirEntry) bool {
+		fi, err := entry.Info()
+		return err == nil && time.Since(fi.ModTime()) > tempFileExpiration
+	}, &report.Temps, &report.Bytes, dryRun)
+}
+
+// markImageBlobs returns the digests of all blobs and the hex of all diffIDs reachable from the index
+func markImageBlobs(lp layout.Path, skip match.Matcher) (map[v1.Hash]bool, map[string]bool, error) {
+	blobs := map[v1.Hash]bool{}
+	diffIDs := map[string]bool{}
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := markIndex(ii, skip, blobs, diffIDs); err != nil {
+		return nil, nil, err
+	}
+
+	return blobs, diffIDs, nil
+}
+
+func markIndex(ii v1.ImageIndex, skip match.Matcher, blobs map[v1.Hash]bool, diffIDs map[string]bool) error {
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range imf.Manifests {
+		if skip != nil && skip(desc) {
+			continue
+		}
+		blobs[desc.Digest] = true
+
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := ii.ImageIndex(desc.Digest)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			if err := markIndex(child, nil, blobs, diffIDs); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			img, err := ii.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := markImage(img, blobs, diffIDs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func markImage(img v1.Image, blobs map[v1.Hash]bool, diffIDs map[string]bool) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		// the manifest of a platform which was not pulled is not in the repository
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	blobs[manifest.Config.Digest] = true
+	for _, layer := range manifest.Layers {
+		blobs[layer.Digest] = true
+	}
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+
+	for _, diffID := range config.RootFS.DiffIDs {
+		diffIDs[diffID.Hex] = true
+	}
+
+	return nil
+}
+
+func sweepBlobs(lp layout.Path, keep map[v1.Hash]bool, report *GCReport, dryRun bool) error {
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		entries, err := os.ReadDir(filepath.Join(string(lp), "blobs", algorithm))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			hash := v1.Hash{Algorithm: algorithm, Hex: entry.Name()}
+			if keep[hash] {
+				continue
+			}
+
+			if fi, err := entry.Info(); err == nil {
+				report.Bytes += uint64(fi.Size())
+			}
+			report.Blobs = append(report.Blobs, hash)
+
+			if !dryRun {
+				logrus.Infof("remove blob %s", hash.String())
+				if err := lp.RemoveBlob(hash); err != nil {
+					return fmt.Errorf("remove blob %s: %w", hash.String(), err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func sweepDirs(dir string, isGarbage func(os.DirEntry) bool, removed *[]string, bytes *uint64, dryRun bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if !isGarbage(entry) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		size, err := utils.DiskUsage(path)
+		if err != nil {
+			return err
+		}
+
+		*bytes += size
+		*removed = append(*removed, path)
+
+		if !dryRun {
+			logrus.Infof("remove %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
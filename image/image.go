@@ -2,31 +2,40 @@ package image
 
 import (
 	"archive/tar"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"github.com/google/go-containerregistry/pkg/v1/types"
-	"github.com/lithammer/shortuuid"
-	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"aproton.tech/container/config"
 	"aproton.tech/container/utils"
 )
 
-const SandboxPath = "var/sandbox"
-const RepositoryPath = "var/repositories"
-const ImageLowerPath = "var/overlay/lower"
-const TempPath = "var/tmp"
+func SandboxPath() string {
+	return config.RootPath("sandbox")
+}
+
+func RepositoryPath() string {
+	return config.RootPath("repositories")
+}
+
+func ImageLowerPath() string {
+	return config.RootPath("overlay", "lower")
+}
+
+func TempPath() string {
+	return config.RootPath("tmp")
+}
 
 func ImageCommand() *cobra.Command {
 	cmd := &cobra.Command{
@@ -35,18 +44,40 @@ func ImageCommand() *cobra.Command {
 		Short:   "image commands",
 	}
 
-	cmd.AddCommand(&cobra.Command{
+	list := &cobra.Command{
 		Use:     "list images",
 		Aliases: []string{"ls"},
 		Short:   "list images",
-		Run:     ListImageCommand,
-	})
+		RunE:    ListImageCommand,
+	}
+	list.Flags().Bool("digests", false, "Show the digests the images were pulled by")
+	cmd.AddCommand(list)
 
-	cmd.AddCommand(&cobra.Command{
+	pull := &cobra.Command{
 		Use:   "pull image",
 		Short: "pull image",
 		Args:  cobra.ExactArgs(1),
-		Run:   PullImageCommand,
+		RunE:  PullImageCommand,
+	}
+	pull.Flags().String("platform", "", "Pull the image of the platform os/arch[/variant], e.g. linux/arm64 (default the host platform)")
+	pull.Flags().Bool("all-platforms", false, "Pull the images of all platforms of a multi-platform image")
+	pull.Flags().BoolP("quiet", "q", false, "Suppress the progress output, only print the image name")
+	pull.Flags().Duration("timeout", DefaultPullTimeout, "Give up when the pull takes longer")
+	pull.Flags().Int("max-concurrent-downloads", DefaultMaxConcurrentDownloads, "Number of layers downloaded at the same time")
+	cmd.AddCommand(pull)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "push image",
+		Short: "push image to its registry",
+		Args:  cobra.ExactArgs(1),
+		RunE:  PushImageCommand,
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "inspect image [image...]",
+		Short: "show the details of images",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  InspectImageCommand,
 	})
 
 	cmd.AddCommand(&cobra.Command{
@@ -54,21 +85,21 @@ func ImageCommand() *cobra.Command {
 		Short:   "remove image",
 		Aliases: []string{"rm"},
 		Args:    cobra.ExactArgs(1),
-		Run:     RemoveImageCommand,
+		RunE:    RemoveImageCommand,
 	})
 
 	cmd.AddCommand(&cobra.Command{
 		Use:   "tag image new_name",
 		Short: "rename image",
 		Args:  cobra.ExactArgs(2),
-		Run:   TagImageCommand,
+		RunE:  TagImageCommand,
 	})
 
 	load := &cobra.Command{
 		Use:   "load image -i file.tar.gz",
 		Short: "load image",
 		Args:  cobra.NoArgs,
-		Run:   LoadImageCommand,
+		RunE:  LoadImageCommand,
 	}
 	load.Flags().StringP("input", "i", "", "--input=file.tar.gz")
 
@@ -76,7 +107,7 @@ func ImageCommand() *cobra.Command {
 		Use:   "save [OPTIONS] IMAGE [IMAGE...]\nSave one or more images to a tar archive (streamed to STDOUT by default)",
 		Short: "save image",
 		Args:  cobra.MinimumNArgs(1),
-		Run:   SaveImageCommand,
+		RunE:  SaveImageCommand,
 	}
 	save.Flags().StringP("output", "o", "", "Write to a file, instead of STDOUT")
 
@@ -86,87 +117,73 @@ func ImageCommand() *cobra.Command {
 	return cmd
 }
 
-func GetImage(image string, forcePull bool) (v1.Image, error) {
+// ErrImageNotFound is wrapped by the errors of an image which is not in the repository
+var ErrImageNotFound = errors.New("no such image")
+
+// GetImage returns the image from the repository and its platform, it is pulled when it is
+// not there, when forcePull is set or when it is not for the platform. The platform is
+// os/arch[/variant], any platform of an image in the repository is used when it is empty.
+func GetImage(ctx context.Context, image string, platform string, forcePull bool) (v1.Image, *v1.Platform, error) {
 	ref, err := name.ParseReference(image)
-	utils.Assert(err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	want, err := requestedPlatform(platform)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	lp, err := Repository()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if !forcePull {
-		// check image is exists
 		ii, err := lp.ImageIndex()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		imf, err := ii.IndexManifest()
-		if err != nil {
-			return nil, err
-		}
-
-		for _, img := range imf.Manifests {
-			if img.MediaType == types.DockerManifestSchema2 || img.MediaType == types.OCIManifestSchema1 {
-				if name, ok := img.Annotations[oci.AnnotationRefName]; ok && name == ref.Name() {
-					return lp.Image(img.Digest)
-				}
+		desc, err := findDescriptor(ii, ref)
+		if err == nil {
+			img, found, err := resolveImage(lp, *desc, want)
+			if err == nil && (platform == "" || found == nil || platformRank(want, *found) >= 0) {
+				return img, found, nil
+			}
+			if err == nil {
+				logrus.Infof("image %s is for platform %s, pull it for %s", ref.Name(), found.String(), want.String())
+			} else {
+				logrus.Infof("image %s: %v, pull it", ref.Name(), err)
 			}
+		} else if !errors.Is(err, ErrImageNotFound) {
+			return nil, nil, err
 		}
 	}
 
-	return doPullImage(ref)
+	desc, err := pullImage(ctx, ref, PullOptions{Platform: platform})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resolveImage(lp, *desc, want)
 }
 
-func BuildSandbox(img v1.Image, sboxID string) string {
-	newsdx := path.Join(SandboxPath, sboxID)
+func BuildSandbox(img v1.Image, sboxID string) (string, error) {
+	newsdx := path.Join(SandboxPath(), sboxID)
 
 	rc := mutate.Extract(img)
 	defer rc.Close()
 
-	utils.Assert(os.MkdirAll(newsdx, 0755))
+	if err := os.MkdirAll(newsdx, 0755); err != nil {
+		return "", err
+	}
 
 	if err := utils.Untar(rc, newsdx); err != nil {
 		os.RemoveAll(newsdx)
-		utils.Assert(err)
+		return "", fmt.Errorf("extract image: %w", err)
 	}
 
-	return newsdx
-}
-
-func FlatImageFiles(img v1.Image) []string {
-	hash, err := img.Digest()
-	utils.Assert(err)
-
-	path := filepath.Join(ImageLowerPath, hash.Hex)
-	_, err = os.Stat(path)
-
-	if err == nil {
-		return []string{path}
-	}
-
-	if errors.Is(err, os.ErrNotExist) {
-		tmp := filepath.Join(TempPath, shortuuid.New())
-		utils.Assert(os.MkdirAll(tmp, 0755))
-
-		rc := mutate.Extract(img)
-		defer rc.Close()
-
-		if err := utils.Untar(rc, tmp); err != nil {
-			os.RemoveAll(tmp)
-			utils.Assert(err)
-		}
-
-		utils.Assert(os.MkdirAll(ImageLowerPath, 0755))
-		if err := os.Rename(tmp, path); err != nil {
-			// file path is exists
-			_, err := os.Stat(path)
-			utils.Assert(err)
-		}
-	}
-
-	return []string{path}
+	return newsdx, nil
 }
 
 func GetImageConfig(img v1.Image) (*v1.Config, error) {
@@ -178,19 +195,6 @@ func GetImageConfig(img v1.Image) (*v1.Config, error) {
 	return config.Config.DeepCopy(), nil
 }
 
-func Repository() (layout.Path, error) {
-	lp, err := layout.FromPath(RepositoryPath)
-
-	if err != nil {
-		lp, err = layout.Write(RepositoryPath, empty.Index)
-		if err != nil {
-			return "", err
-		}
-	}
-
-	return lp, nil
-}
-
 func findTagNameInFile(tarFile string) (string, error) {
 	file, err := os.Open(tarFile)
 	if err != nil {
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+// ImageDetail is an image of the repository with its config, the config of an index
+// is the one of the image of the host platform, it is nil when there is none
+type ImageDetail struct {
+	ImageSummary
+	Config *v1.ConfigFile `json:"config"`
+}
+
+func InspectImageCommand(cmd *cobra.Command, args []string) error {
+	errs := []error{}
+	found := []*ImageDetail{}
+	for _, image := range args {
+		detail, err := InspectImage(image)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		found = append(found, detail)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(found); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+// InspectImage returns the image with the name from the repository
+func InspectImage(image string) (*ImageDetail, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := findDescriptor(ii, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := newImageSummary(lp, *desc)
+	if err != nil {
+		return nil, err
+	}
+	detail := &ImageDetail{ImageSummary: *summary}
+
+	// the config of an index is the one of the image which runs on the host
+	img, _, err := resolveImage(lp, *desc, HostPlatform())
+	if err == nil {
+		if detail.Config, err = img.ConfigFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return detail, nil
+}
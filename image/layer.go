@@ -0,0 +1,247 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/lithammer/shortuuid"
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+// LayerRefsFile records which containers use every extracted layer, diffID -> container ids
+func LayerRefsFile() string {
+	return config.RootPath("overlay", "layers.json")
+}
+
+// ExtractImageLayers extracts every layer of the image once into ImageLowerPath/<diffID>,
+// layers shared by images are stored only once. The returned paths are ordered
+// from the top-most layer to the base one, which is the order of overlay lowerdir.
+func ExtractImageLayers(img v1.Image) ([]string, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := extractLayer(layer, diffID)
+		if err != nil {
+			return nil, fmt.Errorf("extract layer %s: %w", diffID.String(), err)
+		}
+
+		paths = append([]string{path}, paths...)
+	}
+
+	return paths, nil
+}
+
+func GetLayerPath(diffID v1.Hash) string {
+	return filepath.Join(ImageLowerPath(), diffID.Hex)
+}
+
+// layerLinkLength is the length of the short name of a layer, like the l/ directory of docker
+const layerLinkLength = 26
+
+// LayerLinkPath keeps a short symlink to every extracted layer, the lowerdir option of
+// overlay is limited to one page, with the short names an image can have many layers
+func LayerLinkPath() string {
+	return config.RootPath("overlay", "l")
+}
+
+// GetLayerLink returns the short link of the layer, relative to the overlay directory
+func GetLayerLink(diffID v1.Hash) string {
+	return filepath.Join(filepath.Base(LayerLinkPath()), diffID.Hex[:layerLinkLength])
+}
+
+func linkLayer(diffID v1.Hash) error {
+	if err := os.MkdirAll(LayerLinkPath(), 0755); err != nil {
+		return err
+	}
+
+	link := filepath.Join(LayerLinkPath(), diffID.Hex[:layerLinkLength])
+	target := filepath.Join("..", filepath.Base(ImageLowerPath()), diffID.Hex)
+	if err := os.Symlink(target, link); err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		if current, err := os.Readlink(link); err != nil || current != target {
+			return fmt.Errorf("layer link %s does not point to %s", link, target)
+		}
+	}
+	return nil
+}
+
+// removeDanglingLayerLinks removes the links of the layers which were removed
+func removeDanglingLayerLinks() error {
+	entries, err := os.ReadDir(LayerLinkPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		link := filepath.Join(LayerLinkPath(), entry.Name())
+		if _, err := os.Stat(link); errors.Is(err, os.ErrNotExist) {
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func extractLayer(layer v1.Layer, diffID v1.Hash) (string, error) {
+	path := GetLayerPath(diffID)
+	if _, err := os.Stat(path); err == nil {
+		return path, linkLayer(diffID)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	logrus.Infof("extract layer %s", diffID.String())
+
+	tmp := filepath.Join(TempPath(), shortuuid.New())
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	defer rc.Close()
+
+	if err := utils.Untar(rc, tmp, utils.WithOverlayWhiteouts()); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	if err := os.MkdirAll(ImageLowerPath(), 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		// the same layer was extracted by another process
+		os.RemoveAll(tmp)
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+	}
+
+	return path, linkLayer(diffID)
+}
+
+// RetainLayers adds the container to the users of the layers
+func RetainLayers(owner string, diffIDs []v1.Hash) error {
+	unlock, err := lockLayerRefs()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	refs, err := GetLayerRefs()
+	if err != nil {
+		return err
+	}
+
+	for _, diffID := range diffIDs {
+		if !slices.Contains(refs[diffID.Hex], owner) {
+			refs[diffID.Hex] = append(refs[diffID.Hex], owner)
+		}
+	}
+
+	return saveLayerRefs(refs)
+}
+
+// ReleaseLayers removes the container from the users of all layers, and returns
+// the layers which are not used by any container now
+func ReleaseLayers(owner string) ([]string, error) {
+	unlock, err := lockLayerRefs()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	refs, err := GetLayerRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	unused := []string{}
+	for diffID, owners := range refs {
+		if idx := slices.Index(owners, owner); idx >= 0 {
+			refs[diffID] = slices.Delete(owners, idx, idx+1)
+			if len(refs[diffID]) == 0 {
+				delete(refs, diffID)
+				unused = append(unused, diffID)
+			}
+		}
+	}
+
+	return unused, saveLayerRefs(refs)
+}
+
+// GetLayerRefs returns the containers which use every layer, keyed by the hex of diffID
+func GetLayerRefs() (map[string][]string, error) {
+	refs := map[string][]string{}
+
+	content, err := os.ReadFile(LayerRefsFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return refs, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &refs); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+func saveLayerRefs(refs map[string][]string) error {
+	content, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(LayerRefsFile()), 0755); err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(LayerRefsFile(), content, 0644)
+}
+
+func lockLayerRefs() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(LayerRefsFile()), 0755); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(LayerRefsFile()+".lock", true)
+}
+
+func GetImageDiffIDs(img v1.Image) ([]v1.Hash, error) {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return config.RootFS.DiffIDs, nil
+}
@@ -1,42 +1,209 @@
 package image
 
 import (
-	"errors"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/olekukonko/tablewriter"
 	oci "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 	"k8s.io/kubernetes/pkg/util/parsers"
-
-	"aproton.tech/container/utils"
 )
 
-func ListImageCommand(cmd *cobra.Command, args []string) {
+// ImageSummary describes an image of the repository. Digest is the one of its manifest,
+// or of its index when the images of all platforms were pulled, and RepoDigest the one
+// it was pulled by. Platform is os/arch[/variant], the platforms of an index are
+// separated by commas.
+type ImageSummary struct {
+	Name       string    `json:"name"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     v1.Hash   `json:"digest"`
+	RepoDigest string    `json:"repoDigest,omitempty"`
+	Platform   string    `json:"platform,omitempty"`
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`
+}
+
+func ListImageCommand(cmd *cobra.Command, args []string) error {
+	images, err := ListImages()
+	if err != nil {
+		return err
+	}
+
+	digests := cmd.Flag("digests").Value.String() == "true"
+	table := newImageListTableRender(digests)
+	for _, img := range images {
+		row := []string{img.Repository, valueOrNone(img.Tag)}
+		if digests {
+			row = append(row, valueOrNone(img.RepoDigest))
+		}
+		table.Append(append(row,
+			img.Digest.Hex[:12],
+			img.Platform,
+			humanize.Bytes(uint64(img.Size)),
+		))
+	}
+	table.Render()
+	return nil
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
+
+// ListImages returns the named images of the repository
+func ListImages() ([]*ImageSummary, error) {
 	lp, err := Repository()
-	utils.Assert(err)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	ii, err := lp.ImageIndex()
-	utils.Assert(err)
+	if err != nil {
+		return nil, err
+	}
 
 	imf, err := ii.IndexManifest()
-	utils.Assert(err)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*ImageSummary{}
+	for _, desc := range imf.Manifests {
+		if !isStoredImage(desc) {
+			continue
+		}
+		if _, ok := desc.Annotations[oci.AnnotationRefName]; !ok {
+			continue
+		}
 
-	table := newImageListTableRender()
-	for _, img := range imf.Manifests {
-		if row, err := newImageListRow(ii, &img); err == nil {
-			table.Append(row)
+		if summary, err := newImageSummary(lp, desc); err == nil {
+			images = append(images, summary)
 		}
 	}
-	table.Render()
+
+	return images, nil
+}
+
+// newImageSummary describes the named image or index of the repository index, the one of
+// an index sums up its pulled images
+func newImageSummary(lp layout.Path, desc v1.Descriptor) (*ImageSummary, error) {
+	name := desc.Annotations[oci.AnnotationRefName]
+	repository, tag, digest, err := parsers.ParseImageName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ImageSummary{
+		Name:       name,
+		Repository: repository,
+		Tag:        tag,
+		Digest:     desc.Digest,
+		RepoDigest: desc.Annotations[AnnotationRepoDigest],
+	}
+	if summary.RepoDigest == "" {
+		summary.RepoDigest = digest
+	}
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := ii.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := addImageSummary(summary, img, map[v1.Hash]bool{}); err != nil {
+			return nil, err
+		}
+		if platform := imagePlatform(&desc, img); platform != nil {
+			summary.Platform = platform.String()
+		}
+		return summary, nil
+	}
+
+	idx, err := ii.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := pulledManifests(lp, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := []string{}
+	counted := map[v1.Hash]bool{}
+	for _, child := range pulled {
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := addImageSummary(summary, img, counted); err != nil {
+			return nil, err
+		}
+		if platform := imagePlatform(&child, img); platform != nil {
+			platforms = append(platforms, platform.String())
+		}
+	}
+	summary.Platform = strings.Join(platforms, ",")
+
+	return summary, nil
+}
+
+// addImageSummary adds the layers of the image not counted yet to the size of the
+// summary, the created time is the one of the newest image
+func addImageSummary(summary *ImageSummary, img v1.Image, counted map[v1.Hash]bool) error {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	if config.Created.Time.After(summary.Created) {
+		summary.Created = config.Created.Time
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil || counted[digest] {
+			continue
+		}
+		if s, err := layer.Size(); err == nil {
+			summary.Size += s
+			counted[digest] = true
+		}
+	}
+
+	return nil
 }
 
-func newImageListTableRender() *tablewriter.Table {
+func newImageListTableRender(digests bool) *tablewriter.Table {
+	header := []string{"REPOSITORY", "TAG"}
+	if digests {
+		header = append(header, "DIGEST")
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"REPOSITORY", "TAG", "IMAGE ID", "SIZE"})
+	table.SetHeader(append(header, "IMAGE ID", "PLATFORM", "SIZE"))
 	table.SetAutoWrapText(false)
 	table.SetAutoFormatHeaders(true)
 	table.SetBorder(false)
@@ -50,41 +217,3 @@ func newImageListTableRender() *tablewriter.Table {
 
 	return table
 }
-
-func newImageListRow(ii v1.ImageIndex, img *v1.Descriptor) ([]string, error) {
-	if img.MediaType == types.DockerManifestSchema2 || img.MediaType == types.OCIManifestSchema1 {
-		if name, ok := img.Annotations[oci.AnnotationRefName]; ok {
-			repoToPull, tag, _, err := parsers.ParseImageName(name)
-			if err != nil {
-				return nil, err
-			}
-
-			real, err := ii.Image(img.Digest)
-			if err != nil {
-				return nil, err
-			}
-
-			layers, err := real.Layers()
-			if err != nil {
-				return nil, err
-			}
-
-			size := int64(0)
-			for _, layer := range layers {
-				s, err := layer.Size()
-				if err == nil {
-					size += s
-				}
-			}
-
-			return []string{
-				repoToPull,
-				tag,
-				img.Digest.String()[7:19],
-				humanize.Bytes(uint64(size)),
-			}, nil
-		}
-	}
-
-	return nil, errors.New("not image")
-}
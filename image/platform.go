@@ -0,0 +1,252 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/cpu"
+)
+
+// the directory of the emulators registered with binfmt_misc, e.g. by tonistiigi/binfmt
+const binfmtPath = "/proc/sys/fs/binfmt_misc"
+
+// ParsePlatform parses os/arch[/variant], the other spellings of an architecture are
+// normalized to the ones of the registries, e.g. linux/aarch64 is linux/arm64
+func ParsePlatform(platform string) (*v1.Platform, error) {
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %q: %w", platform, err)
+	}
+	if p.OS == "" || p.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", platform)
+	}
+
+	normalized := normalizePlatform(*p)
+	return &normalized, nil
+}
+
+// HostPlatform is the platform of the images which run natively
+func HostPlatform() v1.Platform {
+	p := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = hostArmVariant()
+	}
+	return normalizePlatform(p)
+}
+
+// requestedPlatform parses the platform of the options, the host one when it is empty
+func requestedPlatform(platform string) (v1.Platform, error) {
+	if platform == "" {
+		return HostPlatform(), nil
+	}
+
+	p, err := ParsePlatform(platform)
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	return *p, nil
+}
+
+// normalizePlatform returns the platform like it is written in the index of a registry:
+// arm without variant is arm/v7 and the default variant of amd64 and arm64 is omitted
+func normalizePlatform(p v1.Platform) v1.Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+
+	switch p.Architecture {
+	case "i386", "i486", "i586", "i686", "x86":
+		p.Architecture, p.Variant = "386", ""
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+
+	switch p.Architecture {
+	case "amd64":
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	case "arm64":
+		if p.Variant == "8" || p.Variant == "v8" {
+			p.Variant = ""
+		}
+	case "arm":
+		switch p.Variant {
+		case "", "7":
+			p.Variant = "v7"
+		case "5", "6", "8":
+			p.Variant = "v" + p.Variant
+		}
+	}
+
+	return p
+}
+
+// platformRank tells how well an image of platform have suits the wanted one, it is
+// negative when the image does not run there. The wanted variant matches best, then
+// the older variants of the architecture from the newest, and an image without variant.
+func platformRank(want v1.Platform, have v1.Platform) int {
+	want, have = normalizePlatform(want), normalizePlatform(have)
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return -1
+	}
+	if want.OSVersion != "" && want.OSVersion != have.OSVersion {
+		return -1
+	}
+	if !containsAll(have.OSFeatures, want.OSFeatures) || !containsAll(have.Features, want.Features) {
+		return -1
+	}
+
+	if want.Variant == have.Variant {
+		return 100
+	}
+	if have.Variant == "" {
+		return 1
+	}
+
+	// a CPU runs the code of the older variants of its architecture
+	wantLevel, ok := variantLevel(want)
+	if !ok {
+		return -1
+	}
+	haveLevel, ok := variantLevel(have)
+	if !ok || haveLevel > wantLevel {
+		return -1
+	}
+	return 100 - (wantLevel - haveLevel)
+}
+
+// variantLevel returns the number of a variant vN, the default variant of the
+// architecture when there is none
+func variantLevel(p v1.Platform) (int, bool) {
+	variant := p.Variant
+	if variant == "" {
+		switch p.Architecture {
+		case "amd64":
+			variant = "v1"
+		case "arm64":
+			variant = "v8"
+		default:
+			return 0, false
+		}
+	}
+
+	level, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	if err != nil || !strings.HasPrefix(variant, "v") {
+		return 0, false
+	}
+	return level, true
+}
+
+func containsAll(values []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			if v == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// imagePlatform returns the platform recorded in the descriptor of the image,
+// or the one of its config
+func imagePlatform(desc *v1.Descriptor, img v1.Image) *v1.Platform {
+	if desc != nil && desc.Platform != nil {
+		return desc.Platform
+	}
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil
+	}
+	return config.Platform()
+}
+
+// PlatformWarning returns why an image of the platform may not run on the host,
+// it is empty when it runs natively or by an emulator registered with binfmt_misc
+func PlatformWarning(platform string) string {
+	if platform == "" {
+		return ""
+	}
+
+	p, err := ParsePlatform(platform)
+	if err != nil {
+		return ""
+	}
+
+	host := HostPlatform()
+	if platformRank(host, *p) >= 0 || (host.Architecture == "amd64" && p.Architecture == "386" && p.OS == host.OS) {
+		return ""
+	}
+
+	if p.OS == host.OS {
+		if emulator, ok := binfmtEmulator(p.Architecture); ok {
+			return fmt.Sprintf("the platform %s of the image is run by the emulator %s", p.String(), emulator)
+		}
+	}
+
+	return fmt.Sprintf("the platform %s of the image does not match the host platform %s and no emulator is registered", p.String(), host.String())
+}
+
+// binfmtEmulator returns the interpreter of the enabled qemu emulator of the architecture
+func binfmtEmulator(arch string) (string, bool) {
+	qemuArch, ok := map[string]string{
+		"amd64":    "x86_64",
+		"386":      "i386",
+		"arm64":    "aarch64",
+		"arm":      "arm",
+		"ppc64le":  "ppc64le",
+		"s390x":    "s390x",
+		"riscv64":  "riscv64",
+		"mips64le": "mips64el",
+		"mips64":   "mips64",
+		"loong64":  "loongarch64",
+	}[arch]
+	if !ok {
+		return "", false
+	}
+
+	file, err := os.Open(filepath.Join(binfmtPath, "qemu-"+qemuArch))
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	enabled, interpreter := false, ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "enabled" {
+			enabled = true
+		} else if value, ok := strings.CutPrefix(line, "interpreter "); ok {
+			interpreter = value
+		}
+	}
+	return interpreter, enabled
+}
+
+// hostArmVariant returns the arm variant of the CPU, v7 unless it lacks the features of one
+func hostArmVariant() string {
+	if !cpu.ARM.HasVFPv3 && cpu.ARM.HasVFP {
+		return "v6"
+	}
+	return "v7"
+}
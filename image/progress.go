@@ -0,0 +1,127 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+// how often the progress is redrawn on a terminal, and printed in plain mode
+const (
+	progressRedrawInterval = 100 * time.Millisecond
+	progressPrintInterval  = 5 * time.Second
+)
+
+// progressPrinter shows the progress of the layers of a pull. On a terminal a line per
+// layer is redrawn in place, otherwise the changes of the status and the progress every
+// few seconds are printed as plain lines, e.g. for CI logs.
+type progressPrinter struct {
+	lock     sync.Mutex
+	out      *os.File
+	terminal bool
+
+	order  []string
+	layers map[string]*layerProgress
+	// the lines drawn on the terminal
+	lines  int
+	drawn  time.Time
+	closed bool
+}
+
+type layerProgress struct {
+	PullProgress
+	// the time and the bytes when the download started
+	started time.Time
+	base    int64
+	printed time.Time
+}
+
+func newProgressPrinter(out *os.File) *progressPrinter {
+	return &progressPrinter{out: out, terminal: isTerminal(out), layers: map[string]*layerProgress{}}
+}
+
+// isTerminal tells whether the progress printed to out can be redrawn
+func isTerminal(out *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(out.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func (p *progressPrinter) update(progress PullProgress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	layer, ok := p.layers[progress.ID]
+	if !ok {
+		layer = &layerProgress{}
+		p.layers[progress.ID] = layer
+		p.order = append(p.order, progress.ID)
+	}
+
+	changed := layer.Status != progress.Status
+	if progress.Status == ProgressDownloading && changed {
+		// the speed of a resumed download only counts the bytes of this try
+		layer.started, layer.base = time.Now(), progress.Current
+	}
+	layer.PullProgress = progress
+
+	if p.terminal {
+		if changed || time.Since(p.drawn) >= progressRedrawInterval {
+			p.draw()
+		}
+		return
+	}
+
+	if changed || time.Since(layer.printed) >= progressPrintInterval {
+		fmt.Fprintf(p.out, "%s: %s\n", layer.ID, formatProgress(layer))
+		layer.printed = time.Now()
+	}
+}
+
+// draw redraws the lines of all layers on the terminal
+func (p *progressPrinter) draw() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\033[%dA", p.lines)
+	}
+	for _, id := range p.order {
+		fmt.Fprintf(p.out, "\033[2K%s: %s\n", id, formatProgress(p.layers[id]))
+	}
+	p.lines = len(p.order)
+	p.drawn = time.Now()
+}
+
+// close draws the final state, the progress is not shown anymore
+func (p *progressPrinter) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.terminal && !p.closed && len(p.order) > 0 {
+		p.draw()
+	}
+	p.closed = true
+}
+
+func formatProgress(layer *layerProgress) string {
+	switch layer.Status {
+	case ProgressDownloading:
+		text := fmt.Sprintf("%s %s / %s", layer.Status, humanize.Bytes(uint64(layer.Current)), humanize.Bytes(uint64(layer.Total)))
+		if elapsed := time.Since(layer.started).Seconds(); elapsed > 0 && layer.Current > layer.base {
+			speed := float64(layer.Current-layer.base) / elapsed
+			text += fmt.Sprintf("  %s/s", humanize.Bytes(uint64(speed)))
+			if remaining := layer.Total - layer.Current; remaining > 0 {
+				text += fmt.Sprintf("  ETA %s", time.Duration(float64(remaining)/speed*float64(time.Second)).Round(time.Second))
+			}
+		}
+		return text
+	case ProgressRetrying:
+		return fmt.Sprintf("%s: %v", layer.Status, layer.Error)
+	}
+	return layer.Status
+}
@@ -4,112 +4,308 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"runtime"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
-	"github.com/google/go-containerregistry/pkg/v1/match"
-	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	oci "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
-	"aproton.tech/container/utils"
+	"aproton.tech/container/events"
 )
 
-func PullImageCommand(cmd *cobra.Command, args []string) {
-	ref, err := name.ParseReference(args[0])
-	utils.Assert(err)
+// PullOptions changes how an image is pulled
+type PullOptions struct {
+	// Auth authenticates to the registry, the credentials stored by login are used when it is nil
+	Auth authn.Authenticator
+	// Platform selects the image of a multi-platform image, os/arch[/variant], the host
+	// platform when it is empty
+	Platform string
+	// AllPlatforms keeps the whole index of a multi-platform image with the images of all
+	// its platforms, the platform to run is selected from it then
+	AllPlatforms bool
+	// Timeout limits the whole pull, DefaultPullTimeout when it is 0
+	Timeout time.Duration
+	// MaxConcurrentDownloads is the number of layers downloaded at the same time,
+	// DefaultMaxConcurrentDownloads when it is 0
+	MaxConcurrentDownloads int
+	// Progress receives the progress of every layer, it is called by concurrent downloads
+	Progress func(PullProgress)
+	// OnEvent receives the pull event of the image
+	OnEvent events.Handler
+}
+
+// DefaultPullTimeout is how long a pull may take
+const DefaultPullTimeout = time.Hour
+
+func PullImageCommand(cmd *cobra.Command, args []string) error {
+	timeout, err := time.ParseDuration(cmd.Flag("timeout").Value.String())
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	parallel, err := strconv.Atoi(cmd.Flag("max-concurrent-downloads").Value.String())
+	if err != nil || parallel <= 0 {
+		return fmt.Errorf("invalid max-concurrent-downloads %s", cmd.Flag("max-concurrent-downloads").Value.String())
+	}
+	quiet := cmd.Flag("quiet").Value.String() == "true"
+
+	opts := PullOptions{
+		Platform:               cmd.Flag("platform").Value.String(),
+		AllPlatforms:           cmd.Flag("all-platforms").Value.String() == "true",
+		Timeout:                timeout,
+		MaxConcurrentDownloads: parallel,
+	}
+	var printer *progressPrinter
+	if !quiet {
+		printer = newProgressPrinter(os.Stdout)
+		opts.Progress = printer.update
+	}
+
+	summary, err := PullImage(cmd.Context(), args[0], opts)
+	if printer != nil {
+		printer.close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if quiet {
+		fmt.Println(summary.Name)
+		return nil
+	}
+	fmt.Printf("Digest: %s\n", summary.Digest)
+	fmt.Printf("Status: Downloaded newer image for %s\n", summary.Name)
+	return nil
+}
+
+// PullImage pulls the image for the platform of the options into the repository,
+// an image with the same name is replaced
+func PullImage(ctx context.Context, image string, opts PullOptions) (*ImageSummary, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = doPullImage(ref)
+	desc, err := pullImage(ctx, ref, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	utils.Assert(err)
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+	return newImageSummary(lp, *desc)
 }
 
-func doPullImage(ref name.Reference) (v1.Image, error) {
+// pullImage returns the descriptor of the pulled image in the repository index
+func pullImage(ctx context.Context, ref name.Reference, opts PullOptions) (*v1.Descriptor, error) {
+	want, err := requestedPlatform(opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	if opts.AllPlatforms && opts.Platform != "" {
+		return nil, errors.New("a platform can not be selected when all platforms are pulled")
+	}
+
 	lp, err := Repository()
-	utils.Assert(err)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	logrus.Infof("Current Platform: OS=%s, Architecture=%s", runtime.GOOS, runtime.GOARCH)
+	logrus.Debugf("pull %s for platform %s", ref.Name(), want.String())
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPullTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	remoteOptions := []remote.Option{
-		remote.WithContext(ctx),
-		remote.WithTransport(remote.DefaultTransport),
-
-		remote.WithPlatform(v1.Platform{
-			OS:           runtime.GOOS,
-			Architecture: runtime.GOARCH,
-		}),
+	rmt, err := getRemoteImage(ctx, ref, want, opts)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
 	}
 
-	rmt, err := remote.Get(ref, remoteOptions...)
-	utils.Assert(err)
+	fetcher, err := newBlobFetcher(ctx, rmt.source.Context(), rmt.auth)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
+	}
 
-	var img v1.Image
+	var desc *v1.Descriptor
 	if rmt.MediaType.IsIndex() {
 		idx, err := rmt.ImageIndex()
-		utils.Assert(err)
-		if img, err = findMatchImage(idx); err != nil {
-			utils.Assert(err)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.AllPlatforms {
+			desc, err = pullIndex(ctx, lp, ref, idx, rmt.Digest.String(), fetcher, opts)
+		} else {
+			var img v1.Image
+			var platform *v1.Platform
+			if img, platform, err = findMatchImage(idx, want); err != nil {
+				return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
+			}
+			desc, err = storeImage(ctx, lp, ref, img, platform, rmt.Digest.String(), fetcher, opts)
+		}
+		if err != nil {
+			return nil, err
 		}
 	} else {
-		if img, err = rmt.Image(); err != nil {
-			utils.Assert(err)
+		img, err := rmt.Image()
+		if err != nil {
+			return nil, err
+		}
+		// an image of a single platform is pulled for the host even when it does not match,
+		// running it warns then. The platform asked for explicitly has to match.
+		platform := imagePlatform(nil, img)
+		if opts.Platform != "" && platform != nil && platformRank(want, *platform) < 0 {
+			return nil, fmt.Errorf("pull %s: the image is for platform %s, not %s", ref.Name(), platform.String(), want.String())
+		}
+
+		if desc, err = storeImage(ctx, lp, ref, img, platform, rmt.Digest.String(), fetcher, opts); err != nil {
+			return nil, err
 		}
 	}
+	emitImageEvent(ref.Name(), "pull", opts.OnEvent)
+
+	return desc, nil
+}
 
-	// if image aready exists, will update it
-	if err = lp.ReplaceImage(img, match.Name(ref.Name()), layout.WithAnnotations(map[string]string{
-		oci.AnnotationRefName: ref.Name(),
-	})); err != nil {
-		utils.Assert(err)
+// storeImage downloads the layers of the image and names it ref, an image with the name is replaced
+func storeImage(ctx context.Context, lp layout.Path, ref name.Reference, img v1.Image, platform *v1.Platform,
+	repoDigest string, fetcher *blobFetcher, opts PullOptions) (*v1.Descriptor, error) {
+	if err := downloadLayers(ctx, lp, img, fetcher, opts.MaxConcurrentDownloads, opts.Progress); err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
 	}
 
-	return img, nil
+	desc, err := replaceImage(lp, img, ref.Name(), platform, repoDigest)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
+	}
+	return desc, nil
 }
 
-func findMatchImage(idx v1.ImageIndex) (v1.Image, error) {
-	manifests, err := partial.Manifests(idx)
+// pullIndex downloads the images of all platforms of the index and names the index ref,
+// the attestations of the images which build tools add as platform unknown/unknown are skipped
+func pullIndex(ctx context.Context, lp layout.Path, ref name.Reference, idx v1.ImageIndex,
+	repoDigest string, fetcher *blobFetcher, opts PullOptions) (*v1.Descriptor, error) {
+	imf, err := idx.IndexManifest()
 	if err != nil {
 		return nil, err
 	}
 
-	var matched partial.Describable
-	for _, m := range manifests {
-		// Keep the old descriptor (annotations and whatnot).
-		desc, err := partial.Descriptor(m)
+	for _, child := range imf.Manifests {
+		if !child.MediaType.IsImage() || child.Platform == nil || child.Platform.OS == "unknown" {
+			continue
+		}
+
+		img, err := idx.Image(child.Digest)
 		if err != nil {
 			return nil, err
 		}
+		if err := downloadLayers(ctx, lp, img, fetcher, opts.MaxConcurrentDownloads, opts.Progress); err != nil {
+			return nil, fmt.Errorf("pull %s for %s: %w", ref.Name(), child.Platform.String(), err)
+		}
+		if err := writeImageBlobs(lp, img); err != nil {
+			return nil, fmt.Errorf("pull %s for %s: %w", ref.Name(), child.Platform.String(), err)
+		}
+	}
 
-		// High-priority: platform/arch are matched
-		// Middle-priority: arch matched
-		if p := desc.Platform; p != nil {
-			logrus.Infof("Image=%s, Platform: OS=%s, Architecture=%s", desc.Digest.String(), p.OS, p.Architecture)
+	desc, err := replaceIndex(lp, idx, ref.Name(), repoDigest)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref.Name(), err)
+	}
+	return desc, nil
+}
 
-			if p.Architecture == runtime.GOARCH && p.OS == runtime.GOOS {
-				matched = m
-				break
-			} else if matched == nil && p.Architecture == runtime.GOARCH {
-				matched = m
-			}
+// remoteImage is the descriptor of an image and where it was found
+type remoteImage struct {
+	*remote.Descriptor
+	source name.Reference
+	auth   authn.Authenticator
+}
+
+// getRemoteImage gets the descriptor of ref from the first of its mirrors which has it,
+// or from its registry
+func getRemoteImage(ctx context.Context, ref name.Reference, platform v1.Platform, opts PullOptions) (*remoteImage, error) {
+	sources, err := pullSources(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	for n, source := range sources {
+		// the credentials of the caller are only sent to the registry, not to the mirrors
+		auth := opts.Auth
+		if n != len(sources)-1 {
+			auth = nil
+		}
+
+		remoteOptions, err := registryOptions(ctx, source.Context().Registry, auth)
+		if err != nil {
+			return nil, err
+		}
+		remoteOptions = append(remoteOptions, remote.WithPlatform(platform))
+
+		rmt, err := remote.Get(source, remoteOptions...)
+		if err == nil {
+			return &remoteImage{Descriptor: rmt, source: source, auth: auth}, nil
+		}
+		if n == len(sources)-1 || ctx.Err() != nil {
+			return nil, err
 		}
+		logrus.Warnf("pull %s from mirror %s: %v", ref.Name(), source.Context().RegistryStr(), err)
+	}
+
+	return nil, errors.New("no registry to pull from")
+}
+
+// findMatchImage returns the image of the index which suits the platform best, see
+// platformRank, and the platform of its descriptor
+func findMatchImage(idx v1.ImageIndex, platform v1.Platform) (v1.Image, *v1.Platform, error) {
+	imf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if matched != nil {
-		if img, ok := matched.(v1.Image); ok {
-			desc, _ := partial.Descriptor(matched)
-			logrus.Infof("Selected best matched image=%s", desc.Digest.String())
-			return img, nil
+	var matched *v1.Descriptor
+	best := -1
+	available := []string{}
+	for n, desc := range imf.Manifests {
+		if desc.Platform == nil || !desc.MediaType.IsImage() {
+			continue
 		}
-		return nil, fmt.Errorf("found a matched index, but is not an image")
+		available = append(available, desc.Platform.String())
+
+		rank := platformRank(platform, *desc.Platform)
+		logrus.Debugf("image %s, platform %s, rank %d", desc.Digest.String(), desc.Platform.String(), rank)
+		if rank > best {
+			matched, best = &imf.Manifests[n], rank
+		}
+	}
+
+	if matched == nil {
+		return nil, nil, fmt.Errorf("no matching manifest for %s in the manifest list entries, available: %s",
+			platform.String(), strings.Join(available, ", "))
 	}
 
-	return nil, errors.New("not found matched image")
+	logrus.Debugf("selected image %s", matched.Digest.String())
+	img, err := idx.Image(matched.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, matched.Platform, nil
 }
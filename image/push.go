@@ -0,0 +1,263 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/events"
+)
+
+// PushOptions changes how an image is pushed
+type PushOptions struct {
+	// Auth authenticates to the registry, the credentials stored by login are used when it is nil
+	Auth authn.Authenticator
+	// Progress is called with the bytes pushed so far and the total of the image
+	Progress func(complete int64, total int64)
+	// OnEvent receives the push event of the image
+	OnEvent events.Handler
+}
+
+// PushResult is the manifest written to the registry
+type PushResult struct {
+	Name   string
+	Digest v1.Hash
+	Size   int64
+}
+
+func PushImageCommand(cmd *cobra.Command, args []string) error {
+	// the progress is redrawn on a terminal, otherwise printed every few seconds
+	terminal := isTerminal(os.Stdout)
+
+	var printed time.Time
+	progress := func(complete int64, total int64) {
+		if terminal {
+			fmt.Printf("\rPushing %s / %s", humanize.Bytes(uint64(complete)), humanize.Bytes(uint64(total)))
+		} else if time.Since(printed) > 5*time.Second || complete == total {
+			fmt.Printf("Pushing %s / %s\n", humanize.Bytes(uint64(complete)), humanize.Bytes(uint64(total)))
+			printed = time.Now()
+		}
+	}
+
+	result, err := PushImage(cmd.Context(), args[0], PushOptions{Progress: progress})
+	if terminal {
+		fmt.Println()
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: digest: %s size: %d\n", result.Name, result.Digest, result.Size)
+	return nil
+}
+
+// PushImage writes the image of the repository to the registry of its name, the layers
+// of other images of the same registry are mounted instead of uploaded
+func PushImage(ctx context.Context, image string, opts PushOptions) (*PushResult, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := findDescriptor(ii, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := findLayerSources(lp, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := registryReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	remoteOptions, err := registryOptions(ctx, target.Context().Registry, opts.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	var write func(...remote.Option) error
+	digest, size := desc.Digest, desc.Size
+	if desc.MediaType.IsIndex() {
+		idx, err := pushedIndex(lp, ii, *desc)
+		if err != nil {
+			return nil, err
+		}
+		if digest, err = idx.Digest(); err != nil {
+			return nil, err
+		}
+		if size, err = idx.Size(); err != nil {
+			return nil, err
+		}
+		write = func(options ...remote.Option) error { return remote.WriteIndex(target, idx, options...) }
+	} else {
+		img, err := ii.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		mountable := &mountableImage{Image: img, sources: sources}
+		write = func(options ...remote.Option) error { return remote.Write(target, mountable, options...) }
+	}
+
+	updates := make(chan v1.Update, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for update := range updates {
+			if update.Error == nil && opts.Progress != nil {
+				opts.Progress(update.Complete, update.Total)
+			}
+		}
+	}()
+
+	err = write(append(remoteOptions, remote.WithProgress(updates))...)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("push %s: %w", ref.Name(), err)
+	}
+	emitImageEvent(ref.Name(), "push", opts.OnEvent)
+
+	return &PushResult{Name: ref.Name(), Digest: digest, Size: size}, nil
+}
+
+// pushedIndex returns the index of the descriptor with the images which were pulled, an
+// index without the others, e.g. attestations, has another digest than the pulled one
+func pushedIndex(lp layout.Path, ii v1.ImageIndex, desc v1.Descriptor) (v1.ImageIndex, error) {
+	idx, err := ii.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	imf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := pulledManifests(lp, idx)
+	if err != nil {
+		return nil, err
+	}
+	if len(pulled) == len(imf.Manifests) {
+		return idx, nil
+	}
+
+	logrus.Warnf("push %s without the %d manifests which were not pulled, the digest of the index changes",
+		desc.Annotations[oci.AnnotationRefName], len(imf.Manifests)-len(pulled))
+	return mutate.RemoveManifests(idx, func(child v1.Descriptor) bool {
+		return !slices.ContainsFunc(pulled, func(p v1.Descriptor) bool { return p.Digest == child.Digest })
+	}), nil
+}
+
+// findLayerSources maps the layers of the images named in other repositories of the
+// registry of ref to one of those images, the registry may mount them from there
+func findLayerSources(lp layout.Path, ref name.Reference) (map[v1.Hash]name.Reference, error) {
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[v1.Hash]name.Reference{}
+	for _, desc := range imf.Manifests {
+		imageName, ok := desc.Annotations[oci.AnnotationRefName]
+		if !ok {
+			continue
+		}
+
+		source, err := name.ParseReference(imageName)
+		if err != nil || source.Context().RegistryStr() != ref.Context().RegistryStr() ||
+			source.Context().RepositoryStr() == ref.Context().RepositoryStr() {
+			continue
+		}
+
+		img, err := lp.Image(desc.Digest)
+		if err != nil {
+			continue
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			continue
+		}
+		for _, layer := range manifest.Layers {
+			if _, ok := sources[layer.Digest]; !ok {
+				sources[layer.Digest] = source
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// mountableImage marks the layers found in other repositories of the registry as
+// mountable, remote.Write asks the registry to mount them from there first
+type mountableImage struct {
+	v1.Image
+	sources map[v1.Hash]name.Reference
+}
+
+func (i *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	for n, layer := range layers {
+		if layers[n], err = i.mountable(layer); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+func (i *mountableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mountable(layer)
+}
+
+func (i *mountableImage) mountable(layer v1.Layer) (v1.Layer, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	if source, ok := i.sources[digest]; ok {
+		return &remote.MountableLayer{Layer: layer, Reference: source}, nil
+	}
+	return layer, nil
+}
@@ -0,0 +1,224 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/config"
+)
+
+// recordedRequest is a request served by the test registry and its status
+type recordedRequest struct {
+	method string
+	path   string
+	query  string
+	status int
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// newTestRegistry starts an in-memory registry which records the requests it serves. The
+// registry keeps blobs by digest only and does not mount, the blobs are scoped to the
+// repositories they were uploaded or mounted to here, like a real registry does.
+func newTestRegistry(t *testing.T) (string, func() []recordedRequest) {
+	t.Helper()
+
+	var lock sync.Mutex
+	requests := []recordedRequest{}
+	blobs := map[string]bool{}
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, blob, isBlob := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+
+		lock.Lock()
+		known := blobs[repo+"@"+blob]
+		lock.Unlock()
+
+		mount, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		lock.Lock()
+		mountable := blobs[from+"@"+mount]
+		lock.Unlock()
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		switch {
+		case isBlob && r.Method == http.MethodHead && !known:
+			rw.WriteHeader(http.StatusNotFound)
+		case isBlob && r.Method == http.MethodPost && mountable:
+			rw.Header().Set("Location", "/v2/"+repo+"/blobs/"+mount)
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			handler.ServeHTTP(rw, r)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, recordedRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, status: rw.status})
+		if isBlob && rw.status == http.StatusCreated {
+			if mountable {
+				blobs[repo+"@"+mount] = true
+			} else if digest := r.URL.Query().Get("digest"); digest != "" {
+				blobs[repo+"@"+digest] = true
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://"), func() []recordedRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]recordedRequest{}, requests...)
+	}
+}
+
+// initTestRoot points the runtime to empty directories, without any stored credentials
+func initTestRoot(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	if err := config.Init(t.TempDir(), t.TempDir(), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pushCommand runs the push command and returns what it printed
+func pushCommand(t *testing.T, image string) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(r)
+		output <- string(content)
+	}()
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	err = PushImageCommand(cmd, []string{image})
+	w.Close()
+	printed := <-output
+	if err != nil {
+		t.Fatalf("push %s: %v", image, err)
+	}
+	return printed
+}
+
+func layerDigests(t *testing.T, img v1.Image) []v1.Hash {
+	t.Helper()
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := []v1.Hash{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+	return digests
+}
+
+func TestPushImage(t *testing.T) {
+	host, requests := newTestRegistry(t)
+	initTestRoot(t)
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, target := host+"/source:v1", host+"/target:v1"
+	for _, image := range []string{source, target} {
+		if _, err := StoreImage(img, image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	printed := pushCommand(t, source)
+	if want := fmt.Sprintf("%s: digest: %s", source, digest); !strings.Contains(printed, want) {
+		t.Errorf("push printed %q, want %q", printed, want)
+	}
+
+	ref, err := name.ParseReference(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Head(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digest {
+		t.Errorf("registry has %s, want %s", desc.Digest, digest)
+	}
+
+	// the layers are in the source repository of the registry now, they are mounted from there
+	pushed := len(requests())
+	printed = pushCommand(t, target)
+	if want := fmt.Sprintf("%s: digest: %s", target, digest); !strings.Contains(printed, want) {
+		t.Errorf("push printed %q, want %q", printed, want)
+	}
+
+	mounted := map[string]bool{}
+	for _, req := range requests()[pushed:] {
+		query, err := url.ParseQuery(req.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.method == http.MethodPut && strings.Contains(req.path, "/blobs/") {
+			for _, layer := range layerDigests(t, img) {
+				if query.Get("digest") == layer.String() {
+					t.Errorf("layer %s was uploaded", layer)
+				}
+			}
+		}
+		if req.method == http.MethodPost && req.path == "/v2/target/blobs/uploads/" && req.status == http.StatusCreated {
+			if from := query.Get("from"); from != "source" {
+				t.Errorf("layer %s mounted from %s, want source", query.Get("mount"), from)
+			}
+			mounted[query.Get("mount")] = true
+		}
+	}
+
+	for _, layer := range layerDigests(t, img) {
+		if !mounted[layer.String()] {
+			t.Errorf("layer %s was not mounted from source", layer)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationRepoDigest records the digest of the manifest or the index which a named
+// image of the repository index was pulled by, e.g. the index of all platforms
+const AnnotationRepoDigest = "tech.aproton.container.repo.digest"
+
+// isStoredImage tells whether the descriptor of the repository index is an image, or an
+// index of the images of several platforms
+func isStoredImage(desc v1.Descriptor) bool {
+	switch desc.MediaType {
+	case types.DockerManifestSchema2, types.OCIManifestSchema1, types.DockerManifestList, types.OCIImageIndex:
+		return true
+	}
+	return false
+}
+
+// findDescriptor returns the descriptor of the image named ref in the repository index,
+// an image of the repository of a digest reference is found by its digest too: the
+// one of its manifest or index, or the one it was pulled by
+func findDescriptor(ii v1.ImageIndex, ref name.Reference) (*v1.Descriptor, error) {
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for n, desc := range imf.Manifests {
+		if isStoredImage(desc) && desc.Annotations[oci.AnnotationRefName] == ref.Name() {
+			return &imf.Manifests[n], nil
+		}
+	}
+
+	if digest, ok := ref.(name.Digest); ok {
+		for n, desc := range imf.Manifests {
+			if !isStoredImage(desc) {
+				continue
+			}
+
+			stored, err := name.ParseReference(desc.Annotations[oci.AnnotationRefName])
+			if err != nil || stored.Context().Name() != digest.Context().Name() {
+				continue
+			}
+			if desc.Digest.String() == digest.DigestStr() || desc.Annotations[AnnotationRepoDigest] == digest.DigestStr() {
+				return &imf.Manifests[n], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrImageNotFound, ref.String())
+}
+
+// resolveImage returns the image of the descriptor and its platform, the one of an index
+// is the pulled image which suits the platform best
+func resolveImage(lp layout.Path, desc v1.Descriptor, platform v1.Platform) (v1.Image, *v1.Platform, error) {
+	if !desc.MediaType.IsIndex() {
+		img, err := lp.Image(desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, imagePlatform(&desc, img), nil
+	}
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, err := ii.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pulled, err := pulledManifests(lp, idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	pulledOnly := mutate.RemoveManifests(idx, func(child v1.Descriptor) bool {
+		return !slices.ContainsFunc(pulled, func(p v1.Descriptor) bool { return p.Digest == child.Digest })
+	})
+
+	return findMatchImage(pulledOnly, platform)
+}
+
+// pulledManifests returns the descriptors of the images of the index whose manifests are
+// in the repository, the images of the other platforms were not pulled
+func pulledManifests(lp layout.Path, idx v1.ImageIndex) ([]v1.Descriptor, error) {
+	imf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := []v1.Descriptor{}
+	for _, desc := range imf.Manifests {
+		if desc.MediaType.IsImage() && hasBlob(filepath.Join(string(lp), "blobs", desc.Digest.Algorithm, desc.Digest.Hex), desc.Size) {
+			pulled = append(pulled, desc)
+		}
+	}
+	return pulled, nil
+}
+
+// nameDescriptor points the name to the image or the index of the descriptor, whose
+// blobs are in the repository, the image which had the name before is removed
+func nameDescriptor(lp layout.Path, add mutate.Appendable, desc v1.Descriptor, name string, repoDigest string) (*v1.Descriptor, error) {
+	desc.Annotations = map[string]string{oci.AnnotationRefName: name}
+	if repoDigest != "" {
+		desc.Annotations[AnnotationRepoDigest] = repoDigest
+	}
+
+	err := updateIndex(lp, func(ii v1.ImageIndex) v1.ImageIndex {
+		return mutate.AppendManifests(mutate.RemoveManifests(ii, match.Name(name)), mutate.IndexAddendum{
+			Add:        add,
+			Descriptor: desc,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
@@ -0,0 +1,149 @@
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"aproton.tech/container/config"
+)
+
+// registryOptions returns the options of the requests to the registry: its transport
+// with the TLS config of the registry and the credentials
+func registryOptions(ctx context.Context, reg name.Registry, auth authn.Authenticator) ([]remote.Option, error) {
+	t, err := registryTransport(reg.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithTransport(t),
+		authOption(auth),
+	}, nil
+}
+
+// registryTransport returns the transport of the registry host, it trusts the CA and
+// presents the client certificate of the registry config
+func registryTransport(host string) (http.RoundTripper, error) {
+	cfg := config.Registry(host)
+	if !cfg.Insecure && cfg.CA == "" && cfg.Cert == "" && cfg.Key == "" {
+		return remote.DefaultTransport, nil
+	}
+
+	t := remote.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		tlsConfig = t.TLSClientConfig.Clone()
+	}
+
+	if cfg.Insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if cfg.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		content, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", host, err)
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("registry %s: no certificate found in %s", host, cfg.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, fmt.Errorf("registry %s: both cert and key are required", host)
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+// registryReference returns ref which may be accessed by HTTP when the registry is insecure
+func registryReference(ref name.Reference) (name.Reference, error) {
+	if !config.Registry(ref.Context().RegistryStr()).Insecure {
+		return ref, nil
+	}
+
+	insecure, err := name.NewRepository(ref.Context().Name(), name.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	return withIdentifier(insecure, ref)
+}
+
+// pullSources returns the references which are tried in order to pull ref, the
+// mirrors of its registry and then ref itself
+func pullSources(ref name.Reference) ([]name.Reference, error) {
+	sources := []name.Reference{}
+	for _, mirror := range config.Registry(ref.Context().RegistryStr()).Mirrors {
+		source, err := mirrorReference(mirror, ref)
+		if err != nil {
+			return nil, fmt.Errorf("registry mirror %s: %w", mirror, err)
+		}
+		sources = append(sources, source)
+	}
+
+	original, err := registryReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return append(sources, original), nil
+}
+
+// mirrorReference returns ref in the mirror, e.g. https://mirror.example.com or
+// mirror.example.com/prefix
+func mirrorReference(mirror string, ref name.Reference) (name.Reference, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://"), "/")
+	host, prefix, _ := strings.Cut(host, "/")
+
+	opts := []name.Option{}
+	if strings.HasPrefix(mirror, "http://") || config.Registry(host).Insecure {
+		opts = append(opts, name.Insecure)
+	}
+
+	repository := ref.Context().RepositoryStr()
+	if prefix != "" {
+		repository = prefix + "/" + repository
+	}
+
+	repo, err := name.NewRepository(host+"/"+repository, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return withIdentifier(repo, ref)
+}
+
+// withIdentifier returns the tag or the digest of ref in the repository
+func withIdentifier(repo name.Repository, ref name.Reference) (name.Reference, error) {
+	switch r := ref.(type) {
+	case name.Tag:
+		return repo.Tag(r.TagStr()), nil
+	case name.Digest:
+		return repo.Digest(r.DigestStr()), nil
+	}
+	return nil, errors.New("unknown reference " + ref.String())
+}
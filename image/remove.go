@@ -2,19 +2,56 @@ package image
 
 import (
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/match"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
-
-	"aproton.tech/container/utils"
 )
 
-func RemoveImageCommand(cmd *cobra.Command, args []string) {
+func RemoveImageCommand(cmd *cobra.Command, args []string) error {
+	return RemoveImage(args[0])
+}
+
+// RemoveImage removes the name from the repository, the blobs and layers which are
+// not used anymore are collected
+func RemoveImage(image string) error {
 	lp, err := Repository()
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return err
+	}
+	removed, err := removeNamedImage(lp, ref)
+	unlock()
+	if err != nil {
+		return err
+	}
+	emitImageEvent(removed, "delete", nil)
+
+	_, err = GarbageCollect(false)
+	return err
+}
+
+// removeNamedImage removes the name of the image of ref from the repository index and returns it
+func removeNamedImage(lp layout.Path, ref name.Reference) (string, error) {
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return "", err
+	}
 
-	ref, err := name.ParseReference(args[0])
-	utils.Assert(err)
+	desc, err := findDescriptor(ii, ref)
+	if err != nil {
+		return "", err
+	}
 
-	err = lp.RemoveDescriptors(match.Name(ref.Name()))
-	utils.Assert(err)
+	name := desc.Annotations[oci.AnnotationRefName]
+	return name, removeDescriptors(lp, match.Name(name))
 }
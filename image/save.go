@@ -1,55 +1,62 @@
 package image
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"github.com/google/go-containerregistry/pkg/v1/types"
-	oci "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-
-	"aproton.tech/container/utils"
 )
 
-func SaveImageCommand(cmd *cobra.Command, args []string) {
+func SaveImageCommand(cmd *cobra.Command, args []string) error {
 	output := os.Stdout
 	if flag := cmd.Flag("output"); flag != nil && flag.Value.String() != "" {
 		var err error
 		output, err = os.Create(flag.Value.String())
-		utils.Assert(err)
+		if err != nil {
+			return err
+		}
 		defer output.Close()
 	}
 
 	lp, err := Repository()
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
-	ii, err := lp.ImageIndex()
-	utils.Assert(err)
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	imf, err := ii.IndexManifest()
-	utils.Assert(err)
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return err
+	}
 
 	for _, tag := range args {
 		logrus.Infof("name=%s", tag)
 		ref, err := name.ParseReference(tag)
-		utils.Assert(err)
-
-		for _, img := range imf.Manifests {
-			if img.MediaType == types.DockerManifestSchema2 || img.MediaType == types.OCIManifestSchema1 {
-				if name, ok := img.Annotations[oci.AnnotationRefName]; ok && name == ref.Name() {
-					logrus.Infof("found=%s", name)
-					i, err := lp.Image(img.Digest)
-					utils.Assert(err)
-					utils.Assert(tarball.Write(ref, i, output))
-					break
-				}
-			}
+		if err != nil {
+			return err
 		}
 
+		desc, err := findDescriptor(ii, ref)
+		if err != nil {
+			return err
+		}
+		// the archive has a single image, the one of the host of an index
+		img, _, err := resolveImage(lp, *desc, HostPlatform())
+		if err != nil {
+			return fmt.Errorf("save %s: %w", tag, err)
+		}
+		if err := tarball.Write(ref, img, output); err != nil {
+			return fmt.Errorf("save %s: %w", tag, err)
+		}
 	}
 
-	utils.Assert(err)
-
+	return nil
 }
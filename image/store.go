@@ -0,0 +1,384 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+
+	"aproton.tech/container/config"
+	"aproton.tech/container/utils"
+)
+
+// The repository is shared by concurrent processes. Everyone reading images or adding
+// blobs holds the repository lock shared, blobs are only added and written by rename.
+// Garbage collection deletes blobs and layers, it holds the repository lock exclusive.
+// The read-modify-write of index.json is serialized by the index lock.
+
+func repositoryLockFile() string {
+	return config.RootPath("repositories.lock")
+}
+
+func indexLockFile() string {
+	return config.RootPath("repositories.index.lock")
+}
+
+// blobLockPath keeps the locks of the blobs being written, it is not in TempPath,
+// the temporary files are swept and a lock file must not be removed while it is held
+func blobLockPath() string {
+	return config.RootPath("locks")
+}
+
+// LockRepository locks the repository, the returned function releases the lock. A
+// process must not take the exclusive lock while it holds the shared one.
+func LockRepository(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(config.Get().Root, 0755); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(repositoryLockFile(), exclusive)
+}
+
+func lockIndex() (func(), error) {
+	if err := os.MkdirAll(config.Get().Root, 0755); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(indexLockFile(), true)
+}
+
+func Repository() (layout.Path, error) {
+	if lp, err := layout.FromPath(RepositoryPath()); err == nil {
+		return lp, nil
+	}
+
+	unlock, err := lockIndex()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// created by another process while waiting for the lock, it must not be truncated
+	if lp, err := layout.FromPath(RepositoryPath()); err == nil {
+		return lp, nil
+	}
+
+	if err := os.MkdirAll(RepositoryPath(), 0755); err != nil {
+		return "", err
+	}
+
+	lp := layout.Path(RepositoryPath())
+	if err := utils.WriteFileAtomic(filepath.Join(RepositoryPath(), oci.ImageLayoutFile),
+		[]byte(`{"imageLayoutVersion": "`+oci.ImageLayoutVersion+`"}`), 0644); err != nil {
+		return "", err
+	}
+
+	if err := writeIndex(lp, empty.Index); err != nil {
+		return "", err
+	}
+
+	return lp, nil
+}
+
+// updateIndex replaces index.json with the index returned by update, under the index lock
+func updateIndex(lp layout.Path, update func(ii v1.ImageIndex) v1.ImageIndex) error {
+	unlock, err := lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return err
+	}
+
+	return writeIndex(lp, update(ii))
+}
+
+func writeIndex(lp layout.Path, ii v1.ImageIndex) error {
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(imf, "", "   ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(filepath.Join(string(lp), "index.json"), content, 0644)
+}
+
+// replaceImage writes the blobs of the image and points the name to it, the image which
+// had the name before is removed from the index. The descriptor records the platform,
+// the one of the image config when it is nil, and the digest the image was pulled by.
+func replaceImage(lp layout.Path, img v1.Image, name string, platform *v1.Platform, repoDigest string) (*v1.Descriptor, error) {
+	if err := writeImageBlobs(lp, img); err != nil {
+		return nil, err
+	}
+
+	desc, err := partial.Descriptor(img)
+	if err != nil {
+		return nil, err
+	}
+	desc.Platform = platform
+	if desc.Platform == nil {
+		desc.Platform = imagePlatform(nil, img)
+	}
+
+	return nameDescriptor(lp, img, *desc, name, repoDigest)
+}
+
+// replaceIndex writes the manifest of the index and points the name to it like
+// replaceImage, the images of the index are written before
+func replaceIndex(lp layout.Path, idx v1.ImageIndex, name string, repoDigest string) (*v1.Descriptor, error) {
+	digest, err := idx.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	rawManifest, err := idx.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeBlob(lp, digest, int64(len(rawManifest)), bytesReader(rawManifest)); err != nil {
+		return nil, fmt.Errorf("write index %s: %w", digest.String(), err)
+	}
+
+	desc, err := partial.Descriptor(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return nameDescriptor(lp, idx, *desc, name, repoDigest)
+}
+
+func removeDescriptors(lp layout.Path, matcher match.Matcher) error {
+	return updateIndex(lp, func(ii v1.ImageIndex) v1.ImageIndex {
+		return mutate.RemoveManifests(ii, matcher)
+	})
+}
+
+func writeImageBlobs(lp layout.Path, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+
+		if err := writeBlob(lp, digest, size, layer.Compressed); err != nil {
+			return fmt.Errorf("write layer %s: %w", digest.String(), err)
+		}
+	}
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+
+	if err := writeBlob(lp, configName, int64(len(rawConfig)), bytesReader(rawConfig)); err != nil {
+		return fmt.Errorf("write config %s: %w", configName.String(), err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+
+	if err := writeBlob(lp, digest, int64(len(rawManifest)), bytesReader(rawManifest)); err != nil {
+		return fmt.Errorf("write manifest %s: %w", digest.String(), err)
+	}
+
+	return nil
+}
+
+// writeBlob writes the blob once, a process which wants the same blob waits for the one
+// writing it instead of downloading it again
+func writeBlob(lp layout.Path, digest v1.Hash, size int64, open func() (io.ReadCloser, error)) error {
+	return storeBlob(lp, digest, size, func(int64) (io.ReadCloser, int64, error) {
+		rc, err := open()
+		return rc, 0, err
+	}, nil)
+}
+
+// blobOpener opens the content of a blob at offset, it returns the offset the content
+// starts at, which is 0 when the source can't resume
+type blobOpener func(offset int64) (io.ReadCloser, int64, error)
+
+// storeBlob writes the blob like writeBlob, the content is downloaded into a partial file
+// which is resumed by the next attempt when the download fails. The content is verified
+// before it is renamed into place, a blob in the repository is always complete. written
+// is called with the bytes written so far.
+func storeBlob(lp layout.Path, digest v1.Hash, size int64, open blobOpener, written func(int64)) error {
+	dir := filepath.Join(string(lp), "blobs", digest.Algorithm)
+	path := filepath.Join(dir, digest.Hex)
+
+	if hasBlob(path, size) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, dir := range []string{TempPath(), blobLockPath()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := utils.LockFile(filepath.Join(blobLockPath(), digest.Algorithm+"-"+digest.Hex+".lock"), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if hasBlob(path, size) {
+		logrus.Infof("blob %s was written by another process", digest.String())
+		return nil
+	}
+
+	partial := filepath.Join(TempPath(), digest.Algorithm+"-"+digest.Hex+".partial")
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var hasher hash.Hash
+	if digest.Algorithm == "sha256" {
+		hasher = sha256.New()
+	}
+
+	// the content of the previous attempt, it can only be verified when it is hashed again
+	offset := int64(0)
+	if hasher != nil {
+		if offset, err = io.Copy(hasher, f); err != nil {
+			return err
+		}
+	}
+	if size >= 0 && offset >= size {
+		offset = 0
+	}
+
+	rc, start, err := open(offset)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if start != offset || offset == 0 {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if hasher != nil {
+			hasher.Reset()
+		}
+		offset = 0
+	} else {
+		logrus.Infof("resume blob %s at %d", digest.String(), offset)
+	}
+
+	w := io.Writer(f)
+	if hasher != nil {
+		w = io.MultiWriter(f, hasher)
+	}
+	if written != nil {
+		w = &progressWriter{writer: w, written: offset, report: written}
+	}
+
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && offset+n != size {
+		os.Remove(partial)
+		return fmt.Errorf("expected blob size %d, but got %d", size, offset+n)
+	}
+
+	if hasher != nil {
+		if actual := hex.EncodeToString(hasher.Sum(nil)); actual != digest.Hex {
+			os.Remove(partial)
+			return fmt.Errorf("digest mismatch, expected %s, but got sha256:%s", digest.String(), actual)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(partial, path)
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	writer  io.Writer
+	written int64
+	report  func(int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	w.report(w.written)
+	return n, err
+}
+
+func hasBlob(path string, size int64) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("stat blob %s: %v", path, err)
+		}
+		return false
+	}
+	return fi.Mode().IsRegular() && (size < 0 || fi.Size() == size)
+}
+
+func bytesReader(content []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+}
@@ -2,42 +2,61 @@ package image
 
 import (
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
-	"github.com/google/go-containerregistry/pkg/v1/match"
-	"github.com/google/go-containerregistry/pkg/v1/types"
-	oci "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/spf13/cobra"
-
-	"aproton.tech/container/utils"
 )
 
-func TagImageCommand(cmd *cobra.Command, args []string) {
+func TagImageCommand(cmd *cobra.Command, args []string) error {
 	lp, err := Repository()
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	org, err := name.ParseReference(args[0])
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
 	dst, err := name.ParseReference(args[1])
-	utils.Assert(err)
+	if err != nil {
+		return err
+	}
 
 	ii, err := lp.ImageIndex()
-	utils.Assert(err)
-
-	imf, err := ii.IndexManifest()
-	utils.Assert(err)
-
-	for _, img := range imf.Manifests {
-		if img.MediaType == types.DockerManifestSchema2 || img.MediaType == types.OCIManifestSchema1 {
-			if name, ok := img.Annotations[oci.AnnotationRefName]; ok && name == org.Name() {
-				i, err := lp.Image(img.Digest)
-				utils.Assert(err)
-				err = lp.ReplaceImage(i, match.Name(dst.Name()), layout.WithAnnotations(map[string]string{
-					oci.AnnotationRefName: dst.Name(),
-				}))
-				utils.Assert(err)
-				break
-			}
-		}
+	if err != nil {
+		return err
+	}
+
+	desc, err := findDescriptor(ii, org)
+	if err != nil {
+		return err
+	}
+
+	var add mutate.Appendable
+	if desc.MediaType.IsIndex() {
+		add, err = ii.ImageIndex(desc.Digest)
+	} else {
+		add, err = ii.Image(desc.Digest)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the digest the image was pulled by belongs to its repository
+	repoDigest := ""
+	if org.Context().Name() == dst.Context().Name() {
+		repoDigest = desc.Annotations[AnnotationRepoDigest]
+	}
+
+	if _, err := nameDescriptor(lp, add, *desc, dst.Name(), repoDigest); err != nil {
+		return err
 	}
+	emitImageEvent(dst.Name(), "tag", nil)
+	return nil
 }
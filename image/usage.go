@@ -0,0 +1,285 @@
+package image
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	oci "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"aproton.tech/container/utils"
+)
+
+// ImageUsage is the disk space of an image in the repository, the blobs used by
+// other images too are counted in SharedSize, the others in UniqueSize
+type ImageUsage struct {
+	Name       string    `json:"name"`
+	Digest     v1.Hash   `json:"digest"`
+	Created    time.Time `json:"created"`
+	Size       uint64    `json:"size"`
+	SharedSize uint64    `json:"sharedSize"`
+	UniqueSize uint64    `json:"uniqueSize"`
+
+	diffIDs []string
+	blobs   map[v1.Hash]int64
+}
+
+// LayerUsage is the disk space of an extracted lower directory
+type LayerUsage struct {
+	DiffID     string   `json:"diffId"`
+	Size       uint64   `json:"size"`
+	Images     []string `json:"images"`
+	Containers []string `json:"containers"`
+}
+
+// RepositoryUsage is the disk space used by the images and their extracted layers
+type RepositoryUsage struct {
+	Images    []*ImageUsage `json:"images"`
+	Layers    []*LayerUsage `json:"layers"`
+	BlobsSize uint64        `json:"blobsSize"`
+}
+
+func GetRepositoryUsage() (*RepositoryUsage, error) {
+	lp, err := Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := LockRepository(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	imf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &RepositoryUsage{Images: []*ImageUsage{}, Layers: []*LayerUsage{}}
+
+	blobUsers := map[v1.Hash]int{}
+	for _, desc := range imf.Manifests {
+		if !isStoredImage(desc) {
+			continue
+		}
+
+		img, err := newImageUsage(lp, ii, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		for hash := range img.blobs {
+			blobUsers[hash]++
+		}
+		usage.Images = append(usage.Images, img)
+	}
+
+	for _, img := range usage.Images {
+		for hash, size := range img.blobs {
+			if blobUsers[hash] > 1 {
+				img.SharedSize += uint64(size)
+			} else {
+				img.UniqueSize += uint64(size)
+			}
+		}
+		img.Size = img.SharedSize + img.UniqueSize
+	}
+
+	if usage.BlobsSize, err = getBlobsSize(string(lp)); err != nil {
+		return nil, err
+	}
+
+	if usage.Layers, err = getLayersUsage(usage.Images); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// ReclaimableImagesSize returns the size of the blobs which are not used by the images in use
+func (u *RepositoryUsage) ReclaimableImagesSize(inUse map[string]bool) uint64 {
+	used := map[v1.Hash]int64{}
+	for _, img := range u.Images {
+		if inUse[img.Name] {
+			for hash, size := range img.blobs {
+				used[hash] = size
+			}
+		}
+	}
+
+	size := uint64(0)
+	for _, s := range used {
+		size += uint64(s)
+	}
+
+	if size > u.BlobsSize {
+		return 0
+	}
+	return u.BlobsSize - size
+}
+
+// ReclaimableLayersSize returns the size of the lower directories which are neither
+// used by a container nor by the images in use
+func (u *RepositoryUsage) ReclaimableLayersSize(inUse map[string]bool) uint64 {
+	used := map[string]bool{}
+	for _, img := range u.Images {
+		if inUse[img.Name] {
+			for _, diffID := range img.diffIDs {
+				used[diffID] = true
+			}
+		}
+	}
+
+	size := uint64(0)
+	for _, layer := range u.Layers {
+		if len(layer.Containers) == 0 && !used[layer.DiffID] {
+			size += layer.Size
+		}
+	}
+
+	return size
+}
+
+// newImageUsage returns the blobs of the image, the ones of the pulled images of an index
+func newImageUsage(lp layout.Path, ii v1.ImageIndex, desc v1.Descriptor) (*ImageUsage, error) {
+	usage := &ImageUsage{
+		Name:   desc.Annotations[oci.AnnotationRefName],
+		Digest: desc.Digest,
+		blobs:  map[v1.Hash]int64{desc.Digest: desc.Size},
+	}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := ii.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return usage, usage.addImage(img)
+	}
+
+	idx, err := ii.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := pulledManifests(lp, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range pulled {
+		usage.blobs[child.Digest] = child.Size
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := usage.addImage(img); err != nil {
+			return nil, err
+		}
+	}
+
+	return usage, nil
+}
+
+func (usage *ImageUsage) addImage(img v1.Image) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+
+	usage.blobs[manifest.Config.Digest] = manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		usage.blobs[layer.Digest] = layer.Size
+	}
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+
+	if config.Created.Time.After(usage.Created) {
+		usage.Created = config.Created.Time
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if !slices.Contains(usage.diffIDs, diffID.Hex) {
+			usage.diffIDs = append(usage.diffIDs, diffID.Hex)
+		}
+	}
+
+	return nil
+}
+
+func getBlobsSize(repository string) (uint64, error) {
+	size := uint64(0)
+	err := filepath.WalkDir(filepath.Join(repository, "blobs"), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += uint64(fi.Size())
+			}
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+func getLayersUsage(images []*ImageUsage) ([]*LayerUsage, error) {
+	refs, err := GetLayerRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(ImageLowerPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*LayerUsage{}, nil
+		}
+		return nil, err
+	}
+
+	layers := []*LayerUsage{}
+	for _, entry := range entries {
+		size, err := utils.DiskUsage(filepath.Join(ImageLowerPath(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		layer := &LayerUsage{
+			DiffID:     entry.Name(),
+			Size:       size,
+			Images:     []string{},
+			Containers: refs[entry.Name()],
+		}
+		if layer.Containers == nil {
+			layer.Containers = []string{}
+		}
+
+		for _, img := range images {
+			for _, diffID := range img.diffIDs {
+				if diffID == entry.Name() {
+					layer.Images = append(layer.Images, img.Name)
+					break
+				}
+			}
+		}
+
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -8,21 +9,19 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"aproton.tech/container/build"
+	"aproton.tech/container/config"
 	"aproton.tech/container/container"
+	"aproton.tech/container/daemon"
+	"aproton.tech/container/events"
 	"aproton.tech/container/image"
+	"aproton.tech/container/system"
 	"aproton.tech/container/utils"
 )
 
 func init() {
 	logrus.SetFormatter(&utils.LogFormatter{})
 	logrus.SetReportCaller(true)
-	reexec.Register(container.ReExecRunCommand, func() {
-		utils.SetSubProcessFlag()
-		if err := container.Run(os.Args[1], os.Args[2]); err != nil {
-			utils.Assert(err)
-		}
-		logrus.Infof("run finished")
-	})
 }
 
 func main() {
@@ -31,20 +30,64 @@ func main() {
 	}
 
 	rootCmd := &cobra.Command{
-		Use:               "container",
-		Long:              `container`,
+		Use: "container",
+		Long: `container
+
+Exit codes:
+  125  the runtime failed, e.g. invalid flags or the image can not be pulled
+  126  the container command can not be invoked
+  127  the container command is not found
+  run returns the exit code of the container command, 128+signal if it was killed`,
 		Version:           "1.0",
 		CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.Init(cmd.Flag("root").Value.String(),
+				cmd.Flag("state").Value.String(), cmd.Flag("config").Value.String()); err != nil {
+				return err
+			}
+
+			mirrors, err := cmd.Flags().GetStringArray("registry-mirror")
+			if err != nil {
+				return err
+			}
+			insecure, err := cmd.Flags().GetStringArray("insecure-registry")
+			if err != nil {
+				return err
+			}
+			return config.ApplyRegistryFlags(mirrors, insecure)
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
 	}
 
+	rootCmd.PersistentFlags().String("root", "", "Root directory of persistent state (default \""+config.DefaultRoot+"\", env "+config.RootEnv+")")
+	rootCmd.PersistentFlags().String("state", "", "Directory of ephemeral runtime files (default \""+config.DefaultState+"\", env "+config.StateEnv+")")
+	rootCmd.PersistentFlags().String("config", "", "Config file (default \""+config.DefaultConfigFile+"\", env "+config.ConfigEnv+")")
+	rootCmd.PersistentFlags().StringArray("registry-mirror", []string{}, "Pull from a mirror first, [REGISTRY=]MIRROR, the default registry is Docker Hub")
+	rootCmd.PersistentFlags().StringArray("insecure-registry", []string{}, "Access a registry by HTTP or without verifying its certificate")
+
 	for _, cmd := range container.ContainerCommands() {
 		rootCmd.AddCommand(cmd)
 	}
 
-	rootCmd.AddCommand(image.ImageCommand())
+	for _, cmd := range image.RegistryCommands() {
+		rootCmd.AddCommand(cmd)
+	}
+
+	imageCmd := image.ImageCommand()
+	imageCmd.AddCommand(system.ImagePruneCommand())
+	imageCmd.AddCommand(build.BuildCommand())
+	rootCmd.AddCommand(imageCmd)
+	rootCmd.AddCommand(container.VolumeCommand())
+	rootCmd.AddCommand(system.SystemCommand())
+	rootCmd.AddCommand(events.EventsCommand())
+	rootCmd.AddCommand(daemon.DaemonCommand())
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		var exitErr *utils.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(utils.ExitCode(err))
 	}
 }
@@ -0,0 +1,194 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"k8s.io/kubernetes/pkg/util/parsers"
+
+	"aproton.tech/container/container"
+	"aproton.tech/container/image"
+	"aproton.tech/container/utils"
+)
+
+func SystemDiskUsageCommand(cmd *cobra.Command, args []string) error {
+	repository, err := image.GetRepositoryUsage()
+	if err != nil {
+		return err
+	}
+
+	containers, err := container.GetContainersUsage()
+	if err != nil {
+		return err
+	}
+
+	volumes, err := container.GetVolumesUsage()
+	if err != nil {
+		return err
+	}
+
+	inUse, err := container.GetImagesInUse()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flag("verbose").Value.String() == "true" {
+		printDiskUsageDetails(repository, containers, volumes, inUse)
+		return nil
+	}
+
+	table := newSystemTableRender([]string{"TYPE", "TOTAL", "ACTIVE", "SIZE", "RECLAIMABLE"})
+
+	activeImages := 0
+	for _, img := range repository.Images {
+		if inUse[img.Name] {
+			activeImages++
+		}
+	}
+	table.Append(newDiskUsageRow("Images", len(repository.Images), activeImages,
+		repository.BlobsSize, repository.ReclaimableImagesSize(inUse)))
+
+	activeLayers, layersSize := 0, uint64(0)
+	for _, layer := range repository.Layers {
+		if len(layer.Containers) != 0 {
+			activeLayers++
+		}
+		layersSize += layer.Size
+	}
+	table.Append(newDiskUsageRow("Layers", len(repository.Layers), activeLayers,
+		layersSize, repository.ReclaimableLayersSize(inUse)))
+
+	activeContainers, containersSize, containersReclaimable := 0, uint64(0), uint64(0)
+	for _, cnt := range containers {
+		if cnt.Running {
+			activeContainers++
+		} else {
+			containersReclaimable += cnt.Size
+		}
+		containersSize += cnt.Size
+	}
+	table.Append(newDiskUsageRow("Containers", len(containers), activeContainers,
+		containersSize, containersReclaimable))
+
+	activeVolumes, volumesSize, volumesReclaimable := 0, uint64(0), uint64(0)
+	for _, vol := range volumes {
+		if vol.Links != 0 {
+			activeVolumes++
+		} else {
+			volumesReclaimable += vol.Size
+		}
+		volumesSize += vol.Size
+	}
+	table.Append(newDiskUsageRow("Local Volumes", len(volumes), activeVolumes,
+		volumesSize, volumesReclaimable))
+
+	table.Render()
+	return nil
+}
+
+func printDiskUsageDetails(repository *image.RepositoryUsage, containers []*container.ContainerUsage,
+	volumes []*container.VolumeUsage, inUse map[string]bool) {
+	containersOfImage := map[string]int{}
+	for _, cnt := range containers {
+		containersOfImage[cnt.Image]++
+	}
+
+	utils.PrintToConsole("Images space usage:\n\n")
+	table := newSystemTableRender([]string{"REPOSITORY", "TAG", "IMAGE ID", "CREATED", "SIZE", "SHARED SIZE", "UNIQUE SIZE", "CONTAINERS"})
+	for _, img := range repository.Images {
+		repo, tag := "<none>", "<none>"
+		if img.Name != "" {
+			if r, t, _, err := parsers.ParseImageName(img.Name); err == nil {
+				repo, tag = r, t
+			}
+		}
+
+		table.Append([]string{
+			repo,
+			tag,
+			img.Digest.Hex[:12],
+			humanize.Time(img.Created),
+			humanize.Bytes(img.Size),
+			humanize.Bytes(img.SharedSize),
+			humanize.Bytes(img.UniqueSize),
+			strconv.Itoa(containersOfImage[img.Name]),
+		})
+	}
+	table.Render()
+
+	utils.PrintToConsole("\nLayers space usage:\n\n")
+	table = newSystemTableRender([]string{"LAYER ID", "SIZE", "IMAGES", "CONTAINERS"})
+	for _, layer := range repository.Layers {
+		table.Append([]string{
+			shortID(layer.DiffID),
+			humanize.Bytes(layer.Size),
+			strconv.Itoa(len(layer.Images)),
+			strconv.Itoa(len(layer.Containers)),
+		})
+	}
+	table.Render()
+
+	utils.PrintToConsole("\nContainers space usage:\n\n")
+	table = newSystemTableRender([]string{"CONTAINER ID", "IMAGE", "COMMAND", "CREATED", "STATUS", "SIZE"})
+	for _, cnt := range containers {
+		table.Append([]string{
+			cnt.ContainerID,
+			cnt.Image,
+			cnt.Command,
+			humanize.Time(cnt.Created),
+			cnt.Status,
+			humanize.Bytes(cnt.Size),
+		})
+	}
+	table.Render()
+
+	utils.PrintToConsole("\nLocal Volumes space usage:\n\n")
+	table = newSystemTableRender([]string{"VOLUME NAME", "LINKS", "SIZE"})
+	for _, vol := range volumes {
+		table.Append([]string{vol.Name, strconv.Itoa(vol.Links), humanize.Bytes(vol.Size)})
+	}
+	table.Render()
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func newDiskUsageRow(kind string, total int, active int, size uint64, reclaimable uint64) []string {
+	percent := 0
+	if size > 0 {
+		percent = int(reclaimable * 100 / size)
+	}
+
+	return []string{
+		kind,
+		strconv.Itoa(total),
+		strconv.Itoa(active),
+		humanize.Bytes(size),
+		fmt.Sprintf("%s (%d%%)", humanize.Bytes(reclaimable), percent),
+	}
+}
+
+func newSystemTableRender(header []string) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetBorder(false)
+	table.SetHeaderLine(false)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+
+	return table
+}
@@ -0,0 +1,101 @@
+package system
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"aproton.tech/container/container"
+	"aproton.tech/container/image"
+	"aproton.tech/container/utils"
+)
+
+func ImagePruneRunCommand(cmd *cobra.Command, args []string) error {
+	all := cmd.Flag("all").Value.String() == "true"
+	dryRun := cmd.Flag("dry-run").Value.String() == "true"
+
+	inUse, err := container.GetImagesInUse()
+	if err != nil {
+		return err
+	}
+
+	report, err := image.PruneImages(all, inUse, dryRun)
+	if err != nil {
+		return err
+	}
+
+	printImageReport(report, dryRun)
+	printReclaimedSpace(report.Bytes, dryRun)
+	return nil
+}
+
+func SystemPruneCommand(cmd *cobra.Command, args []string) error {
+	all := cmd.Flag("all").Value.String() == "true"
+	volumes := cmd.Flag("volumes").Value.String() == "true"
+	dryRun := cmd.Flag("dry-run").Value.String() == "true"
+
+	containers, reclaimed, err := container.PruneContainers(dryRun)
+	if err != nil {
+		return err
+	}
+	printDeleted("Containers", containers, dryRun)
+
+	if volumes {
+		names, size, err := container.PruneVolumes(dryRun)
+		if err != nil {
+			return err
+		}
+		printDeleted("Volumes", names, dryRun)
+		reclaimed += size
+	}
+
+	// in dry-run mode the stopped containers are still there, their images would not be in use anymore
+	inUse, err := container.GetImagesInUse(containers...)
+	if err != nil {
+		return err
+	}
+
+	report, err := image.PruneImages(all, inUse, dryRun)
+	if err != nil {
+		return err
+	}
+
+	printImageReport(report, dryRun)
+	printReclaimedSpace(reclaimed+report.Bytes, dryRun)
+	return nil
+}
+
+func printImageReport(report *image.GCReport, dryRun bool) {
+	printDeleted("Images", report.Images, dryRun)
+
+	blobs := []string{}
+	for _, blob := range report.Blobs {
+		blobs = append(blobs, blob.String())
+	}
+	printDeleted("Blobs", blobs, dryRun)
+	printDeleted("Layers", report.Lowers, dryRun)
+	printDeleted("Temporary Files", report.Temps, dryRun)
+}
+
+func printDeleted(kind string, items []string, dryRun bool) {
+	if len(items) == 0 {
+		return
+	}
+
+	if dryRun {
+		utils.PrintToConsole("Would Delete %s:\n", kind)
+	} else {
+		utils.PrintToConsole("Deleted %s:\n", kind)
+	}
+	for _, item := range items {
+		utils.PrintToConsole("%s\n", item)
+	}
+	utils.PrintToConsole("\n")
+}
+
+func printReclaimedSpace(bytes uint64, dryRun bool) {
+	if dryRun {
+		utils.PrintToConsole("Total reclaimable space: %s\n", humanize.Bytes(bytes))
+	} else {
+		utils.PrintToConsole("Total reclaimed space: %s\n", humanize.Bytes(bytes))
+	}
+}
@@ -0,0 +1,50 @@
+package system
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func SystemCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "system",
+		Short: "manage the container state",
+	}
+
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "remove stopped containers, dangling images and unreferenced layers",
+		Args:  cobra.NoArgs,
+		RunE:  SystemPruneCommand,
+	}
+	prune.Flags().BoolP("all", "a", false, "Remove all unused images, not just dangling ones")
+	prune.Flags().Bool("volumes", false, "Prune volumes")
+	prune.Flags().Bool("dry-run", false, "Only show what would be removed")
+
+	df := &cobra.Command{
+		Use:   "df",
+		Short: "show disk usage of images, layers, containers and volumes",
+		Args:  cobra.NoArgs,
+		RunE:  SystemDiskUsageCommand,
+	}
+	df.Flags().BoolP("verbose", "v", false, "Show detailed information on space usage")
+
+	cmd.AddCommand(prune)
+	cmd.AddCommand(df)
+
+	return cmd
+}
+
+// ImagePruneCommand is registered under the image command, it lives here since
+// the images used by containers can't be known from the image package
+func ImagePruneCommand() *cobra.Command {
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "remove unused images",
+		Args:  cobra.NoArgs,
+		RunE:  ImagePruneRunCommand,
+	}
+	prune.Flags().BoolP("all", "a", false, "Remove all unused images, not just dangling ones")
+	prune.Flags().Bool("dry-run", false, "Only show what would be removed")
+
+	return prune
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CopyDir copies the content of src into dst recursively, keeping
+// permissions, ownership and modification times of every entry
+func CopyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(dst, rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := copyEntry(path, to, fi); err != nil {
+			return err
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(to, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			// chown clears setuid/setgid, so set the mode after it
+			if err := os.Chmod(to, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+				return err
+			}
+			return os.Chtimes(to, fi.ModTime(), fi.ModTime())
+		}
+
+		return nil
+	})
+}
+
+func copyEntry(from, to string, fi fs.FileInfo) error {
+	switch {
+	case fi.IsDir():
+		return os.MkdirAll(to, 0755)
+	case fi.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, to)
+	case fi.Mode().IsRegular():
+		return copyFile(from, to)
+	case fi.Mode()&(fs.ModeDevice|fs.ModeNamedPipe) != 0:
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			return syscall.Mknod(to, st.Mode, int(st.Rdev))
+		}
+	}
+
+	return fmt.Errorf("%s: unsupported file type %s", from, fi.Mode().Type())
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
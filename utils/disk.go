@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiskUsage returns the bytes allocated by the files under path,
+// hard linked files are counted once
+func DiskUsage(path string) (uint64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+
+	seen := map[inode]bool{}
+	size := uint64(0)
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			size += uint64(fi.Size())
+			return nil
+		}
+
+		if st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+
+		size += uint64(st.Blocks) * 512
+		return nil
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	return size, err
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The exit codes of the CLI, they are the same as docker's
+const (
+	// ExitCodeRuntime is a failure of the runtime itself
+	ExitCodeRuntime = 125
+	// ExitCodeCannotInvoke is a container command which can not be executed
+	ExitCodeCannotInvoke = 126
+	// ExitCodeNotFound is a container command which does not exist
+	ExitCodeNotFound = 127
+)
+
+// ExitError carries the exit code of the CLI, an ExitError without Err only
+// sets the code, e.g. the exit code of the container process for run
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+func WithExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+// ExitCode returns the exit code of the CLI for err, ExitCodeRuntime unless err carries one
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitCodeRuntime
+}
@@ -6,6 +6,11 @@ import (
 )
 
 func IsProcessExists(pid int, cmd string) bool {
+	// signal 0 to pid 0 would check the process group of the caller
+	if pid <= 0 {
+		return false
+	}
+
 	process, err := os.FindProcess(pid)
 	if err != nil {
 		return false
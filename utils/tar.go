@@ -2,18 +2,57 @@ package utils
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
-func Untar(r io.Reader, path string) error {
-	dirPermissionRevertList := map[string]fs.FileMode{}
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+type untarOptions struct {
+	overlayWhiteouts bool
+}
+
+type UntarOption func(*untarOptions)
+
+// WithOverlayWhiteouts converts the OCI whiteout files into the format of overlayfs,
+// a deleted file becomes a 0/0 char device and an opaque directory gets the
+// trusted.overlay.opaque xattr, so the extracted layer can be used as a lowerdir
+func WithOverlayWhiteouts() UntarOption {
+	return func(o *untarOptions) {
+		o.overlayWhiteouts = true
+	}
+}
+
+// Untar extracts the tar stream into root. Every entry keeps its type, ownership,
+// permission bits, xattrs and modification time, and no entry can be created or
+// followed outside of root, whatever "../" or symlinks the archive contains.
+func Untar(r io.Reader, root string, opts ...UntarOption) error {
+	options := &untarOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	// the permission and mtime of directories are set at the end,
+	// a read-only directory must stay writable while its children are created
+	dirs := []*tar.Header{}
+	dirPaths := map[*tar.Header]string{}
+
 	tr := tar.NewReader(r)
 	for {
 		hdr, err := tr.Next()
@@ -25,70 +64,451 @@ func Untar(r io.Reader, path string) error {
 			}
 		}
 
-		to := filepath.Join(path, hdr.Name)
+		to, err := resolveTarPath(root, hdr.Name)
+		if err != nil {
+			return err
+		}
 
-		if hdr.Typeflag == tar.TypeDir {
-			if (hdr.FileInfo().Mode().Perm() & 0200) == 0 {
-				orgMod := hdr.Mode
-				hdr.Mode = hdr.Mode | 0200
-				logrus.Debugf("path(%s) change permission (%s) --> (%s)", to, fs.FileMode(orgMod).String(), hdr.FileInfo().Mode().String())
+		if to == filepath.Clean(root) && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%s: can not replace the extract root", hdr.Name)
+		}
 
-				dirPermissionRevertList[to] = fs.FileMode(orgMod)
+		if options.overlayWhiteouts && strings.HasPrefix(filepath.Base(to), WhiteoutPrefix) {
+			if err := convertWhiteout(to, hdr); err != nil {
+				return err
 			}
+			continue
 		}
 
-		canRetry, err := untarFile(to, hdr, tr)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+
+		created, err := untarFile(root, to, hdr, tr)
 		if err != nil {
-			if !canRetry {
-				return err
-			}
+			return err
+		}
+		if !created {
+			continue
+		}
 
-			if err := os.RemoveAll(to); err != nil {
-				return err
-			}
-			if _, err := untarFile(to, hdr, tr); err != nil {
-				return err
-			}
+		if err := setFileOwner(to, hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+			dirPaths[hdr] = to
+			continue
+		}
+
+		if err := setFileAttributes(to, hdr); err != nil {
+			return err
 		}
 	}
 
-	for dir, mod := range dirPermissionRevertList {
-		err := os.Chmod(dir, mod)
-		logrus.Debugf("path(%s) revert permission to (%s), err=%v", dir, mod.String(), err)
+	// children first, creating an entry changes the mtime of its parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setFileAttributes(dirPaths[dirs[i]], dirs[i]); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func untarFile(to string, hdr *tar.Header, r *tar.Reader) (bool, error) {
-	f := hdr.FileInfo()
+// resolveTarPath returns the path of the entry under root, the parent directory is
+// resolved with symlinks evaluated as if root is "/", the last component is not
+// followed, it is the entry to be created
+func resolveTarPath(root, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return filepath.Clean(root), nil
+	}
+
+	parent, err := securejoin.SecureJoin(root, filepath.Dir(clean))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
+
+// untarFile creates the entry, returns false when the entry is skipped
+func untarFile(root, to string, hdr *tar.Header, r *tar.Reader) (bool, error) {
+	mode := hdr.FileInfo().Mode()
 
-	getRealLinkName := func(linkname string) string {
-		base := to[:(len(to) - len(hdr.Name))]
-		return path.Join(base, linkname)
+	if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeXGlobalHeader {
+		// never write through an existing entry, it may be a symlink pointing out of root
+		if err := removeExisting(to); err != nil {
+			return false, err
+		}
 	}
 
 	switch hdr.Typeflag {
 	case tar.TypeDir:
-		return true, os.MkdirAll(to, f.Mode())
-	case tar.TypeReg, tar.TypeChar, tar.TypeBlock, tar.TypeFifo, tar.TypeGNUSparse:
-		f, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_RDWR, f.Mode())
+		fi, err := os.Lstat(to)
+		if err == nil && !fi.IsDir() {
+			if err := os.Remove(to); err != nil {
+				return false, err
+			}
+		}
+		if err := os.Mkdir(to, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return false, err
+		}
+		return true, nil
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		f, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
 		if err != nil {
-			return true, err
+			return false, err
 		}
 
 		defer f.Close()
 		if _, err := io.Copy(f, r); err != nil {
 			return false, err
 		}
-		return false, nil
+		return true, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := uint32(syscall.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			fileType = syscall.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			fileType = syscall.S_IFBLK
+		}
+
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(to, fileType|uint32(mode.Perm()), int(dev)); err != nil {
+			if errors.Is(err, syscall.EPERM) && os.Geteuid() != 0 {
+				logrus.Warnf("%s: skip device file, mknod is not permitted", hdr.Name)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
 	case tar.TypeSymlink:
 		return true, os.Symlink(hdr.Linkname, to)
 	case tar.TypeLink:
-		return true, os.Link(getRealLinkName(hdr.Linkname), to)
+		target, err := resolveTarPath(root, hdr.Linkname)
+		if err != nil {
+			return false, err
+		}
+		// a hard link shares the inode, the attributes were already set by the target entry
+		return false, os.Link(target, to)
 	case tar.TypeXGlobalHeader:
 		return false, nil
 	default:
 		return false, fmt.Errorf("%s: unknown type flag: %c", hdr.Name, hdr.Typeflag)
 	}
 }
+
+func removeExisting(to string) error {
+	fi, err := os.Lstat(to)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.IsDir() {
+		return os.RemoveAll(to)
+	}
+	return os.Remove(to)
+}
+
+func setFileOwner(to string, hdr *tar.Header) error {
+	if err := os.Lchown(to, hdr.Uid, hdr.Gid); err != nil {
+		if errors.Is(err, syscall.EPERM) && os.Geteuid() != 0 {
+			logrus.Debugf("%s: skip chown to %d:%d, %v", hdr.Name, hdr.Uid, hdr.Gid, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// setFileAttributes sets the mode, xattrs and times of the entry, it must run after chown,
+// chown clears the setuid/setgid bits and the security.capability xattr
+func setFileAttributes(to string, hdr *tar.Header) error {
+	mode := hdr.FileInfo().Mode()
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(to, mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+
+		xattr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(to, xattr, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				logrus.Warnf("%s: ignore xattr %s, %v", hdr.Name, xattr, err)
+				continue
+			}
+			return fmt.Errorf("%s: set xattr %s: %w", hdr.Name, xattr, err)
+		}
+	}
+
+	return setFileTimes(to, hdr)
+}
+
+func setFileTimes(to string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(timeToNsec(atime)),
+		unix.NsecToTimespec(timeToNsec(hdr.ModTime)),
+	}
+
+	// the symlink itself gets the times, not its target
+	return unix.UtimesNanoAt(unix.AT_FDCWD, to, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func timeToNsec(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func convertWhiteout(to string, hdr *tar.Header) error {
+	dir, base := filepath.Split(to)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if base == WhiteoutOpaque {
+		return unix.Lsetxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
+	}
+
+	target := filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+	if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+		return err
+	}
+	return os.Lchown(target, hdr.Uid, hdr.Gid)
+}
+
+type tarOptions struct {
+	overlayWhiteouts bool
+	excluded         map[string]bool
+}
+
+type TarOption func(*tarOptions)
+
+// FromOverlayWhiteouts converts the whiteouts of overlayfs into the OCI format, a 0/0
+// char device becomes a .wh. file and a directory with the trusted.overlay.opaque xattr
+// gets a .wh..wh..opq entry, so the upperdir of a container can be written as a layer
+func FromOverlayWhiteouts() TarOption {
+	return func(o *tarOptions) {
+		o.overlayWhiteouts = true
+	}
+}
+
+// WithoutPaths leaves the files out, relative to root, e.g. the mount points created by
+// the runtime. A directory is only left out when it has nothing else in it.
+func WithoutPaths(paths ...string) TarOption {
+	return func(o *tarOptions) {
+		if o.excluded == nil {
+			o.excluded = map[string]bool{}
+		}
+		for _, path := range paths {
+			o.excluded[filepath.ToSlash(filepath.Clean(path))] = true
+		}
+	}
+}
+
+// Tar writes the content of root as a tar stream, the entries are named relative to root.
+// Every entry keeps its type, ownership, permission bits, xattrs and modification time,
+// and the files sharing an inode are written as hard links to the first one.
+func Tar(root string, w io.Writer, opts ...TarOption) error {
+	options := &tarOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	tw := tar.NewWriter(w)
+	inodes := map[uint64]string{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		if options.excluded[rel] {
+			if !fi.IsDir() {
+				return nil
+			}
+			if included, err := hasIncludedEntries(path, rel, options.excluded); err != nil {
+				return err
+			} else if !included {
+				return filepath.SkipDir
+			}
+		}
+		st, _ := fi.Sys().(*syscall.Stat_t)
+
+		if options.overlayWhiteouts && fi.Mode()&fs.ModeCharDevice != 0 && st != nil && st.Rdev == 0 {
+			dir, base := filepath.Split(rel)
+			return tw.WriteHeader(&tar.Header{
+				Name:     dir + WhiteoutPrefix + base,
+				Typeflag: tar.TypeReg,
+				Uid:      int(st.Uid),
+				Gid:      int(st.Gid),
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// the names are the ones of the host, the ids are the ones of the image
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+		if err := readXattrs(path, hdr); err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() && st != nil && st.Nlink > 1 {
+			if target, ok := inodes[st.Ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+				return tw.WriteHeader(hdr)
+			}
+			inodes[st.Ino] = rel
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			if err := copyFileContent(tw, path); err != nil {
+				return err
+			}
+		}
+
+		if options.overlayWhiteouts && fi.IsDir() {
+			opaque := make([]byte, 1)
+			if n, err := unix.Lgetxattr(path, "trusted.overlay.opaque", opaque); err == nil && n == 1 && opaque[0] == 'y' {
+				return tw.WriteHeader(&tar.Header{
+					Name:     rel + "/" + WhiteoutOpaque,
+					Typeflag: tar.TypeReg,
+					ModTime:  fi.ModTime(),
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// hasIncludedEntries tells whether the directory has an entry which is not excluded
+func hasIncludedEntries(path string, rel string, excluded map[string]bool) (bool, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		childRel := rel + "/" + entry.Name()
+		if !excluded[childRel] {
+			return true, nil
+		}
+		if entry.IsDir() {
+			if included, err := hasIncludedEntries(filepath.Join(path, entry.Name()), childRel, excluded); err != nil || included {
+				return included, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func copyFileContent(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// readXattrs records the xattrs of the file in the PAX records of the header, the ones
+// of overlayfs itself are left out
+func readXattrs(path string, hdr *tar.Header) error {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return fmt.Errorf("%s: get xattr %s: %w", path, name, err)
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return fmt.Errorf("%s: get xattr %s: %w", path, name, err)
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(value[:vsize])
+		hdr.Format = tar.FormatPAX
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type tarEntry struct {
+	hdr     *tar.Header
+	content string
+}
+
+func newTarball(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		if entry.hdr.Typeflag == tar.TypeReg {
+			entry.hdr.Size = int64(len(entry.content))
+		}
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// newUntarDirs returns the extract root and a directory next to it, which must never be written
+func newUntarDirs(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+}
+
+func assertNotExist(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s should not exist, got %v", path, err)
+	}
+}
+
+func assertContent(t *testing.T, path string, content string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("%s = %q, want %q", path, got, content)
+	}
+}
+
+func TestUntarConfinesNames(t *testing.T) {
+	root, outside := newUntarDirs(t)
+
+	tarball := newTarball(t,
+		tarEntry{hdr: &tar.Header{Name: "../outside/dotdot", Typeflag: tar.TypeReg, Mode: 0644}, content: "dotdot"},
+		tarEntry{hdr: &tar.Header{Name: "a/../../../outside/nested", Typeflag: tar.TypeReg, Mode: 0644}, content: "nested"},
+		tarEntry{hdr: &tar.Header{Name: filepath.Join(outside, "absolute"), Typeflag: tar.TypeReg, Mode: 0644}, content: "absolute"},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dotdot", "nested", "absolute"} {
+		assertNotExist(t, filepath.Join(outside, name))
+	}
+	assertContent(t, filepath.Join(root, "outside", "dotdot"), "dotdot")
+	assertContent(t, filepath.Join(root, "outside", "nested"), "nested")
+	assertContent(t, filepath.Join(root, outside, "absolute"), "absolute")
+}
+
+func TestUntarSymlinkWriteThrough(t *testing.T) {
+	root, outside := newUntarDirs(t)
+
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tarball := newTarball(t,
+		// a directory symlink pointing out of root, then a file written through it
+		tarEntry{hdr: &tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: outside}},
+		tarEntry{hdr: &tar.Header{Name: "dir/through", Typeflag: tar.TypeReg, Mode: 0644}, content: "through"},
+		tarEntry{hdr: &tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../outside"}},
+		tarEntry{hdr: &tar.Header{Name: "up/relative", Typeflag: tar.TypeReg, Mode: 0644}, content: "relative"},
+		// a file symlink pointing out of root, then the same name as a regular file
+		tarEntry{hdr: &tar.Header{Name: "file", Typeflag: tar.TypeSymlink, Linkname: victim}},
+		tarEntry{hdr: &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}, content: "replaced"},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	assertNotExist(t, filepath.Join(outside, "through"))
+	assertNotExist(t, filepath.Join(outside, "relative"))
+	assertContent(t, victim, "original")
+
+	assertContent(t, filepath.Join(root, outside, "through"), "through")
+	assertContent(t, filepath.Join(root, "outside", "relative"), "relative")
+	assertContent(t, filepath.Join(root, "file"), "replaced")
+	if fi, err := os.Lstat(filepath.Join(root, "file")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("file should be replaced by a regular file, got %v, %v", fi, err)
+	}
+}
+
+func TestUntarHardlinkOutside(t *testing.T) {
+	root, outside := newUntarDirs(t)
+
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, linkname := range []string{secret, "../outside/secret"} {
+		tarball := newTarball(t,
+			tarEntry{hdr: &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: linkname}},
+		)
+		if err := Untar(tarball, root); err == nil {
+			t.Errorf("hard link to %s should fail", linkname)
+		}
+		assertNotExist(t, filepath.Join(root, "link"))
+	}
+
+	fi, err := os.Stat(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nlink := fi.Sys().(*syscall.Stat_t).Nlink; nlink != 1 {
+		t.Errorf("secret has %d links, want 1", nlink)
+	}
+}
+
+func TestUntarHardlinkInside(t *testing.T) {
+	root, _ := newUntarDirs(t)
+
+	tarball := newTarball(t,
+		tarEntry{hdr: &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}, content: "shared"},
+		tarEntry{hdr: &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "/file"}},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Stat(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(file, link) {
+		t.Error("link should share the inode of file")
+	}
+}
+
+func TestUntarDevices(t *testing.T) {
+	requireRoot(t)
+	root, _ := newUntarDirs(t)
+
+	tarball := newTarball(t,
+		tarEntry{hdr: &tar.Header{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		tarEntry{hdr: &tar.Header{Name: "loop", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0}},
+		tarEntry{hdr: &tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0600}},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		ftype uint32
+		perm  uint32
+		major uint32
+		minor uint32
+	}{
+		{"null", syscall.S_IFCHR, 0666, 1, 3},
+		{"loop", syscall.S_IFBLK, 0660, 7, 0},
+		{"fifo", syscall.S_IFIFO, 0600, 0, 0},
+	} {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(root, tc.name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode&syscall.S_IFMT != tc.ftype || st.Mode&0777 != tc.perm {
+			t.Errorf("%s: mode %o, want %o", tc.name, st.Mode, tc.ftype|tc.perm)
+		}
+		if unix.Major(st.Rdev) != tc.major || unix.Minor(st.Rdev) != tc.minor {
+			t.Errorf("%s: device %d:%d, want %d:%d", tc.name, unix.Major(st.Rdev), unix.Minor(st.Rdev), tc.major, tc.minor)
+		}
+	}
+}
+
+func TestUntarXattrsAndTimes(t *testing.T) {
+	root, _ := newUntarDirs(t)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	atime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	tarball := newTarball(t,
+		tarEntry{hdr: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, Format: tar.FormatPAX}},
+		tarEntry{hdr: &tar.Header{
+			Name:       "dir/file",
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			ModTime:    mtime,
+			AccessTime: atime,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.test": "value"},
+		}, content: "content"},
+		tarEntry{hdr: &tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", ModTime: mtime, Format: tar.FormatPAX}},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory keeps its mtime though its children were created after it
+	for _, name := range []string{"dir", "dir/file", "dir/link"} {
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "dir/file"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+		t.Errorf("atime %v, want %v", got, atime)
+	}
+
+	value := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(root, "dir/file"), "user.test", value)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("user xattrs are not supported by the filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value[:n]) != "value" {
+		t.Errorf("xattr user.test = %q, want %q", value[:n], "value")
+	}
+}
+
+func TestUntarKeepsSetuidAfterChown(t *testing.T) {
+	requireRoot(t)
+	root, _ := newUntarDirs(t)
+
+	tarball := newTarball(t,
+		tarEntry{hdr: &tar.Header{Name: "setuid", Typeflag: tar.TypeReg, Mode: 0755 | 04000 | 02000, Uid: 1000, Gid: 1000}, content: "#!/bin/sh\n"},
+	)
+	if err := Untar(tarball, root); err != nil {
+		t.Fatal(err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "setuid"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != 1000 || st.Gid != 1000 {
+		t.Errorf("owner %d:%d, want 1000:1000", st.Uid, st.Gid)
+	}
+	if st.Mode&07777 != 06755 {
+		t.Errorf("mode %o, want 6755", st.Mode&07777)
+	}
+}
+
+func TestTarWithoutPaths(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "run", "run/app"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/hosts", "run/app/hosts", "run/app/pid"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Tar(root, buf, WithoutPaths("etc", "etc/hosts", "run/app", "run/app/hosts")); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[strings.TrimSuffix(hdr.Name, "/")] = true
+	}
+
+	// a directory which has something else in it stays
+	for name, want := range map[string]bool{"etc": false, "etc/hosts": false, "run": true, "run/app": true, "run/app/hosts": false, "run/app/pid": true} {
+		if names[name] != want {
+			t.Errorf("%s in tar = %v, want %v", name, names[name], want)
+		}
+	}
+}
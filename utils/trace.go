@@ -1,4 +1,4 @@
-package main
+package utils
 
 func TraceFiles(path string, logfile string) error {
 